@@ -0,0 +1,59 @@
+package functions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+// allowlistCache remembers positive allowlist decisions for up to ttl.
+// Whenever the allowlist membership changes, cached decisions that no longer hold are dropped,
+// so revocations propagate within one allowlist sync regardless of the TTL.
+// All methods are thread-safe.
+type allowlistCache struct {
+	allowlist functions.OnchainAllowlist
+	ttl       time.Duration
+	clock     utils.Clock
+	mu        sync.Mutex
+	version   uint64
+	expiresAt map[common.Address]time.Time
+}
+
+func newAllowlistCache(allowlist functions.OnchainAllowlist, ttl time.Duration, clock utils.Clock) *allowlistCache {
+	return &allowlistCache{
+		allowlist: allowlist,
+		ttl:       ttl,
+		clock:     clock,
+		expiresAt: make(map[common.Address]time.Time),
+	}
+}
+
+func (c *allowlistCache) Allow(address common.Address) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	if version := c.allowlist.Version(); version != c.version {
+		c.version = version
+		for cached, expiresAt := range c.expiresAt {
+			if !now.Before(expiresAt) || !c.allowlist.Allow(cached) {
+				delete(c.expiresAt, cached)
+			}
+		}
+	}
+	if expiresAt, ok := c.expiresAt[address]; ok && now.Before(expiresAt) {
+		return true
+	}
+	// Negative decisions are not cached to keep the cache bounded by the allowlist size.
+	allowed := c.allowlist.Allow(address)
+	if allowed {
+		c.expiresAt[address] = now.Add(c.ttl)
+	} else {
+		delete(c.expiresAt, address)
+	}
+	return allowed
+}
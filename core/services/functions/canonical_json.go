@@ -0,0 +1,21 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// canonicalJSON re-encodes a JSON document with object keys sorted (recursively) and no insignificant
+// whitespace, using encoding/json string escaping. Numbers are kept verbatim, so large integers don't lose
+// precision. Encoding the same logical document always yields the same bytes, which lets verifiers
+// re-encode a decoded payload and still check its signature.
+func canonicalJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	// encoding/json sorts map keys.
+	return json.Marshal(value)
+}
@@ -0,0 +1,53 @@
+package functions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+)
+
+// CompressionGzip can be requested by clients via "accept_compression" in any request payload.
+//
+// The response payload is then replaced by a compressedPayload object with "compression" set to
+// "gzip" and "payload" holding the gzipped original payload. Responses are only compressed when
+// that makes them smaller, so clients must check the "compression" field before decompressing.
+const CompressionGzip = "gzip"
+
+type compressedPayload struct {
+	Compression string `json:"compression"`
+	Payload     []byte `json:"payload"`
+}
+
+// acceptsCompression reports whether the request payload asks for gzip-compressed responses.
+func acceptsCompression(payload json.RawMessage) bool {
+	var request struct {
+		AcceptCompression string `json:"accept_compression"`
+	}
+	if len(payload) == 0 || json.Unmarshal(payload, &request) != nil {
+		return false
+	}
+	return request.AcceptCompression == CompressionGzip
+}
+
+// compressIfSmaller returns the compressed payload wrapper, or the payload itself if compression doesn't pay off.
+func compressIfSmaller(payload json.RawMessage) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	compressed, err := json.Marshal(compressedPayload{
+		Compression: CompressionGzip,
+		Payload:     buf.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(payload) {
+		return payload, nil
+	}
+	return compressed, nil
+}
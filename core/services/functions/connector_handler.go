@@ -1,20 +1,40 @@
 package functions
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/smartcontractkit/chainlink/v2/core/logger"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/connector"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions/config"
 	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
 	"github.com/smartcontractkit/chainlink/v2/core/utils"
 
 	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
 )
 
 type functionsConnectorHandler struct {
@@ -25,12 +45,322 @@ type functionsConnectorHandler struct {
 	nodeAddress string
 	storage     s4.Storage
 	allowlist   functions.OnchainAllowlist
+	config      config.ConnectorHandlerConfig
+	clock       utils.Clock
 	lggr        logger.Logger
+
+	allowlistCache  *allowlistCache
+	signerCache     *SignerCache
+	responseCache   *responseCache
+	dailyQuota      *dailyQuota
+	rateLimiter     *handlers.RateLimiter
+	donRateLimiters map[string]*handlers.RateLimiter
+	dailyQuotaStore DailyQuotaStore
+	quotaResolver   QuotaResolver
+	senderResolver  SenderResolver
+	partialSigner   PartialSigner
+	acceptedDonIds  map[string]struct{}
+	donIdentities   map[string]*ecdsa.PrivateKey
+	requestSchemas  map[string]*requestSchema
+	// readReplica serves secrets_list and secrets_get. Writes (and reads done by writes) use storage.
+	readReplica         s4.Storage
+	readReplicaFallback bool
+	mirrorStorage       s4.Storage
+	mirrorFallbackReads bool
+	mirror              *mirroringStorage
+	// storageBackend describes the storage passed to the constructor, before it is wrapped.
+	storageBackend s4.BackendInfo
+	// metricsRegisterer receives the handler's metrics instead of the global registry, if set.
+	metricsRegisterer prometheus.Registerer
+	metrics           *handlerMetrics
+
+	maintenance atomic.Bool
+	// pausedSenders holds addresses whose requests are rejected with SENDER_PAUSED.
+	pausedSenders sync.Map
+	// writesInFlight tracks the writes of each sender, so that secrets_flush can wait for them.
+	writesInFlight  *writeBarriers
+	gatewayLabelsMu sync.Mutex
+	gatewayLabels   map[string]struct{}
+	// originGateways maps bodies of requests being handled to IDs of gateways that delivered them.
+	// Responses are only ever sent back to the originating gateway.
+	originGateways sync.Map
+	// respondedRequests holds bodies of requests being handled that were already responded to. A request gets at most
+	// one response, e.g. a panic after the response was sent doesn't produce a second, INTERNAL_ERROR response.
+	respondedRequests sync.Map
+	// debugRequests holds bodies of requests whose lifecycle is logged at info level (see requestsDebug).
+	debugRequests sync.Map
+	// idempotentRequests holds response cache keys of requests with an idempotency key that are being handled.
+	idempotentRequests sync.Map
+	// verifiedSenders maps bodies of requests being handled that passed authentication and the allowlist to their
+	// resolved sender. Only responses to these requests are cached, keyed by that sender rather than the claimed one.
+	verifiedSenders sync.Map
+
+	closeWait sync.WaitGroup
+	stopCh    utils.StopChan
+	startedAt time.Time
+
+	onSecretsChanged SecretsChangedCallback
+	roundGate        RoundGate
+	payloadEnforcer  PayloadFormatEnforcer
+	storageBreaker   *circuitBreakerStorage
+	senderCooldown   *cooldownStorage
+	operators        map[ethCommon.Address]struct{}
+	emergencyTokens  *emergencyTokens
+	// slotLocks serializes writes to a slot, nil unless SerializeSlotWrites is set.
+	slotLocks *slotLocks
+	// unsignedResponseMethods are public methods whose responses are sent without a signature.
+	unsignedResponseMethods map[string]struct{}
+	// secureTransportMethods are methods rejected with INSECURE_TRANSPORT over insecure gateway links.
+	secureTransportMethods map[string]struct{}
+}
+
+// ConnectorHandlerOpt customizes optional dependencies of the connector handler.
+type ConnectorHandlerOpt func(*functionsConnectorHandler)
+
+// WithDailyQuotaStore makes daily quota counters, rate limits and cached responses survive node restarts.
+func WithDailyQuotaStore(store DailyQuotaStore) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.dailyQuotaStore = store
+	}
+}
+
+// WithQuotaResolver overrides MaxDailyRequestsPerSender and MaxSlotsPerSender for senders known to the resolver.
+// Daily quotas have no effect when the daily quota is disabled.
+func WithQuotaResolver(resolver QuotaResolver) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.quotaResolver = resolver
+	}
+}
+
+// SenderResolver maps the sender of a request to the canonical address that owns its secrets,
+// e.g. a delegated key to the account it acts for.
+type SenderResolver interface {
+	// ResolveSender returns the address used for allowlist, quota and ownership checks.
+	ResolveSender(ctx context.Context, sender ethCommon.Address) (ethCommon.Address, error)
+}
+
+// WithSenderResolver resolves request senders before any checks. Without a resolver, the sender is used as is.
+// Message signatures are still verified against the sender, not the resolved address.
+func WithSenderResolver(resolver SenderResolver) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.senderResolver = resolver
+	}
+}
+
+// WithReadReplica serves secrets_list and secrets_get from a read-only replica of the storage.
+// With fallbackToPrimary, reads that miss on a lagging replica are retried on the primary storage.
+func WithReadReplica(replica s4.Storage, fallbackToPrimary bool) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.readReplica = replica
+		h.readReplicaFallback = fallbackToPrimary
+	}
+}
+
+// WithMirrorStorage copies successful writes to a secondary storage in the background, as a warm standby.
+// Failed mirror writes are logged and metered, but don't fail requests. With fallbackReads, reads failing
+// on the primary storage are served by the mirror.
+func WithMirrorStorage(mirror s4.Storage, fallbackReads bool) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.mirrorStorage = mirror
+		h.mirrorFallbackReads = fallbackReads
+	}
+}
+
+// WithDonIdentity answers requests for donId under a separate identity on nodes serving multiple DONs: responses
+// carry the address of signerKey as their sender and are signed with it. Other DONs get the node's own identity.
+func WithDonIdentity(donId string, signerKey *ecdsa.PrivateKey) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		if h.donIdentities == nil {
+			h.donIdentities = make(map[string]*ecdsa.PrivateKey)
+		}
+		h.donIdentities[donId] = signerKey
+	}
+}
+
+// WithPartialSigner embeds a threshold signature share into every response payload.
+func WithPartialSigner(signer PartialSigner) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.partialSigner = signer
+	}
+}
+
+// RoundGate restricts writes to a phase of the DON round, e.g. to stay away from round boundaries.
+type RoundGate interface {
+	// AcceptsWrites reports whether a write received at the given time may proceed.
+	AcceptsWrites(now time.Time) bool
 }
 
+// WithRoundGate rejects writes with OUTSIDE_ACCEPTANCE_WINDOW whenever the gate is closed.
+// Without a gate, writes are always accepted.
+func WithRoundGate(gate RoundGate) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.roundGate = gate
+	}
+}
+
+// PayloadFormatEnforcer checks that secret payloads follow the DON's conventions, e.g. an encrypted envelope structure.
+type PayloadFormatEnforcer interface {
+	// CheckPayloadFormat returns an error describing why the payload doesn't conform.
+	CheckPayloadFormat(payload []byte) error
+}
+
+// WithPayloadFormatEnforcer rejects secrets_set payloads the enforcer doesn't accept with PAYLOAD_FORMAT_INVALID.
+// Without an enforcer, any payload format is accepted.
+func WithPayloadFormatEnforcer(enforcer PayloadFormatEnforcer) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.payloadEnforcer = enforcer
+	}
+}
+
+// WithMetricsRegistry registers the handler's metrics in registerer rather than the global registry,
+// e.g. to embed the handler in a process with its own registry or several handlers.
+// Handlers sharing a registry share their metrics.
+func WithMetricsRegistry(registerer prometheus.Registerer) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.metricsRegisterer = registerer
+	}
+}
+
+// SecretsChangedCallback is notified after a secret was successfully set or deleted.
+// Copies, swaps and expiration extensions are reported as sets of the written slots.
+type SecretsChangedCallback func(ctx context.Context, address ethCommon.Address, slotId uint, version uint64, action string) error
+
+const (
+	SecretsActionSet    = "set"
+	SecretsActionDelete = "delete"
+)
+
+// WithOnSecretsChanged registers a callback for successful secrets mutations, e.g. to notify an external system.
+// The callback runs asynchronously, so it doesn't delay responses. Its errors are logged.
+func WithOnSecretsChanged(callback SecretsChangedCallback) ConnectorHandlerOpt {
+	return func(h *functionsConnectorHandler) {
+		h.onSecretsChanged = callback
+	}
+}
+
+const (
+	methodSecretsSet       = "secrets_set"
+	methodSecretsList      = "secrets_list"
+	methodSecretsCopy      = "secrets_copy"
+	methodSecretsSwap      = "secrets_swap"
+	methodSecretsGet       = "secrets_get"
+	methodSecretsBulkTouch = "secrets_bulk_touch"
+	methodSecretsDelete    = "secrets_delete"
+	methodSecretsUsage     = "secrets_usage"
+	methodSecretsFlush     = "secrets_flush"
+	methodSecretsManifest  = "secrets_manifest"
+	methodSecretsListMulti = "secrets_list_multi"
+	methodVerifySignature  = "secrets_verify_signature"
+	methodCheckWrite       = "secrets_check_write"
+	methodPublicKey        = "public_key"
+	methodStatus           = "status"
+	methodSelfTest         = "self_test"
+	methodConfig           = "config"
+	methodWhoAmI           = "whoami"
+)
+
+const (
+	listSortBySlot       = "slot"
+	listSortByExpiration = "expiration"
+	listSortByVersion    = "version"
+)
+
+const (
+	errorCodeDailyQuotaExceeded      = "DAILY_QUOTA_EXCEEDED"
+	errorCodeInternalError           = "INTERNAL_ERROR"
+	errorCodeRequestTagTooLong       = "REQUEST_TAG_TOO_LONG"
+	errorCodePayloadTooLarge         = "PAYLOAD_TOO_LARGE"
+	errorCodeExpired                 = "EXPIRED"
+	errorCodeBadSignatureFormat      = "BAD_SIGNATURE_FORMAT"
+	errorCodeEnvelopeUnauthenticated = "ENVELOPE_UNAUTHENTICATED"
+	errorCodeMaintenanceMode         = "MAINTENANCE_MODE"
+	errorCodeOutsideAcceptanceWindow = "OUTSIDE_ACCEPTANCE_WINDOW"
+	errorCodeStorageUnavailable      = "STORAGE_UNAVAILABLE"
+	errorCodeEmptyPayload            = "EMPTY_PAYLOAD"
+	errorCodeMessageIdReuse          = "MESSAGE_ID_REUSE"
+	errorCodeIdempotencyKeyReuse     = "IDEMPOTENCY_KEY_REUSE"
+	errorCodeInvalidIdempotencyKey   = "INVALID_IDEMPOTENCY_KEY"
+	errorCodeRequestInProgress       = "REQUEST_IN_PROGRESS"
+	errorCodeStartingUp              = "STARTING_UP"
+	errorCodeBadBase64               = "BAD_BASE64"
+	errorCodeExpirationTooLate       = "EXPIRATION_EXCEEDS_RETENTION"
+	errorCodeCooldown                = "COOLDOWN"
+	errorCodeSignerMismatch          = "SIGNER_MISMATCH"
+	errorCodeVersionOutOfRange       = "VERSION_OUT_OF_RANGE"
+	errorCodeExpirationRegression    = "EXPIRATION_REGRESSION"
+	errorCodeStaleVersion            = "STALE_VERSION"
+	errorCodeSenderPaused            = "SENDER_PAUSED"
+	errorCodeMissingMessageId        = "MISSING_MESSAGE_ID"
+	errorCodeInsecureTransport       = "INSECURE_TRANSPORT"
+	errorCodeIntegrityError          = "INTEGRITY_ERROR"
+	errorCodeRateLimited             = "RATE_LIMITED"
+	errorCodeDonRateLimited          = "DON_RATE_LIMITED"
+	errorCodeSchemaValidationFailed  = "SCHEMA_VALIDATION_FAILED"
+	errorCodePayloadFormatInvalid    = "PAYLOAD_FORMAT_INVALID"
+	errorCodeSwapIncomplete          = "SWAP_INCOMPLETE"
+)
+
+// transientErrorCodes are errors a retry of the same request may not get. Responses with them are never cached.
+var transientErrorCodes = map[string]struct{}{
+	errorCodeMaintenanceMode:         {},
+	errorCodeOutsideAcceptanceWindow: {},
+	errorCodeStorageUnavailable:      {},
+	errorCodeCooldown:                {},
+	errorCodeDailyQuotaExceeded:      {},
+	errorCodeInternalError:           {},
+	errorCodeIntegrityError:          {},
+	errorCodeSwapIncomplete:          {},
+}
+
+const stateSaveTimeout = 5 * time.Second
+
+// SigAlgEcdsaSecp256k1 identifies the algorithm of response message signatures: ECDSA over secp256k1
+// of the Keccak-256 hash of the message body (see api.Message.Sign).
+const SigAlgEcdsaSecp256k1 = "ecdsa-secp256k1-keccak256"
+
+// encryptionPublicKeyLength is the length of an uncompressed secp256k1 public key.
+const encryptionPublicKeyLength = 65
+
+// selfTestRecordTTL bounds the lifetime of records written by self_test, in case cleanup fails.
+const selfTestRecordTTL = time.Minute
+
+// defaultMaxListMultiAddresses bounds secrets_list_multi requests unless MaxListMultiAddresses is set.
+const defaultMaxListMultiAddresses = 20
+
+// defaultExpiringSoonWindow is used by secrets_usage when the request doesn't specify a window.
+const defaultExpiringSoonWindow = 24 * time.Hour
+
+// maxSetRequestOverheadBytes accounts for the JSON fields of a secrets_set request other than the payload.
+const maxSetRequestOverheadBytes = 1024
+
+// Metric options are shared by the global metrics and the metrics registered with WithMetricsRegistry.
+var (
+	promHandlerPanicsOpts = prometheus.CounterOpts{
+		Name: "functions_connector_handler_panic",
+		Help: "Metric to track panics recovered while handling gateway messages",
+	}
+	promGatewaySendSuccessOpts = prometheus.CounterOpts{
+		Name: "functions_connector_handler_gateway_send_success",
+		Help: "Metric to track responses successfully sent to each gateway",
+	}
+	promGatewaySendFailureOpts = prometheus.CounterOpts{
+		Name: "functions_connector_handler_gateway_send_failure",
+		Help: "Metric to track responses that failed to be sent to each gateway",
+	}
+	promGatewayLabels = []string{"gateway"}
+)
+
+var (
+	promHandlerPanics      = promauto.NewCounter(promHandlerPanicsOpts)
+	PromGatewaySendSuccess = promauto.NewCounterVec(promGatewaySendSuccessOpts, promGatewayLabels)
+	PromGatewaySendFailure = promauto.NewCounterVec(promGatewaySendFailureOpts, promGatewayLabels)
+)
+
+// maxGatewayMetricLabels bounds the cardinality of per-gateway metrics. Gateway IDs seen after
+// the limit was reached are reported as otherGatewaysLabel.
 const (
-	methodSecretsSet  = "secrets_set"
-	methodSecretsList = "secrets_list"
+	maxGatewayMetricLabels = 32
+	otherGatewaysLabel     = "other"
 )
 
 var (
@@ -38,154 +368,2583 @@ var (
 	_ connector.GatewayConnectorHandler = &functionsConnectorHandler{}
 )
 
-func NewFunctionsConnectorHandler(nodeAddress string, signerKey *ecdsa.PrivateKey, storage s4.Storage, allowlist functions.OnchainAllowlist, lggr logger.Logger) *functionsConnectorHandler {
-	return &functionsConnectorHandler{
-		nodeAddress: nodeAddress,
-		signerKey:   signerKey,
-		storage:     storage,
-		allowlist:   allowlist,
-		lggr:        lggr.Named("functionsConnectorHandler"),
+func NewFunctionsConnectorHandler(nodeAddress string, signerKey *ecdsa.PrivateKey, storage s4.Storage, allowlist functions.OnchainAllowlist, handlerConfig config.ConnectorHandlerConfig, clock utils.Clock, lggr logger.Logger, opts ...ConnectorHandlerOpt) (*functionsConnectorHandler, error) {
+	if signerKey == nil {
+		return nil, errors.New("signerKey is nil")
+	}
+	if signerAddress := crypto.PubkeyToAddress(signerKey.PublicKey); signerAddress != ethCommon.HexToAddress(nodeAddress) {
+		return nil, fmt.Errorf("node address %s doesn't match signer key address %s", nodeAddress, signerAddress)
+	}
+	h := &functionsConnectorHandler{
+		nodeAddress:    nodeAddress,
+		signerKey:      signerKey,
+		storage:        storage,
+		storageBackend: s4.GetBackendInfo(storage),
+		writesInFlight: newWriteBarriers(),
+		allowlist:      allowlist,
+		config:         handlerConfig,
+		clock:          clock,
+		lggr:           lggr.Named("functionsConnectorHandler"),
+		stopCh:         make(utils.StopChan),
+		gatewayLabels:  make(map[string]struct{}),
+	}
+	if handlerConfig.AllowlistCacheTTLSec > 0 {
+		h.allowlistCache = newAllowlistCache(allowlist, time.Duration(handlerConfig.AllowlistCacheTTLSec)*time.Second, clock)
+	}
+	if handlerConfig.SignerCacheSize > 0 {
+		h.signerCache = NewSignerCache(int(handlerConfig.SignerCacheSize), time.Duration(handlerConfig.SignerCacheTTLSec)*time.Second, clock)
+	}
+	if handlerConfig.ResponseCacheSize > 0 {
+		if handlerConfig.ResponseCacheTTLSec == 0 {
+			return nil, errors.New("responseCacheTTLSec must be set when responseCacheSize is")
+		}
+		h.responseCache = newResponseCache(int(handlerConfig.ResponseCacheSize), time.Duration(handlerConfig.ResponseCacheTTLSec)*time.Second, clock)
+	}
+	if handlerConfig.StrictDonIdMatching {
+		h.acceptedDonIds = make(map[string]struct{}, len(handlerConfig.AcceptedDonIds))
+		for _, donId := range handlerConfig.AcceptedDonIds {
+			h.acceptedDonIds[donId] = struct{}{}
+		}
+	}
+	for method, rawSchema := range handlerConfig.RequestSchemas {
+		schema, err := parseRequestSchema(rawSchema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request schema for %s: %w", method, err)
+		}
+		if h.requestSchemas == nil {
+			h.requestSchemas = make(map[string]*requestSchema)
+		}
+		h.requestSchemas[method] = schema
+	}
+	for _, method := range handlerConfig.UnsignedResponseMethods {
+		if !isPublicMethod(method) {
+			return nil, fmt.Errorf("responses to %s must be signed", method)
+		}
+		if h.unsignedResponseMethods == nil {
+			h.unsignedResponseMethods = make(map[string]struct{})
+		}
+		h.unsignedResponseMethods[method] = struct{}{}
+	}
+	for _, method := range handlerConfig.SecureTransportMethods {
+		if h.secureTransportMethods == nil {
+			h.secureTransportMethods = make(map[string]struct{})
+		}
+		h.secureTransportMethods[method] = struct{}{}
+	}
+	if handlerConfig.EmergencyPublicKey != "" {
+		publicKey, err := crypto.UnmarshalPubkey(ethCommon.FromHex(handlerConfig.EmergencyPublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid emergency public key: %w", err)
+		}
+		h.emergencyTokens = newEmergencyTokens(crypto.PubkeyToAddress(*publicKey), clock)
+	}
+	if handlerConfig.SerializeSlotWrites {
+		h.slotLocks = newSlotLocks()
 	}
+	if len(handlerConfig.OperatorAddresses) > 0 {
+		h.operators = make(map[ethCommon.Address]struct{}, len(handlerConfig.OperatorAddresses))
+		for _, operator := range handlerConfig.OperatorAddresses {
+			h.operators[ethCommon.HexToAddress(operator)] = struct{}{}
+		}
+	}
+	if handlerConfig.SenderRateLimitRPS > 0 {
+		burst := int(handlerConfig.SenderRateLimitBurst)
+		if burst == 0 {
+			burst = 1
+		}
+		h.rateLimiter = handlers.NewRateLimiterWithClock(math.Inf(1), 1, handlerConfig.SenderRateLimitRPS, burst, clock)
+	}
+	if handlerConfig.DonRateLimitRPS > 0 || len(handlerConfig.DonRateLimits) > 0 {
+		h.donRateLimiters = make(map[string]*handlers.RateLimiter, len(handlerConfig.DonRateLimits)+1)
+		h.donRateLimiters[""] = newDonRateLimiter(config.DonRateLimit{RPS: handlerConfig.DonRateLimitRPS, Burst: handlerConfig.DonRateLimitBurst}, clock)
+		for donId, limit := range handlerConfig.DonRateLimits {
+			h.donRateLimiters[donId] = newDonRateLimiter(limit, clock)
+		}
+	}
+	if handlerConfig.MaxDailyRequestsPerSender > 0 {
+		resetOffset := time.Duration(handlerConfig.DailyQuotaResetOffsetSec) * time.Second
+		h.dailyQuota = newDailyQuota(handlerConfig.MaxDailyRequestsPerSender, resetOffset, clock)
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	for donId, signerKey := range h.donIdentities {
+		if signerKey == nil {
+			return nil, fmt.Errorf("signer key for DON %s is nil", donId)
+		}
+	}
+	h.metrics = defaultHandlerMetrics()
+	if h.metricsRegisterer != nil {
+		metrics, err := newHandlerMetrics(h.metricsRegisterer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %w", err)
+		}
+		h.metrics = metrics
+	}
+	if h.dailyQuota != nil {
+		h.dailyQuota.resolver = h.quotaResolver
+	}
+	if handlerConfig.StorageRetryAttempts > 0 {
+		retryDelay := time.Duration(handlerConfig.StorageRetryDelayMs) * time.Millisecond
+		h.storage = newRetryingStorage(h.storage, handlerConfig.StorageRetryAttempts, retryDelay, h.lggr)
+		if h.readReplica != nil {
+			h.readReplica = newRetryingStorage(h.readReplica, handlerConfig.StorageRetryAttempts, retryDelay, h.lggr)
+		}
+	}
+	if handlerConfig.StorageCircuitBreakerThreshold > 0 {
+		cooldown := time.Duration(handlerConfig.StorageCircuitBreakerCooldownSec) * time.Second
+		h.storageBreaker = newCircuitBreakerStorage(h.storage, handlerConfig.StorageCircuitBreakerThreshold, cooldown, clock, h.lggr)
+		h.storage = h.storageBreaker
+	}
+	if handlerConfig.SenderTimeoutThreshold > 0 {
+		cooldown := time.Duration(handlerConfig.SenderCooldownSec) * time.Second
+		h.senderCooldown = newCooldownStorage(h.storage, handlerConfig.SenderTimeoutThreshold, cooldown, clock, h.lggr)
+		h.storage = h.senderCooldown
+	}
+	if h.mirrorStorage != nil {
+		h.mirror = newMirroringStorage(h.storage, h.mirrorStorage, h.mirrorFallbackReads, h.metrics.mirrorWriteFailures, h.lggr)
+		h.storage = h.mirror
+	}
+	if handlerConfig.ListCacheTTLSec > 0 {
+		h.storage = newListCachingStorage(h.storage, time.Duration(handlerConfig.ListCacheTTLSec)*time.Second, clock)
+	}
+	return h, nil
 }
 
 func (h *functionsConnectorHandler) SetConnector(connector connector.GatewayConnector) {
 	h.connector = connector
 }
 
+// Sign signs with the node key, which authenticates the node to gateways. Data served for a DON is signed
+// with the DON's identity instead (see signer).
 func (h *functionsConnectorHandler) Sign(data ...[]byte) ([]byte, error) {
 	return common.SignData(h.signerKey, data...)
 }
 
 func (h *functionsConnectorHandler) HandleGatewayMessage(ctx context.Context, gatewayId string, msg *api.Message) {
 	body := &msg.Body
+	h.originGateways.Store(body, gatewayId)
+	defer h.originGateways.Delete(body)
+	defer h.respondedRequests.Delete(body)
+	defer h.recoverPanic(ctx, gatewayId, body)
+
+	// Responses carry the request's DON ID, so requests for other DONs are dropped without a response.
+	if h.acceptedDonIds != nil {
+		if _, ok := h.acceptedDonIds[body.DonId]; !ok {
+			h.lggr.Errorw("request for a DON this node doesn't serve", "id", gatewayId, "donId", body.DonId)
+			return
+		}
+	}
+
 	fromAddr := ethCommon.HexToAddress(body.Sender)
-	if !h.allowlist.Allow(fromAddr) {
+	if h.config.VerifyMessageSignature {
+		if signer, err := msg.ExtractSigner(); err != nil || ethCommon.BytesToAddress(signer) != fromAddr {
+			h.lggr.Errorw("message is not signed by its sender", "id", gatewayId, "address", fromAddr, "err", err)
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeEnvelopeUnauthenticated, "Message signature doesn't match the sender")
+			return
+		}
+	}
+	if h.senderResolver != nil {
+		resolved, err := h.senderResolver.ResolveSender(ctx, fromAddr)
+		if err != nil {
+			h.lggr.Errorw("failed to resolve sender", "id", gatewayId, "address", fromAddr, "err", err)
+			return
+		}
+		fromAddr = resolved
+	}
+	// Answered before the allowlist and other checks, so that rejected callers can find out why,
+	// but behind the rate limiters, so that it can't be used to flood the node.
+	if body.Method == methodWhoAmI && h.config.AllowWhoAmI {
+		if !h.rateLimited(ctx, gatewayId, body, fromAddr) {
+			h.handleWhoAmI(ctx, gatewayId, body, fromAddr)
+		}
+		return
+	}
+	// Operators don't need to be allowlisted to call operator methods. Anyone may fetch the node's public key.
+	if body.Method != methodPublicKey && !h.allow(fromAddr) && !(isOperatorMethod(body.Method) && h.isOperator(fromAddr)) && !h.redeemEmergencyToken(gatewayId, body, fromAddr) {
+		if retryAfter := h.startupGraceRemaining(); retryAfter > 0 {
+			h.lggr.Debugw("allowlist is not loaded yet", "id", gatewayId, "address", fromAddr)
+			h.sendRetryLaterResponse(ctx, gatewayId, body, errorCodeStartingUp, "Node is starting up, retry later", retryAfter)
+			return
+		}
 		h.lggr.Errorw("allowlist prevented the request from this address", "id", gatewayId, "address", fromAddr)
 		return
 	}
+	if _, paused := h.pausedSenders.Load(fromAddr); paused {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeSenderPaused, "Requests from this address are paused")
+		return
+	}
+	// Message IDs correlate responses with requests and key the response cache.
+	if body.MessageId == "" {
+		if !h.config.GenerateMissingMessageIds {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeMissingMessageId, "Message ID must not be empty")
+			return
+		}
+		body.MessageId = uuid.New().String()
+		h.lggr.Warnw("generated ID for a message without one", "id", gatewayId, "address", fromAddr, "messageId", body.MessageId)
+	}
+	if h.requiresSecureTransport(body.Method) && !h.isSecureTransport(gatewayId) {
+		h.lggr.Errorw("sensitive request received over an insecure transport", "id", gatewayId, "method", body.Method, "address", fromAddr)
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeInsecureTransport, fmt.Sprintf("Method %s requires a secure transport", body.Method))
+		return
+	}
+	// Only operators may elevate logging, so that clients can't flood node logs.
+	if requestsDebug(body.Payload) && h.isOperator(fromAddr) {
+		h.debugRequests.Store(body, struct{}{})
+		defer h.debugRequests.Delete(body)
+		start := h.clock.Now()
+		h.lggr.Infow("debug request received", "id", gatewayId, "messageId", body.MessageId, "method", body.Method, "address", fromAddr, "payloadSize", len(body.Payload))
+		defer func() {
+			h.lggr.Infow("debug request handled", "id", gatewayId, "messageId", body.MessageId, "method", body.Method, "duration", h.clock.Now().Sub(start))
+		}()
+	}
+	if h.responseCache != nil {
+		h.verifiedSenders.Store(body, fromAddr)
+		defer h.verifiedSenders.Delete(body)
+		idempotencyKey := requestIdempotencyKey(body.Payload)
+		if len(idempotencyKey) > api.MessageIdMaxLen {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeInvalidIdempotencyKey, fmt.Sprintf("Idempotency key must not be longer than %d bytes", api.MessageIdMaxLen))
+			return
+		}
+		cached, reused := h.responseCache.Get(fromAddr, body)
+		if reused && idempotencyKey != "" {
+			h.lggr.Errorw("idempotency key reused for a different request", "id", gatewayId, "address", fromAddr, "messageId", body.MessageId)
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeIdempotencyKeyReuse, "Idempotency key was already used for a different request")
+			return
+		}
+		if reused {
+			h.lggr.Errorw("message ID reused for a different request", "id", gatewayId, "address", fromAddr, "messageId", body.MessageId)
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeMessageIdReuse, "Message ID was already used for a different request")
+			return
+		}
+		if cached != nil {
+			h.debugw(body, "serving retried request from cache", "id", gatewayId, "messageId", body.MessageId)
+			if err := h.sendCachedResponse(ctx, gatewayId, body, cached); err != nil {
+				h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+			}
+			return
+		}
+		if idempotencyKey != "" {
+			// A retry arriving while the original request is handled must not be processed a second time.
+			inFlightKey := responseCacheKeyOf(fromAddr, body)
+			if _, inFlight := h.idempotentRequests.LoadOrStore(inFlightKey, struct{}{}); inFlight {
+				h.sendRetryLaterResponse(ctx, gatewayId, body, errorCodeRequestInProgress, "A request with this idempotency key is in progress, retry later", time.Second)
+				return
+			}
+			defer h.idempotentRequests.Delete(inFlightKey)
+		}
+	}
+	if h.rateLimited(ctx, gatewayId, body, fromAddr) {
+		return
+	}
+	if h.dailyQuota != nil && !h.dailyQuota.Allow(fromAddr, h.methodWeight(body.Method)) {
+		h.debugw(body, "daily request quota exceeded", "id", gatewayId, "address", fromAddr)
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeDailyQuotaExceeded, "Daily request quota exceeded")
+		return
+	}
+
+	if maxSize, ok := h.config.MaxPayloadBytesPerMethod[body.Method]; ok && len(body.Payload) > int(maxSize) {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodePayloadTooLarge, fmt.Sprintf("Payload of %d bytes exceeds the %d bytes limit for %s", len(body.Payload), maxSize, body.Method))
+		return
+	}
+	if schema, ok := h.requestSchemas[body.Method]; ok {
+		if err := schema.Validate(body.Payload); err != nil {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeSchemaValidationFailed, fmt.Sprintf("Payload doesn't match the schema at %v", err))
+			return
+		}
+	}
+	if h.config.MaxRequestTagLength > 0 && len(requestTag(body.Payload)) > int(h.config.MaxRequestTagLength) {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeRequestTagTooLong, fmt.Sprintf("Request tag is longer than %d bytes", h.config.MaxRequestTagLength))
+		return
+	}
+
+	h.debugw(body, "handling gateway request", "id", gatewayId, "method", body.Method)
+
+	if h.maintenance.Load() && isWriteMethod(body.Method) {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeMaintenanceMode, "Writes are disabled during maintenance")
+		return
+	}
+	if h.storageBreaker != nil && body.Method != methodStatus && body.Method != methodConfig && h.storageBreaker.IsOpen() {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeStorageUnavailable, "Storage is temporarily unavailable")
+		return
+	}
+	if h.senderCooldown != nil && isWriteMethod(body.Method) {
+		if remaining := h.senderCooldown.CooldownRemaining(fromAddr); remaining > 0 {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeCooldown, fmt.Sprintf("Too many storage timeouts, writes are paused for %s", remaining.Round(time.Second)))
+			return
+		}
+	}
+	if h.roundGate != nil && isWriteMethod(body.Method) && !h.roundGate.AcceptsWrites(h.clock.Now()) {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeOutsideAcceptanceWindow, "Writes are not accepted in the current phase of the DON round")
+		return
+	}
 
-	h.lggr.Debugw("handling gateway request", "id", gatewayId, "method", body.Method)
+	if requestsAck(body.Payload) {
+		h.sendAck(ctx, gatewayId, body)
+	}
+	if isWriteMethod(body.Method) {
+		defer h.writesInFlight.Enter(fromAddr)()
+	}
 
 	switch body.Method {
 	case methodSecretsList:
 		h.handleSecretsList(ctx, gatewayId, body, fromAddr)
 	case methodSecretsSet:
 		h.handleSecretsSet(ctx, gatewayId, body, fromAddr)
+	case methodSecretsGet:
+		h.handleSecretsGet(ctx, gatewayId, body, fromAddr)
+	case methodSecretsCopy:
+		h.handleSecretsCopy(ctx, gatewayId, body, fromAddr)
+	case methodSecretsSwap:
+		h.handleSecretsSwap(ctx, gatewayId, body, fromAddr)
+	case methodSecretsBulkTouch:
+		h.handleSecretsBulkTouch(ctx, gatewayId, body, fromAddr)
+	case methodSecretsDelete:
+		h.handleSecretsDelete(ctx, gatewayId, body, fromAddr)
+	case methodSecretsUsage:
+		h.handleSecretsUsage(ctx, gatewayId, body, fromAddr)
+	case methodSecretsFlush:
+		h.handleSecretsFlush(ctx, gatewayId, body, fromAddr)
+	case methodSecretsManifest:
+		h.handleSecretsManifest(ctx, gatewayId, body, fromAddr)
+	case methodSecretsListMulti:
+		h.handleSecretsListMulti(ctx, gatewayId, body, fromAddr)
+	case methodVerifySignature:
+		h.handleVerifySignature(ctx, gatewayId, body, fromAddr)
+	case methodCheckWrite:
+		h.handleCheckWrite(ctx, gatewayId, body, fromAddr)
+	case methodSelfTest:
+		h.handleSelfTest(ctx, gatewayId, body, fromAddr)
+	case methodConfig:
+		h.handleConfig(ctx, gatewayId, body, fromAddr)
+	case methodStatus:
+		h.handleStatus(ctx, gatewayId, body)
+	case methodPublicKey:
+		h.handlePublicKey(ctx, gatewayId, body)
 	default:
 		h.lggr.Errorw("unsupported method", "id", gatewayId, "method", body.Method)
 	}
 }
 
-func (h *functionsConnectorHandler) Start(ctx context.Context) error {
-	return h.StartOnce("FunctionsConnectorHandler", func() error {
-		return h.allowlist.Start(ctx)
-	})
+// rateLimited checks the per-sender and per-DON rate limiters and responds with a retry hint when either is exhausted.
+func (h *functionsConnectorHandler) rateLimited(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) bool {
+	if h.rateLimiter != nil {
+		if allowed, retryAfter := h.rateLimiter.AllowNWithRetryAfter(fromAddr.Hex(), int(h.methodWeight(body.Method))); !allowed {
+			h.debugw(body, "request rate limited", "id", gatewayId, "address", fromAddr)
+			h.sendRetryLaterResponse(ctx, gatewayId, body, errorCodeRateLimited, "Too many requests, retry later", retryAfter)
+			return true
+		}
+	}
+	if limiter := h.donRateLimiter(body.DonId); limiter != nil {
+		if allowed, retryAfter := limiter.AllowWithRetryAfter(body.DonId); !allowed {
+			h.debugw(body, "DON request rate limited", "id", gatewayId, "donId", body.DonId)
+			h.sendRetryLaterResponse(ctx, gatewayId, body, errorCodeDonRateLimited, "Too many requests for this DON, retry later", retryAfter)
+			return true
+		}
+	}
+	return false
 }
 
-func (h *functionsConnectorHandler) Close() error {
-	return h.StopOnce("FunctionsConnectorHandler", func() error {
-		return h.allowlist.Close()
-	})
+func (h *functionsConnectorHandler) requiresSecureTransport(method string) bool {
+	_, ok := h.secureTransportMethods[method]
+	return ok
 }
 
-func (h *functionsConnectorHandler) handleSecretsList(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
-	type ListRow struct {
-		SlotID     uint   `json:"slot_id"`
-		Version    uint64 `json:"version"`
-		Expiration int64  `json:"expiration"`
-	}
+// isSecureTransport reports whether the connector knows the link to the gateway to be secure.
+func (h *functionsConnectorHandler) isSecureTransport(gatewayId string) bool {
+	reporter, ok := h.connector.(connector.TransportSecurityReporter)
+	return ok && reporter.IsSecureTransport(gatewayId)
+}
 
-	type ListResponse struct {
-		Success      bool      `json:"success"`
-		ErrorMessage string    `json:"error_message,omitempty"`
-		Rows         []ListRow `json:"rows,omitempty"`
+// isWriteMethod reports whether a method modifies S4 and is therefore rejected in maintenance mode.
+func isWriteMethod(method string) bool {
+	switch method {
+	case methodSecretsSet, methodSecretsCopy, methodSecretsSwap, methodSecretsBulkTouch, methodSecretsDelete, methodSelfTest:
+		return true
 	}
+	return false
+}
 
-	var response ListResponse
-	snapshot, err := h.storage.List(ctx, fromAddr)
-	if err == nil {
-		response.Success = true
-		response.Rows = make([]ListRow, len(snapshot))
-		for i, row := range snapshot {
-			response.Rows[i] = ListRow{
-				SlotID:     row.SlotId,
-				Version:    row.Version,
-				Expiration: row.Expiration,
-			}
-		}
-	} else {
-		response.ErrorMessage = fmt.Sprintf("Failed to list secrets: %v", err)
+// isOperatorMethod reports whether a method may only be called by OperatorAddresses.
+func isOperatorMethod(method string) bool {
+	return method == methodSelfTest || method == methodConfig || method == methodSecretsListMulti
+}
+
+// isPublicMethod reports whether a method only returns information that is not specific to the sender,
+// so that gateways accept unsigned responses to it.
+func isPublicMethod(method string) bool {
+	return api.IsUnsignedResponseMethod(method)
+}
+
+// SetMaintenanceMode toggles maintenance mode. While enabled, requests that write to S4 are rejected
+// with MAINTENANCE_MODE and reads are served as usual.
+func (h *functionsConnectorHandler) SetMaintenanceMode(enabled bool) {
+	if h.maintenance.Swap(enabled) != enabled {
+		h.lggr.Infow("maintenance mode changed", "enabled", enabled)
 	}
+}
 
-	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
-		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+// PauseSender rejects all requests from the address with SENDER_PAUSED until ResumeSender is called,
+// e.g. during an investigation. Paused senders are not persisted and are resumed on restart.
+func (h *functionsConnectorHandler) PauseSender(address ethCommon.Address) {
+	if _, paused := h.pausedSenders.LoadOrStore(address, struct{}{}); !paused {
+		h.lggr.Infow("sender paused", "address", address)
 	}
 }
 
-func (h *functionsConnectorHandler) handleSecretsSet(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
-	type SetRequest struct {
-		SlotID     uint   `json:"slot_id"`
-		Version    uint64 `json:"version"`
-		Expiration int64  `json:"expiration"`
-		Payload    []byte `json:"payload"`
-		Signature  []byte `json:"signature"`
+// ResumeSender lifts PauseSender.
+func (h *functionsConnectorHandler) ResumeSender(address ethCommon.Address) {
+	if _, paused := h.pausedSenders.LoadAndDelete(address); paused {
+		h.lggr.Infow("sender resumed", "address", address)
 	}
+}
 
-	type SetResponse struct {
-		Success      bool   `json:"success"`
-		ErrorMessage string `json:"error_message,omitempty"`
+// methodWeight is the number of daily quota units and per-sender rate limit tokens consumed by a request
+// (1 unless configured otherwise).
+func (h *functionsConnectorHandler) methodWeight(method string) uint32 {
+	if weight, ok := h.config.DailyQuotaMethodWeights[method]; ok {
+		return weight
 	}
+	return 1
+}
 
-	var request SetRequest
-	var response SetResponse
-	err := json.Unmarshal(body.Payload, &request)
-	if err == nil {
-		key := s4.Key{
-			Address: fromAddr,
-			SlotId:  request.SlotID,
-			Version: request.Version,
-		}
-		record := s4.Record{
-			Expiration: request.Expiration,
-			Payload:    request.Payload,
-		}
-		err = h.storage.Put(ctx, &key, &record, request.Signature)
-		if err == nil {
-			response.Success = true
-		} else {
-			response.ErrorMessage = fmt.Sprintf("Failed to set secret: %v", err)
-		}
-	} else {
-		response.ErrorMessage = fmt.Sprintf("Bad request to set secret: %v", err)
+// newDonRateLimiter returns the limiter of a DON, or nil if the DON isn't limited.
+func newDonRateLimiter(limit config.DonRateLimit, clock utils.Clock) *handlers.RateLimiter {
+	if limit.RPS <= 0 {
+		return nil
 	}
+	burst := int(limit.Burst)
+	if burst == 0 {
+		burst = 1
+	}
+	return handlers.NewRateLimiterWithClock(math.Inf(1), 1, limit.RPS, burst, clock)
+}
 
-	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
-		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+// donRateLimiter returns the limiter applying to requests for donId, or nil if they aren't limited.
+// DONs without an override use the default limiter, stored under "".
+func (h *functionsConnectorHandler) donRateLimiter(donId string) *handlers.RateLimiter {
+	if limiter, ok := h.donRateLimiters[donId]; ok {
+		return limiter
 	}
+	return h.donRateLimiters[""]
 }
 
-func (h *functionsConnectorHandler) sendResponse(ctx context.Context, gatewayId string, requestBody *api.MessageBody, payload any) error {
-	payloadJson, err := json.Marshal(payload)
-	if err != nil {
-		return err
+// startupGraceRemaining returns how long the node may still be waiting for its first allowlist update,
+// or zero once the allowlist was loaded or StartupGraceSec has passed since Start.
+func (h *functionsConnectorHandler) startupGraceRemaining() time.Duration {
+	if h.config.StartupGraceSec == 0 || !h.allowlist.LastUpdated().IsZero() {
+		return 0
 	}
+	graceEnd := h.startedAt.Add(time.Duration(h.config.StartupGraceSec) * time.Second)
+	return graceEnd.Sub(h.clock.Now())
+}
 
-	msg := &api.Message{
-		Body: api.MessageBody{
-			MessageId: requestBody.MessageId,
-			DonId:     requestBody.DonId,
-			Method:    requestBody.Method,
-			Sender:    h.nodeAddress,
-			Payload:   payloadJson,
-		},
+// sendRetryLaterResponse rejects a request that may succeed after retryAfter.
+func (h *functionsConnectorHandler) sendRetryLaterResponse(ctx context.Context, gatewayId string, body *api.MessageBody, errorCode string, errorMessage string, retryAfter time.Duration) {
+	type RetryLaterResponse struct {
+		Success      bool   `json:"success"`
+		ErrorCode    string `json:"error_code"`
+		ErrorMessage string `json:"error_message"`
+		// RetryAfterSec is rounded up to whole seconds.
+		RetryAfterSec int64 `json:"retry_after_sec"`
 	}
-	if err = msg.Sign(h.signerKey); err != nil {
-		return err
+	response := RetryLaterResponse{
+		ErrorCode:     errorCode,
+		ErrorMessage:  errorMessage,
+		RetryAfterSec: int64((retryAfter + time.Second - 1) / time.Second),
 	}
+	if err := h.sendResponseWithCaching(ctx, gatewayId, body, response, false); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
 
-	err = h.connector.SendToGateway(ctx, gatewayId, msg)
-	if err == nil {
-		h.lggr.Debugw("sent to gateway", "id", gatewayId, "messageId", requestBody.MessageId, "donId", requestBody.DonId, "method", requestBody.Method)
+// sendStaleVersionResponse reports a write rejected by S4 because its version isn't higher than the stored one.
+func (h *functionsConnectorHandler) sendStaleVersionResponse(ctx context.Context, gatewayId string, body *api.MessageBody, currentVersion uint64) {
+	type StaleVersionResponse struct {
+		Success      bool   `json:"success"`
+		ErrorCode    string `json:"error_code"`
+		ErrorMessage string `json:"error_message"`
+		// CurrentVersion is the version of the stored record. Writes must use a higher version.
+		CurrentVersion uint64 `json:"current_version"`
 	}
-	return err
+	response := StaleVersionResponse{
+		ErrorCode:      errorCodeStaleVersion,
+		ErrorMessage:   fmt.Sprintf("Version must be greater than the current version %d", currentVersion),
+		CurrentVersion: currentVersion,
+	}
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) allow(address ethCommon.Address) bool {
+	if h.allowlistCache != nil {
+		return h.allowlistCache.Allow(address)
+	}
+	return h.allowlist.Allow(address)
+}
+
+// redeemEmergencyToken reports whether the request carries a valid, unused emergency token, which lets it bypass
+// the allowlist, and invalidates the token.
+func (h *functionsConnectorHandler) redeemEmergencyToken(gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) bool {
+	if h.emergencyTokens == nil {
+		return false
+	}
+	var request struct {
+		EmergencyToken *struct {
+			EmergencyToken
+			Signature []byte `json:"signature"`
+		} `json:"emergency_token"`
+	}
+	if len(body.Payload) == 0 || json.Unmarshal(body.Payload, &request) != nil || request.EmergencyToken == nil {
+		return false
+	}
+	token := request.EmergencyToken
+	if err := h.emergencyTokens.Redeem(token.EmergencyToken, token.Signature, fromAddr); err != nil {
+		h.lggr.Errorw("emergency token rejected", "id", gatewayId, "address", fromAddr, "tokenId", token.ID, "err", err)
+		return false
+	}
+	h.lggr.Criticalw("emergency token used to bypass the allowlist", "id", gatewayId, "address", fromAddr, "tokenId", token.ID, "method", body.Method, "messageId", body.MessageId)
+	return true
+}
+
+// recoverPanic must be deferred directly. It makes sure a single bad message can't take down the handler.
+func (h *functionsConnectorHandler) recoverPanic(ctx context.Context, gatewayId string, body *api.MessageBody) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	h.metrics.panics.Inc()
+	h.lggr.Criticalw("recovered from panic while handling gateway message", "id", gatewayId, "messageId", body.MessageId, "method", body.Method, "sender", body.Sender, "panic", r, "stack", string(debug.Stack()))
+	h.sendErrorResponse(ctx, gatewayId, body, errorCodeInternalError, "Internal error")
+	if h.config.RethrowPanics {
+		panic(r)
+	}
+}
+
+func (h *functionsConnectorHandler) Start(ctx context.Context) error {
+	return h.StartOnce(h.Name(), func() error {
+		h.startedAt = h.clock.Now()
+		if h.persistsState() {
+			snapshot, err := h.dailyQuotaStore.Load(ctx)
+			if err != nil {
+				h.lggr.Errorw("failed to load limiter state", "error", err)
+			} else if snapshot != nil {
+				h.restoreState(snapshot)
+			}
+			if h.config.StateCheckpointFrequencySec > 0 {
+				h.closeWait.Add(1)
+				go h.checkpointLoop(time.Duration(h.config.StateCheckpointFrequencySec) * time.Second)
+			}
+		}
+		return h.allowlist.Start(ctx)
+	})
+}
+
+func (h *functionsConnectorHandler) Close() error {
+	return h.StopOnce(h.Name(), func() error {
+		close(h.stopCh)
+		h.closeWait.Wait()
+		if h.mirror != nil {
+			h.mirror.Close()
+		}
+		if h.persistsState() {
+			h.saveState()
+		}
+		return h.allowlist.Close()
+	})
+}
+
+func (h *functionsConnectorHandler) Name() string {
+	return "FunctionsConnectorHandler"
+}
+
+func (h *functionsConnectorHandler) HealthReport() map[string]error {
+	report := map[string]error{h.Name(): h.Healthy()}
+	if h.maintenance.Load() {
+		report[h.Name()+".Maintenance"] = errors.New("maintenance mode is enabled, writes are rejected")
+	}
+	if h.storageBreaker != nil && h.storageBreaker.IsOpen() {
+		report[h.Name()+".StorageCircuitBreaker"] = errStorageUnavailable
+	}
+	return report
+}
+
+func (h *functionsConnectorHandler) checkpointLoop(frequency time.Duration) {
+	defer h.closeWait.Done()
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopCh:
+			return
+		case <-ticker.C:
+			h.saveState()
+		}
+	}
+}
+
+// persistsState is true if there is a store and any limiter state to save in it.
+func (h *functionsConnectorHandler) persistsState() bool {
+	return h.dailyQuotaStore != nil && (h.dailyQuota != nil || h.rateLimiter != nil || h.responseCache != nil)
+}
+
+func (h *functionsConnectorHandler) saveState() {
+	ctx, cancel := context.WithTimeout(context.Background(), stateSaveTimeout)
+	defer cancel()
+	snapshot := &DailyQuotaSnapshot{}
+	if h.dailyQuota != nil {
+		snapshot = h.dailyQuota.Snapshot()
+	}
+	if h.rateLimiter != nil {
+		tokens, at := h.rateLimiter.UserTokens()
+		if len(tokens) > 0 {
+			snapshot.RateLimitTokens = make(map[ethCommon.Address]float64, len(tokens))
+			for sender, left := range tokens {
+				snapshot.RateLimitTokens[ethCommon.HexToAddress(sender)] = left
+			}
+			snapshot.RateLimitTokensAt = at.UnixMilli()
+		}
+	}
+	if h.responseCache != nil {
+		snapshot.Responses = h.responseCache.Snapshot()
+	}
+	if err := h.dailyQuotaStore.Save(ctx, snapshot); err != nil {
+		h.lggr.Errorw("failed to save limiter state", "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) restoreState(snapshot *DailyQuotaSnapshot) {
+	if h.dailyQuota != nil {
+		h.dailyQuota.Restore(snapshot)
+	}
+	if h.rateLimiter != nil && len(snapshot.RateLimitTokens) > 0 {
+		tokens := make(map[string]float64, len(snapshot.RateLimitTokens))
+		for sender, left := range snapshot.RateLimitTokens {
+			tokens[sender.Hex()] = left
+		}
+		h.rateLimiter.RestoreUserTokens(tokens, time.UnixMilli(snapshot.RateLimitTokensAt))
+	}
+	if h.responseCache != nil {
+		h.responseCache.Restore(snapshot.Responses)
+	}
+}
+
+func (h *functionsConnectorHandler) handleSecretsList(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type ListRequest struct {
+		// SortBy is one of "slot" (default), "expiration" or "version".
+		SortBy     string `json:"sort_by"`
+		Descending bool   `json:"descending"`
+		// ModifiedSince (unix time in milliseconds) limits results to records updated after it, for incremental syncs.
+		ModifiedSince int64 `json:"modified_since"`
+		// IncludePayloads inlines payloads of at most MaxInlinePayloadBytes, saving a secrets_get per slot.
+		IncludePayloads bool `json:"include_payloads"`
+		// Cursor resumes the listing after the page that returned it as next_cursor.
+		Cursor string `json:"cursor"`
+		// Limit caps the page size below MaxListRows.
+		Limit uint32 `json:"limit"`
+	}
+
+	type ListRow struct {
+		SlotID     uint   `json:"slot_id"`
+		Version    uint64 `json:"version"`
+		Expiration int64  `json:"expiration"`
+		CreatedAt  int64  `json:"created_at,omitempty"`
+		UpdatedAt  int64  `json:"updated_at,omitempty"`
+		// Deleted rows are tombstones, signed by the node (see Tombstone).
+		Deleted            bool   `json:"deleted,omitempty"`
+		TombstoneSignature []byte `json:"tombstone_signature,omitempty"`
+		Payload            []byte `json:"payload,omitempty"`
+		// PayloadOmitted is set when payloads were requested, but this one is too large to be inlined.
+		PayloadOmitted bool `json:"payload_omitted,omitempty"`
+	}
+
+	type ListResponse struct {
+		Success      bool      `json:"success"`
+		ErrorMessage string    `json:"error_message,omitempty"`
+		Rows         []ListRow `json:"rows,omitempty"`
+		// Truncated is set when rows beyond the page size were left out. NextCursor then fetches the next page.
+		Truncated  bool   `json:"truncated,omitempty"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	var request ListRequest
+	var response ListResponse
+	err := unmarshalOptionalPayload(body.Payload, &request)
+	if err == nil {
+		err = validateListSortBy(request.SortBy)
+	}
+	if err == nil && request.IncludePayloads && h.config.MaxInlinePayloadBytes == 0 {
+		err = errors.New("payload inclusion is disabled")
+	}
+	var cursor *listCursor
+	if err == nil && request.Cursor != "" {
+		cursor, err = decodeListCursor(request.Cursor, request.SortBy, request.Descending)
+	}
+	if err == nil {
+		var snapshot []*s4.SnapshotRow
+		snapshot, err = h.listForRead(ctx, fromAddr)
+		if err == nil {
+			if request.ModifiedSince > 0 {
+				snapshot = filterModifiedSince(snapshot, time.UnixMilli(request.ModifiedSince))
+			}
+			sortSnapshotRows(snapshot, request.SortBy, request.Descending)
+			if cursor != nil {
+				snapshot = cursor.rowsAfter(snapshot)
+			}
+			pageSize := int(h.config.MaxListRows)
+			if request.Limit > 0 && (pageSize == 0 || int(request.Limit) < pageSize) {
+				pageSize = int(request.Limit)
+			}
+			if pageSize > 0 && len(snapshot) > pageSize {
+				snapshot = snapshot[:pageSize]
+				response.Truncated = true
+				response.NextCursor = newListCursor(request.SortBy, request.Descending, snapshot[pageSize-1]).Encode()
+			}
+			response.Rows = make([]ListRow, 0, len(snapshot))
+			rowsSize := 0
+			for i, row := range snapshot {
+				listRow := ListRow{
+					SlotID:     row.SlotId,
+					Version:    row.Version,
+					Expiration: row.Expiration,
+					CreatedAt:  unixMilli(row.CreatedAt),
+					UpdatedAt:  unixMilli(row.UpdatedAt),
+				}
+				if h.isTombstone(row.PayloadSize) {
+					tombstone := Tombstone{Address: fromAddr, SlotID: row.SlotId, Version: row.Version, DeletedAt: unixMilli(row.UpdatedAt)}
+					listRow.Deleted = true
+					listRow.TombstoneSignature, err = tombstone.Sign(h.signer(body.DonId))
+					if err != nil {
+						break
+					}
+				} else if request.IncludePayloads {
+					var inlined bool
+					listRow.Payload, inlined, err = h.inlinePayload(ctx, fromAddr, row)
+					if err != nil {
+						break
+					}
+					listRow.PayloadOmitted = !inlined
+				}
+				if h.config.MaxListResponseBytes > 0 {
+					// A page always has at least one row, so that clients can page through any listing.
+					rowsSize += encodedSize(listRow) + 1
+					if i > 0 && rowsSize > int(h.config.MaxListResponseBytes) {
+						response.Truncated = true
+						response.NextCursor = newListCursor(request.SortBy, request.Descending, snapshot[i-1]).Encode()
+						break
+					}
+				}
+				response.Rows = append(response.Rows, listRow)
+			}
+		}
+		if errors.Is(err, errIntegrity) {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeIntegrityError, fmt.Sprintf("Stored record failed the integrity check: %v", err))
+			return
+		}
+		if err == nil {
+			response.Success = true
+		} else {
+			response.Rows = nil
+			response.ErrorMessage = fmt.Sprintf("Failed to list secrets: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to list secrets: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// encodedSize returns the length of the JSON encoding of v, or zero if it can't be encoded.
+func encodedSize(v any) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+func (h *functionsConnectorHandler) handleSecretsUsage(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type UsageRequest struct {
+		// ExpiringWithinSec defines "expiring soon" (defaults to 24 hours).
+		ExpiringWithinSec uint32 `json:"expiring_within_sec"`
+	}
+
+	type UsageResponse struct {
+		Success         bool   `json:"success"`
+		ErrorMessage    string `json:"error_message,omitempty"`
+		SlotsUsed       int    `json:"slots_used"`
+		BytesUsed       uint64 `json:"bytes_used"`
+		MaxSlots        uint   `json:"max_slots"`
+		MaxPayloadBytes uint   `json:"max_payload_bytes"`
+		ExpiringSoon    int    `json:"expiring_soon"`
+	}
+
+	var request UsageRequest
+	var response UsageResponse
+	err := unmarshalOptionalPayload(body.Payload, &request)
+	if err == nil {
+		var snapshot []*s4.SnapshotRow
+		snapshot, err = h.listForRead(ctx, fromAddr)
+		if err == nil {
+			window := defaultExpiringSoonWindow
+			if request.ExpiringWithinSec > 0 {
+				window = time.Duration(request.ExpiringWithinSec) * time.Second
+			}
+			expiringBefore := h.clock.Now().Add(window).UnixMilli()
+			response.Success = true
+			response.MaxSlots = h.slotQuota(fromAddr)
+			response.MaxPayloadBytes = h.storage.Constraints().MaxPayloadSizeBytes
+			// Tombstones occupy slots until they expire, but are never reported as expiring secrets.
+			response.SlotsUsed = len(snapshot)
+			for _, row := range snapshot {
+				response.BytesUsed += row.PayloadSize
+				if !h.isTombstone(row.PayloadSize) && row.Expiration < expiringBefore {
+					response.ExpiringSoon++
+				}
+			}
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to get secrets usage: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to get secrets usage: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func filterModifiedSince(rows []*s4.SnapshotRow, since time.Time) []*s4.SnapshotRow {
+	var filtered []*s4.SnapshotRow
+	for _, row := range rows {
+		if row.UpdatedAt.After(since) {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered
+}
+
+// inlinePayload returns the payload of a listed record. It isn't inlined if it is larger than MaxInlinePayloadBytes
+// or was overwritten since it was listed.
+func (h *functionsConnectorHandler) inlinePayload(ctx context.Context, address ethCommon.Address, row *s4.SnapshotRow) (payload []byte, inlined bool, err error) {
+	if row.PayloadSize > uint64(h.config.MaxInlinePayloadBytes) {
+		return nil, false, nil
+	}
+	record, metadata, err := h.getForRead(ctx, &s4.Key{Address: address, SlotId: row.SlotId})
+	if err != nil {
+		return nil, false, fmt.Errorf("slot %d: %w", row.SlotId, err)
+	}
+	if metadata.Version != row.Version {
+		return nil, false, nil
+	}
+	if err = h.verifyIntegrity(s4.Key{Address: address, SlotId: row.SlotId}, record, metadata); err != nil {
+		return nil, false, fmt.Errorf("slot %d: %w", row.SlotId, err)
+	}
+	return record.Payload, true, nil
+}
+
+// errIntegrity is returned for stored records that don't match their signature.
+var errIntegrity = errors.New("record doesn't match its signature")
+
+// verifyIntegrity checks a record read from S4 against the owner's signature, which S4 stores with every record,
+// so that corrupted records are never served. It is a no-op unless VerifyRecordsOnRead is set.
+func (h *functionsConnectorHandler) verifyIntegrity(key s4.Key, record *s4.Record, metadata *s4.Metadata) error {
+	if !h.config.VerifyRecordsOnRead {
+		return nil
+	}
+	key.Version = metadata.Version
+	signer, err := h.getSignerAddress(s4.NewEnvelopeFromRecord(&key, record), metadata.Signature)
+	if err != nil || signer != key.Address {
+		h.lggr.Errorw("stored record failed the integrity check", "address", key.Address, "slotId", key.SlotId, "version", key.Version)
+		return errIntegrity
+	}
+	return nil
+}
+
+// listForRead lists from the read replica, if any. An empty replica listing counts as a miss.
+func (h *functionsConnectorHandler) listForRead(ctx context.Context, address ethCommon.Address) ([]*s4.SnapshotRow, error) {
+	if h.readReplica == nil {
+		return h.storage.List(ctx, address)
+	}
+	rows, err := h.readReplica.List(ctx, address)
+	if err == nil && len(rows) == 0 && h.readReplicaFallback {
+		return h.storage.List(ctx, address)
+	}
+	return rows, err
+}
+
+// getForRead reads from the read replica, if any. Expired records are included.
+func (h *functionsConnectorHandler) getForRead(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metadata, error) {
+	if h.readReplica == nil {
+		return h.storage.GetIncludingExpired(ctx, key)
+	}
+	record, metadata, err := h.readReplica.GetIncludingExpired(ctx, key)
+	if errors.Is(err, s4.ErrNotFound) && h.readReplicaFallback {
+		return h.storage.GetIncludingExpired(ctx, key)
+	}
+	return record, metadata, err
+}
+
+// unmarshalOptionalPayload leaves v untouched when the request carries no payload.
+func unmarshalOptionalPayload(payload json.RawMessage, v any) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func validateListSortBy(sortBy string) error {
+	switch sortBy {
+	case "", listSortBySlot, listSortByExpiration, listSortByVersion:
+		return nil
+	default:
+		return fmt.Errorf("unsupported sort_by: %q", sortBy)
+	}
+}
+
+// sortSnapshotRows orders rows by the given field, breaking ties by ascending slot ID.
+func sortSnapshotRows(rows []*s4.SnapshotRow, sortBy string, descending bool) {
+	less := listOrder(sortBy, descending)
+	sort.SliceStable(rows, func(i, j int) bool {
+		return less(rows[i], rows[j])
+	})
+}
+
+// listOrder returns the order of secrets_list rows. Ties are broken by slot ID, so the order is total.
+func listOrder(sortBy string, descending bool) func(a, b *s4.SnapshotRow) bool {
+	less := func(a, b *s4.SnapshotRow) bool {
+		return a.SlotId < b.SlotId
+	}
+	switch sortBy {
+	case listSortByExpiration:
+		less = func(a, b *s4.SnapshotRow) bool {
+			return a.Expiration < b.Expiration
+		}
+	case listSortByVersion:
+		less = func(a, b *s4.SnapshotRow) bool {
+			return a.Version < b.Version
+		}
+	}
+	return func(a, b *s4.SnapshotRow) bool {
+		if less(a, b) {
+			return !descending
+		}
+		if less(b, a) {
+			return descending
+		}
+		return a.SlotId < b.SlotId
+	}
+}
+
+type setRequest struct {
+	SlotID     uint   `json:"slot_id"`
+	Version    uint64 `json:"version"`
+	Expiration int64  `json:"expiration"`
+	Payload    []byte `json:"payload"`
+	Signature  []byte `json:"signature"`
+}
+
+// UnmarshalJSON accepts Version and Expiration both as JSON numbers and as decimal strings,
+// since JavaScript clients can't represent every uint64 as a number.
+func (r *setRequest) UnmarshalJSON(data []byte) error {
+	type plainSetRequest setRequest
+	var request struct {
+		plainSetRequest
+		Version    json.RawMessage `json:"version"`
+		Expiration json.RawMessage `json:"expiration"`
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return err
+	}
+	*r = setRequest(request.plainSetRequest)
+	if err := unmarshalNumberOrString(request.Version, &r.Version); err != nil {
+		return fmt.Errorf("invalid version: %w", err)
+	}
+	if err := unmarshalNumberOrString(request.Expiration, &r.Expiration); err != nil {
+		return fmt.Errorf("invalid expiration: %w", err)
+	}
+	return nil
+}
+
+// unmarshalNumberOrString decodes a JSON number or a string containing one. Missing values are left untouched.
+func unmarshalNumberOrString(data json.RawMessage, v any) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	var str string
+	if json.Unmarshal(data, &str) == nil {
+		data = json.RawMessage(str)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (h *functionsConnectorHandler) handleStatus(ctx context.Context, gatewayId string, body *api.MessageBody) {
+	type StatusResponse struct {
+		Success     bool `json:"success"`
+		Maintenance bool `json:"maintenance"`
+		// StorageBackend and StorageVersion identify the S4 storage implementation, for fleet consistency checks.
+		StorageBackend string `json:"storage_backend"`
+		StorageVersion string `json:"storage_version"`
+	}
+	response := StatusResponse{
+		Success:        true,
+		Maintenance:    h.maintenance.Load(),
+		StorageBackend: h.storageBackend.Type,
+		StorageVersion: h.storageBackend.Version,
+	}
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) handleWhoAmI(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type WhoAmIResponse struct {
+		Success bool `json:"success"`
+		// Sender signed the request, Address is the account it acts for (see WithSenderResolver).
+		Sender   string `json:"sender"`
+		Address  string `json:"address"`
+		Allowed  bool   `json:"allowed"`
+		Paused   bool   `json:"paused,omitempty"`
+		Operator bool   `json:"operator,omitempty"`
+		// Limits are omitted when disabled.
+		DailyRequestLimit   uint32  `json:"daily_request_limit,omitempty"`
+		DailyRequestsUsed   uint32  `json:"daily_requests_used,omitempty"`
+		RateLimitRPS        float64 `json:"rate_limit_rps,omitempty"`
+		RateLimitBurst      uint32  `json:"rate_limit_burst,omitempty"`
+		MaxSlots            uint    `json:"max_slots"`
+		MaxPayloadSizeBytes uint    `json:"max_payload_size_bytes"`
+	}
+
+	constraints := h.storage.Constraints()
+	_, paused := h.pausedSenders.Load(fromAddr)
+	response := WhoAmIResponse{
+		Success:             true,
+		Sender:              ethCommon.HexToAddress(body.Sender).Hex(),
+		Address:             fromAddr.Hex(),
+		Allowed:             h.allow(fromAddr),
+		Paused:              paused,
+		Operator:            h.isOperator(fromAddr),
+		MaxSlots:            h.slotQuota(fromAddr),
+		MaxPayloadSizeBytes: constraints.MaxPayloadSizeBytes,
+	}
+	if h.dailyQuota != nil {
+		response.DailyRequestsUsed, response.DailyRequestLimit = h.dailyQuota.Usage(fromAddr)
+	}
+	if h.rateLimiter != nil {
+		response.RateLimitRPS = h.config.SenderRateLimitRPS
+		response.RateLimitBurst = h.config.SenderRateLimitBurst
+		if response.RateLimitBurst == 0 {
+			response.RateLimitBurst = 1
+		}
+	}
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) handleSecretsListMulti(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	if !h.isOperator(fromAddr) {
+		h.lggr.Errorw("multi-address list requested by a non-operator address", "id", gatewayId, "address", fromAddr)
+		return
+	}
+
+	type ListMultiRequest struct {
+		Addresses []ethCommon.Address `json:"addresses"`
+	}
+
+	type ListMultiRow struct {
+		SlotID      uint   `json:"slot_id"`
+		Version     uint64 `json:"version"`
+		Expiration  int64  `json:"expiration"`
+		PayloadSize uint64 `json:"payload_size"`
+		UpdatedAt   int64  `json:"updated_at,omitempty"`
+	}
+
+	type AddressRows struct {
+		Address ethCommon.Address `json:"address"`
+		Rows    []ListMultiRow    `json:"rows"`
+	}
+
+	type ListMultiResponse struct {
+		Success      bool          `json:"success"`
+		ErrorMessage string        `json:"error_message,omitempty"`
+		Addresses    []AddressRows `json:"addresses,omitempty"`
+	}
+
+	maxAddresses := int(h.config.MaxListMultiAddresses)
+	if maxAddresses == 0 {
+		maxAddresses = defaultMaxListMultiAddresses
+	}
+
+	var request ListMultiRequest
+	var response ListMultiResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if err == nil && len(request.Addresses) == 0 {
+		err = errors.New("no addresses given")
+	}
+	if err == nil && len(request.Addresses) > maxAddresses {
+		err = fmt.Errorf("at most %d addresses are allowed, got %d", maxAddresses, len(request.Addresses))
+	}
+	if err == nil {
+		response.Addresses = make([]AddressRows, len(request.Addresses))
+		for i, address := range request.Addresses {
+			var snapshot []*s4.SnapshotRow
+			snapshot, err = h.listForRead(ctx, address)
+			if err != nil {
+				err = fmt.Errorf("address %s: %w", address, err)
+				break
+			}
+			sortSnapshotRows(snapshot, listSortBySlot, false)
+			rows := make([]ListMultiRow, len(snapshot))
+			for j, row := range snapshot {
+				rows[j] = ListMultiRow{
+					SlotID:      row.SlotId,
+					Version:     row.Version,
+					Expiration:  row.Expiration,
+					PayloadSize: row.PayloadSize,
+					UpdatedAt:   unixMilli(row.UpdatedAt),
+				}
+			}
+			response.Addresses[i] = AddressRows{Address: address, Rows: rows}
+		}
+		if err == nil {
+			response.Success = true
+		} else {
+			response.Addresses = nil
+			response.ErrorMessage = fmt.Sprintf("Failed to list secrets: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to list secrets: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) handleSecretsManifest(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type ManifestResponse struct {
+		Success      bool      `json:"success"`
+		ErrorMessage string    `json:"error_message,omitempty"`
+		Manifest     *Manifest `json:"manifest,omitempty"`
+		// ManifestSignature is the node's signature over the manifest (see Manifest.GetSignerAddress).
+		ManifestSignature []byte `json:"manifest_signature,omitempty"`
+	}
+
+	var response ManifestResponse
+	snapshot, err := h.listForRead(ctx, fromAddr)
+	if err == nil {
+		sortSnapshotRows(snapshot, listSortBySlot, false)
+		manifest := &Manifest{
+			Address:     fromAddr,
+			GeneratedAt: h.clock.Now().UnixMilli(),
+			Records:     make([]ManifestRecord, len(snapshot)),
+		}
+		for i, row := range snapshot {
+			manifest.Records[i] = ManifestRecord{
+				SlotID:      row.SlotId,
+				Version:     row.Version,
+				Expiration:  row.Expiration,
+				PayloadSize: row.PayloadSize,
+				UpdatedAt:   unixMilli(row.UpdatedAt),
+			}
+		}
+		response.ManifestSignature, err = manifest.Sign(h.signer(body.DonId))
+		if err == nil {
+			response.Success = true
+			response.Manifest = manifest
+		}
+	}
+	if err != nil {
+		response.ManifestSignature = nil
+		response.ErrorMessage = fmt.Sprintf("Failed to build manifest: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// handleSecretsFlush responds once all writes of the sender accepted before the flush have been committed to storage,
+// so that a subsequent read observes them, even if they were delivered through a different gateway.
+func (h *functionsConnectorHandler) handleSecretsFlush(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type FlushResponse struct {
+		Success bool `json:"success"`
+	}
+	h.writesInFlight.Wait(fromAddr)
+	if err := h.sendResponse(ctx, gatewayId, body, FlushResponse{Success: true}); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// handleVerifySignature checks the signature of a secrets_set request without storing anything,
+// so that clients can test their signing code.
+func (h *functionsConnectorHandler) handleVerifySignature(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type VerifySignatureResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+		Valid        bool   `json:"valid"`
+		// Signer is the address recovered from the signature, if it could be recovered.
+		Signer *ethCommon.Address `json:"signer,omitempty"`
+	}
+
+	var request setRequest
+	var response VerifySignatureResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	if err == nil {
+		key := s4.Key{
+			Address: fromAddr,
+			SlotId:  request.SlotID,
+			Version: request.Version,
+		}
+		record := s4.Record{
+			Expiration: request.Expiration,
+			Payload:    request.Payload,
+		}
+		response.Success = true
+		if signer, signerErr := h.getSignerAddress(s4.NewEnvelopeFromRecord(&key, &record), request.Signature); signerErr == nil {
+			response.Valid = signer == fromAddr
+			response.Signer = &signer
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to verify signature: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// handleCheckWrite tells whether a secrets_set request landed, so that a client whose request timed out can
+// check before retrying it with a new version.
+func (h *functionsConnectorHandler) handleCheckWrite(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type CheckWriteRequest struct {
+		SlotID  uint   `json:"slot_id"`
+		Version uint64 `json:"version"`
+		// Digest is the payload digest of the write (see payloadDigest).
+		Digest string `json:"digest"`
+	}
+
+	type CheckWriteResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+		// Landed is set when the slot holds the record with the requested version and digest.
+		Landed         bool   `json:"landed"`
+		CurrentVersion uint64 `json:"current_version,omitempty"`
+		CurrentDigest  string `json:"current_digest,omitempty"`
+	}
+
+	var request CheckWriteRequest
+	var response CheckWriteResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if err == nil && !h.config.RetrySafeWrites {
+		err = errors.New("retry-safe writes are disabled")
+	}
+	if err == nil && request.Digest == "" {
+		err = errors.New("digest is required")
+	}
+	if err == nil {
+		// Reads go to the primary storage, as a replica may not have the write yet.
+		var record *s4.Record
+		var metadata *s4.Metadata
+		record, metadata, err = h.storage.GetIncludingExpired(ctx, &s4.Key{Address: fromAddr, SlotId: request.SlotID})
+		if err == nil {
+			response.CurrentVersion = metadata.Version
+			response.CurrentDigest = payloadDigest(record.Payload)
+			response.Landed = metadata.Version == request.Version && strings.EqualFold(response.CurrentDigest, request.Digest)
+		} else if errors.Is(err, s4.ErrNotFound) {
+			err = nil
+		}
+		if err == nil {
+			response.Success = true
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to check write: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to check write: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// payloadDigest is the hex-encoded Keccak-256 hash of a payload, which clients can compute themselves.
+func payloadDigest(payload []byte) string {
+	return crypto.Keccak256Hash(payload).Hex()
+}
+
+// handlePublicKey returns the uncompressed secp256k1 public key that signs responses.
+// The response itself is signed, so clients can check that the key belongs to the signer.
+func (h *functionsConnectorHandler) handlePublicKey(ctx context.Context, gatewayId string, body *api.MessageBody) {
+	type PublicKeyResponse struct {
+		Success     bool   `json:"success"`
+		NodeAddress string `json:"node_address"`
+		PublicKey   []byte `json:"public_key"`
+	}
+	nodeAddress, signerKey := h.identity(body.DonId)
+	response := PublicKeyResponse{
+		Success:     true,
+		NodeAddress: nodeAddress,
+		PublicKey:   crypto.FromECDSAPub(&signerKey.PublicKey),
+	}
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) handleSelfTest(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	if !h.isOperator(fromAddr) {
+		h.lggr.Errorw("self test requested by a non-operator address", "id", gatewayId, "address", fromAddr)
+		return
+	}
+
+	type SelfTestStep struct {
+		Name         string `json:"name"`
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+	}
+
+	type SelfTestResponse struct {
+		Success bool           `json:"success"`
+		Steps   []SelfTestStep `json:"steps"`
+	}
+
+	var response SelfTestResponse
+	step := func(name string, err error) bool {
+		result := SelfTestStep{Name: name, Success: err == nil}
+		if err != nil {
+			result.ErrorMessage = err.Error()
+		}
+		response.Steps = append(response.Steps, result)
+		return err == nil
+	}
+
+	// The test record is stored under the node's own address, which no client can write to.
+	now := h.clock.Now()
+	key := s4.Key{Address: ethCommon.HexToAddress(h.nodeAddress), Version: uint64(now.UnixNano())}
+	record := s4.Record{Payload: []byte("self_test"), Expiration: now.Add(selfTestRecordTTL).UnixMilli()}
+	put := func(record *s4.Record) error {
+		signature, err := s4.NewEnvelopeFromRecord(&key, record).Sign(h.signerKey)
+		if err != nil {
+			return err
+		}
+		return h.storage.Put(ctx, &key, record, signature)
+	}
+
+	defer h.lockSlot(key.Address, key.SlotId)()
+	if step("sign", h.selfTestSign()) && step("store", put(&record)) {
+		step("read", h.selfTestRead(ctx, &key, &record))
+		// S4 has no deletes, so the record is overwritten with an empty payload and left to expire.
+		key.Version++
+		step("delete", put(&s4.Record{Payload: []byte{}, Expiration: record.Expiration}))
+	}
+	response.Success = true
+	for _, result := range response.Steps {
+		response.Success = response.Success && result.Success
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// handleConfig returns the effective handler configuration to operators.
+// The handler config and S4 constraints hold limits only. Keys are never included.
+func (h *functionsConnectorHandler) handleConfig(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	if !h.isOperator(fromAddr) {
+		h.lggr.Errorw("config requested by a non-operator address", "id", gatewayId, "address", fromAddr)
+		return
+	}
+
+	type ConfigResponse struct {
+		Success        bool                          `json:"success"`
+		NodeAddress    string                        `json:"node_address"`
+		Config         config.ConnectorHandlerConfig `json:"config"`
+		Constraints    s4.Constraints                `json:"constraints"`
+		EnabledMethods []string                      `json:"enabled_methods"`
+		Maintenance    bool                          `json:"maintenance"`
+	}
+
+	response := ConfigResponse{
+		Success:        true,
+		NodeAddress:    h.nodeAddress,
+		Config:         h.config,
+		Constraints:    h.storage.Constraints(),
+		EnabledMethods: h.enabledMethods(),
+		Maintenance:    h.maintenance.Load(),
+	}
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) enabledMethods() []string {
+	methods := []string{methodSecretsSet, methodSecretsList, methodSecretsGet, methodSecretsCopy, methodSecretsSwap, methodSecretsBulkTouch, methodSecretsUsage, methodSecretsFlush, methodSecretsManifest, methodVerifySignature, methodPublicKey, methodStatus}
+	if h.config.TombstoneRetentionSec > 0 {
+		methods = append(methods, methodSecretsDelete)
+	}
+	if len(h.operators) > 0 {
+		methods = append(methods, methodSelfTest, methodConfig, methodSecretsListMulti)
+	}
+	if h.config.AllowWhoAmI {
+		methods = append(methods, methodWhoAmI)
+	}
+	if h.config.RetrySafeWrites {
+		methods = append(methods, methodCheckWrite)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func (h *functionsConnectorHandler) isOperator(address ethCommon.Address) bool {
+	_, ok := h.operators[address]
+	return ok
+}
+
+func (h *functionsConnectorHandler) selfTestSign() error {
+	data := []byte("self_test")
+	signature, err := h.Sign(data)
+	if err != nil {
+		return err
+	}
+	signer, err := common.ExtractSigner(signature, data)
+	if err != nil {
+		return err
+	}
+	if ethCommon.BytesToAddress(signer) != ethCommon.HexToAddress(h.nodeAddress) {
+		return errors.New("signature doesn't recover to the node address")
+	}
+	return nil
+}
+
+func (h *functionsConnectorHandler) selfTestRead(ctx context.Context, key *s4.Key, expected *s4.Record) error {
+	record, metadata, err := h.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if metadata.Version != key.Version || string(record.Payload) != string(expected.Payload) {
+		return errors.New("read back a different record")
+	}
+	return nil
+}
+
+func (h *functionsConnectorHandler) handleSecretsSet(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type SetResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+		// Warning is set when the sender is close to their storage quota.
+		Warning string `json:"warning,omitempty"`
+		// Version and Digest (see payloadDigest) identify the stored record when RetrySafeWrites is enabled.
+		Version uint64 `json:"version,omitempty"`
+		Digest  string `json:"digest,omitempty"`
+		// AlreadyWritten is set when a retried request found its record already stored.
+		AlreadyWritten bool `json:"already_written,omitempty"`
+	}
+
+	var request setRequest
+	var response SetResponse
+	var err error
+	// Reject oversized requests before decoding base64 payloads of arbitrary size.
+	maxRequestSize := base64.StdEncoding.EncodedLen(int(h.storage.Constraints().MaxPayloadSizeBytes)) + maxSetRequestOverheadBytes
+	if len(body.Payload) > maxRequestSize {
+		err = fmt.Errorf("request is too big: %d bytes, max %d", len(body.Payload), maxRequestSize)
+	} else {
+		err = json.Unmarshal(body.Payload, &request)
+	}
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	if err == nil && h.isTombstone(uint64(len(request.Payload))) {
+		err = errors.New("empty payload is reserved for deleted secrets")
+	}
+	if err == nil && len(request.Payload) == 0 && !h.config.AllowEmptyPayloads {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeEmptyPayload, "Payload must not be empty")
+		return
+	}
+	if err == nil && h.payloadEnforcer != nil {
+		if formatErr := h.payloadEnforcer.CheckPayloadFormat(request.Payload); formatErr != nil {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodePayloadFormatInvalid, fmt.Sprintf("Payload format is invalid: %v", formatErr))
+			return
+		}
+	}
+	if err == nil && h.config.SignatureLength > 0 && len(request.Signature) != int(h.config.SignatureLength) {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadSignatureFormat, fmt.Sprintf("Signature must be %d bytes long, got %d", h.config.SignatureLength, len(request.Signature)))
+		return
+	}
+	if err == nil && h.sendIfBeyondRetention(ctx, gatewayId, body, h.checkRetention(request.Expiration)) {
+		return
+	}
+	if err == nil && h.sendIfVersionOutOfRange(ctx, gatewayId, body, request.Version) {
+		return
+	}
+	if err == nil {
+		err = h.checkSlotQuota(fromAddr, request.SlotID)
+	}
+	if err == nil {
+		key := s4.Key{
+			Address: fromAddr,
+			SlotId:  request.SlotID,
+			Version: request.Version,
+		}
+		record := s4.Record{
+			Expiration: request.Expiration,
+			Payload:    request.Payload,
+		}
+		if h.config.RejectSignerMismatch {
+			signer, signerErr := h.getSignerAddress(s4.NewEnvelopeFromRecord(&key, &record), request.Signature)
+			if signerErr != nil || signer != fromAddr {
+				h.sendErrorResponse(ctx, gatewayId, body, errorCodeSignerMismatch, "Payload is not signed by the sender")
+				return
+			}
+		}
+		defer h.lockSlot(fromAddr, request.SlotID)()
+		if h.config.RejectExpirationRegression {
+			var current int64
+			current, err = h.currentExpiration(ctx, &key)
+			if err == nil && record.Expiration < current {
+				h.sendErrorResponse(ctx, gatewayId, body, errorCodeExpirationRegression, fmt.Sprintf("Expiration must not be earlier than the current expiration %d (unix ms)", current))
+				return
+			}
+		}
+		if err == nil {
+			err = h.storage.Put(ctx, &key, &record, request.Signature)
+		}
+		alreadyWritten := false
+		if errors.Is(err, s4.ErrVersionTooLow) {
+			stored, metadata, getErr := h.storage.GetIncludingExpired(ctx, &s4.Key{Address: fromAddr, SlotId: request.SlotID})
+			if getErr == nil {
+				// A retry of a write that landed, but whose response was lost, is answered as if it had just landed.
+				alreadyWritten = h.config.RetrySafeWrites && metadata.Version == key.Version && stored.Expiration == record.Expiration && bytes.Equal(stored.Payload, record.Payload)
+				if !alreadyWritten {
+					h.sendStaleVersionResponse(ctx, gatewayId, body, metadata.Version)
+					return
+				}
+				err = nil
+			}
+		}
+		if err == nil {
+			response.Success = true
+			response.Warning = h.quotaWarning(ctx, fromAddr)
+			if h.config.RetrySafeWrites {
+				response.Version = key.Version
+				response.Digest = payloadDigest(record.Payload)
+				response.AlreadyWritten = alreadyWritten
+			}
+			if !alreadyWritten {
+				h.notifySecretsChanged(key, SecretsActionSet)
+			}
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to set secret: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to set secret: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// slotQuota returns the number of slots the sender may use.
+func (h *functionsConnectorHandler) slotQuota(address ethCommon.Address) uint {
+	maxSlots := h.storage.Constraints().MaxSlotsPerUser
+	quota := maxSlots
+	if h.config.MaxSlotsPerSender > 0 {
+		quota = h.config.MaxSlotsPerSender
+	}
+	if h.quotaResolver != nil {
+		if slots, ok := h.quotaResolver.SlotQuota(address); ok {
+			quota = slots
+		}
+	}
+	if quota > maxSlots {
+		quota = maxSlots
+	}
+	return quota
+}
+
+// checkSlotQuota rejects writes to slots beyond the sender's slot quota.
+func (h *functionsConnectorHandler) checkSlotQuota(address ethCommon.Address, slotID uint) error {
+	if quota := h.slotQuota(address); slotID >= quota {
+		return fmt.Errorf("%w: the sender may use %d slots", s4.ErrSlotIdTooBig, quota)
+	}
+	return nil
+}
+
+// quotaWarning returns a warning when the sender uses at least QuotaWarningThresholdPercent of their slots
+// or of their byte capacity (all slots filled with maximum size payloads).
+func (h *functionsConnectorHandler) quotaWarning(ctx context.Context, address ethCommon.Address) string {
+	threshold := uint64(h.config.QuotaWarningThresholdPercent)
+	if threshold == 0 {
+		return ""
+	}
+	snapshot, err := h.storage.List(ctx, address)
+	if err != nil {
+		h.lggr.Errorw("failed to list secrets for quota warning", "address", address, "err", err)
+		return ""
+	}
+	maxSlots := uint64(h.slotQuota(address))
+	maxBytes := maxSlots * uint64(h.storage.Constraints().MaxPayloadSizeBytes)
+	slotsUsed := uint64(len(snapshot))
+	var bytesUsed uint64
+	for _, row := range snapshot {
+		bytesUsed += row.PayloadSize
+	}
+
+	var warnings []string
+	if slotsUsed*100 >= threshold*maxSlots {
+		warnings = append(warnings, fmt.Sprintf("%d of %d slots used", slotsUsed, maxSlots))
+	}
+	if bytesUsed*100 >= threshold*maxBytes {
+		warnings = append(warnings, fmt.Sprintf("%d of %d bytes used", bytesUsed, maxBytes))
+	}
+	if len(warnings) == 0 {
+		return ""
+	}
+	return "Approaching storage quota: " + strings.Join(warnings, ", ")
+}
+
+func (h *functionsConnectorHandler) handleSecretsGet(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type GetRequest struct {
+		SlotID uint `json:"slot_id"`
+		// EncryptionPublicKey (uncompressed secp256k1) makes the node ECIES-encrypt the payload to the client,
+		// so it stays confidential across the gateway.
+		EncryptionPublicKey []byte `json:"encryption_public_key"`
+	}
+
+	type GetResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+		Version      uint64 `json:"version,omitempty"`
+		Expiration   int64  `json:"expiration,omitempty"`
+		Payload      []byte `json:"payload,omitempty"`
+		// PayloadEncrypted is set when Payload was encrypted to the request's EncryptionPublicKey.
+		PayloadEncrypted bool  `json:"payload_encrypted,omitempty"`
+		CreatedAt        int64 `json:"created_at,omitempty"`
+		UpdatedAt        int64 `json:"updated_at,omitempty"`
+		Deleted          bool  `json:"deleted,omitempty"`
+		// Expired is only set when expired reads are allowed by the config.
+		Expired bool `json:"expired,omitempty"`
+		// Stale is set for records that expired within the read grace window (ReadGraceSec).
+		Stale bool `json:"stale,omitempty"`
+	}
+
+	var request GetRequest
+	var response GetResponse
+	var encryptionKey *ecies.PublicKey
+	err := json.Unmarshal(body.Payload, &request)
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	if err == nil && request.EncryptionPublicKey != nil {
+		encryptionKey, err = parseEncryptionPublicKey(request.EncryptionPublicKey)
+	}
+	if err == nil {
+		key := s4.Key{
+			Address: fromAddr,
+			SlotId:  request.SlotID,
+		}
+		var record *s4.Record
+		var metadata *s4.Metadata
+		record, metadata, err = h.getForRead(ctx, &key)
+		if err == nil && h.verifyIntegrity(key, record, metadata) != nil {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeIntegrityError, "Stored record failed the integrity check")
+			return
+		}
+		if err == nil {
+			now := h.clock.Now().UnixMilli()
+			expired := record.Expiration <= now
+			// Stale records expired less than ReadGraceSec ago and are still served.
+			stale := expired && now-record.Expiration <= (time.Duration(h.config.ReadGraceSec)*time.Second).Milliseconds()
+			if expired && !stale && !h.config.AllowExpiredReads {
+				h.sendErrorResponse(ctx, gatewayId, body, errorCodeExpired, "Secret has expired")
+				return
+			}
+			response.Success = true
+			response.Version = metadata.Version
+			response.Expiration = record.Expiration
+			response.Payload = record.Payload
+			response.CreatedAt = unixMilli(metadata.CreatedAt)
+			response.UpdatedAt = unixMilli(metadata.UpdatedAt)
+			response.Deleted = h.isTombstone(uint64(len(record.Payload)))
+			response.Expired = expired && !stale
+			response.Stale = stale
+			if encryptionKey != nil && len(record.Payload) > 0 {
+				response.Payload, err = ecies.Encrypt(rand.Reader, encryptionKey, record.Payload, nil, nil)
+				if err != nil {
+					h.lggr.Errorw("failed to encrypt payload", "id", gatewayId, "err", err)
+					h.sendErrorResponse(ctx, gatewayId, body, errorCodeInternalError, "Internal error")
+					return
+				}
+				response.PayloadEncrypted = true
+			}
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to get secret: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to get secret: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func parseEncryptionPublicKey(publicKey []byte) (*ecies.PublicKey, error) {
+	if len(publicKey) != encryptionPublicKeyLength {
+		return nil, fmt.Errorf("encryption public key must be %d bytes long, got %d", encryptionPublicKeyLength, len(publicKey))
+	}
+	ecdsaKey, err := crypto.UnmarshalPubkey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption public key: %w", err)
+	}
+	return ecies.ImportECDSAPublic(ecdsaKey), nil
+}
+
+func (h *functionsConnectorHandler) handleSecretsCopy(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type CopyRequest struct {
+		SlotID      uint   `json:"slot_id"`
+		Version     uint64 `json:"version"`
+		DestSlotID  uint   `json:"dest_slot_id"`
+		DestVersion uint64 `json:"dest_version"`
+		// Expiration of the copy, zero keeps the source expiration.
+		Expiration int64 `json:"expiration"`
+		// Signature over the destination record (see s4.Envelope).
+		Signature []byte `json:"signature"`
+	}
+
+	type CopyResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+	}
+
+	var request CopyRequest
+	var response CopyResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	if err == nil && request.SlotID == request.DestSlotID {
+		err = errors.New("destination slot must differ from the source slot")
+	}
+	if err == nil {
+		err = h.checkSlotQuota(fromAddr, request.DestSlotID)
+	}
+	if err == nil && h.sendIfVersionOutOfRange(ctx, gatewayId, body, request.DestVersion) {
+		return
+	}
+	if err == nil {
+		srcKey := s4.Key{
+			Address: fromAddr,
+			SlotId:  request.SlotID,
+			Version: request.Version,
+		}
+		dstKey := s4.Key{
+			Address: fromAddr,
+			SlotId:  request.DestSlotID,
+			Version: request.DestVersion,
+		}
+		err = h.copySecret(ctx, &srcKey, &dstKey, request.Expiration, request.Signature)
+		if err == nil {
+			response.Success = true
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to copy secret: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to copy secret: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) handleSecretsDelete(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type DeleteRequest struct {
+		SlotID  uint   `json:"slot_id"`
+		Version uint64 `json:"version"`
+		// Expiration of the tombstone, at most TombstoneRetentionSec from now.
+		Expiration int64 `json:"expiration"`
+		// Signature over the tombstone record, which has an empty payload (see s4.Envelope).
+		Signature []byte `json:"signature"`
+	}
+
+	type DeleteResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+	}
+
+	var request DeleteRequest
+	var response DeleteResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	retention := time.Duration(h.config.TombstoneRetentionSec) * time.Second
+	if err == nil && retention == 0 {
+		err = errors.New("deletes are disabled")
+	}
+	if err == nil && request.Expiration > h.clock.Now().Add(retention).UnixMilli() {
+		err = fmt.Errorf("tombstone must expire within %s", retention)
+	}
+	if err == nil && h.sendIfVersionOutOfRange(ctx, gatewayId, body, request.Version) {
+		return
+	}
+	if err == nil {
+		key := s4.Key{
+			Address: fromAddr,
+			SlotId:  request.SlotID,
+			Version: request.Version,
+		}
+		record := s4.Record{
+			Expiration: request.Expiration,
+			Payload:    []byte{},
+		}
+		defer h.lockSlot(fromAddr, request.SlotID)()
+		err = h.storage.Put(ctx, &key, &record, request.Signature)
+		if err == nil {
+			response.Success = true
+			h.notifySecretsChanged(key, SecretsActionDelete)
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to delete secret: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to delete secret: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+func (h *functionsConnectorHandler) notifySecretsChanged(key s4.Key, action string) {
+	if h.onSecretsChanged == nil {
+		return
+	}
+	h.closeWait.Add(1)
+	go func() {
+		defer h.closeWait.Done()
+		ctx, cancel := h.stopCh.NewCtx()
+		defer cancel()
+		if err := h.onSecretsChanged(ctx, key.Address, key.SlotId, key.Version, action); err != nil {
+			h.lggr.Errorw("secrets changed callback failed", "address", key.Address, "slotId", key.SlotId, "version", key.Version, "action", action, "err", err)
+		}
+	}()
+}
+
+// expirationBeyondRetentionError rejects expirations later than MaxExpirationSec from now.
+type expirationBeyondRetentionError struct {
+	maxExpiration int64
+}
+
+func (e *expirationBeyondRetentionError) Error() string {
+	return fmt.Sprintf("expiration exceeds the retention horizon, must not be later than %d", e.maxExpiration)
+}
+
+func (h *functionsConnectorHandler) checkRetention(expiration int64) error {
+	if h.config.MaxExpirationSec == 0 {
+		return nil
+	}
+	maxExpiration := h.clock.Now().Add(time.Duration(h.config.MaxExpirationSec) * time.Second).UnixMilli()
+	if expiration > maxExpiration {
+		return &expirationBeyondRetentionError{maxExpiration: maxExpiration}
+	}
+	return nil
+}
+
+// sendIfBeyondRetention responds with EXPIRATION_EXCEEDS_RETENTION and returns true if err is (or wraps) an
+// expirationBeyondRetentionError.
+func (h *functionsConnectorHandler) sendIfBeyondRetention(ctx context.Context, gatewayId string, body *api.MessageBody, err error) bool {
+	var retentionErr *expirationBeyondRetentionError
+	if !errors.As(err, &retentionErr) {
+		return false
+	}
+	h.sendErrorResponse(ctx, gatewayId, body, errorCodeExpirationTooLate, fmt.Sprintf("Expiration must not be later than %d (unix ms)", retentionErr.maxExpiration))
+	return true
+}
+
+// sendIfVersionOutOfRange responds with VERSION_OUT_OF_RANGE and returns true if version exceeds MaxVersion.
+func (h *functionsConnectorHandler) sendIfVersionOutOfRange(ctx context.Context, gatewayId string, body *api.MessageBody, version uint64) bool {
+	if h.config.MaxVersion == 0 || version <= h.config.MaxVersion {
+		return false
+	}
+	h.sendErrorResponse(ctx, gatewayId, body, errorCodeVersionOutOfRange, fmt.Sprintf("Version must not be greater than %d", h.config.MaxVersion))
+	return true
+}
+
+// versionOutOfRangeError rejects version increments beyond MaxVersion (or the uint64 maximum).
+type versionOutOfRangeError struct {
+	maxVersion uint64
+}
+
+func (e *versionOutOfRangeError) Error() string {
+	return fmt.Sprintf("version can't be incremented beyond %d", e.maxVersion)
+}
+
+// nextVersion returns the version following the stored one.
+func (h *functionsConnectorHandler) nextVersion(version uint64) (uint64, error) {
+	maxVersion := uint64(math.MaxUint64)
+	if h.config.MaxVersion > 0 {
+		maxVersion = h.config.MaxVersion
+	}
+	if version >= maxVersion {
+		return 0, &versionOutOfRangeError{maxVersion: maxVersion}
+	}
+	return version + 1, nil
+}
+
+// sendIfNoNextVersion responds with VERSION_OUT_OF_RANGE and returns true if err is (or wraps) a versionOutOfRangeError.
+func (h *functionsConnectorHandler) sendIfNoNextVersion(ctx context.Context, gatewayId string, body *api.MessageBody, err error) bool {
+	var versionErr *versionOutOfRangeError
+	if !errors.As(err, &versionErr) {
+		return false
+	}
+	h.sendErrorResponse(ctx, gatewayId, body, errorCodeVersionOutOfRange, fmt.Sprintf("Failed to touch secrets: %v", err))
+	return true
+}
+
+// lockSlot waits for other writes to the slot when SerializeSlotWrites is set, and returns the function releasing it.
+func (h *functionsConnectorHandler) lockSlot(address ethCommon.Address, slotID uint) (unlock func()) {
+	if h.slotLocks == nil {
+		return func() {}
+	}
+	return h.slotLocks.Lock(address, slotID)
+}
+
+// lockSlots locks multiple slots like lockSlot. Slots are locked in order, so that concurrent writes to
+// overlapping slots can't deadlock.
+func (h *functionsConnectorHandler) lockSlots(address ethCommon.Address, slotIDs []uint) (unlock func()) {
+	if h.slotLocks == nil {
+		return func() {}
+	}
+	sorted := append([]uint(nil), slotIDs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var unlocks []func()
+	for i, slotID := range sorted {
+		if i > 0 && slotID == sorted[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, h.slotLocks.Lock(address, slotID))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// currentExpiration returns the expiration of the secret stored in the key's slot, or zero if there is none.
+func (h *functionsConnectorHandler) currentExpiration(ctx context.Context, key *s4.Key) (int64, error) {
+	record, _, err := h.storage.Get(ctx, &s4.Key{Address: key.Address, SlotId: key.SlotId})
+	if errors.Is(err, s4.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if h.isTombstone(uint64(len(record.Payload))) {
+		return 0, nil
+	}
+	return record.Expiration, nil
+}
+
+// isTombstone tells whether a record of the given payload size marks a deleted secret.
+func (h *functionsConnectorHandler) isTombstone(payloadSize uint64) bool {
+	return h.config.TombstoneRetentionSec > 0 && payloadSize == 0
+}
+
+func (h *functionsConnectorHandler) handleSecretsBulkTouch(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type BulkTouchRequest struct {
+		// SlotIDs selects records to touch, all owned records are touched if empty.
+		SlotIDs []uint `json:"slot_ids"`
+		// Exactly one of ExtendByMs and Expiration must be set.
+		ExtendByMs int64 `json:"extend_by_ms"`
+		Expiration int64 `json:"expiration"`
+		// Signatures maps every touched slot to the owner's signature over its new record
+		// (stored payload, stored version + 1 and the new expiration, see s4.Envelope).
+		// Slots whose version can't be incremented within MaxVersion fail with VERSION_OUT_OF_RANGE.
+		Signatures map[uint][]byte `json:"signatures"`
+	}
+
+	type BulkTouchResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+		Updated      int    `json:"updated"`
+	}
+
+	var request BulkTouchRequest
+	var response BulkTouchResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	if err == nil && (request.ExtendByMs == 0) == (request.Expiration == 0) {
+		err = errors.New("exactly one of extend_by_ms and expiration must be set")
+	}
+	if err == nil {
+		response.Updated, err = h.bulkTouch(ctx, fromAddr, request.SlotIDs, request.ExtendByMs, request.Expiration, request.Signatures)
+		if h.sendIfBeyondRetention(ctx, gatewayId, body, err) || h.sendIfNoNextVersion(ctx, gatewayId, body, err) {
+			return
+		}
+		if err == nil {
+			response.Success = true
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to touch secrets: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to touch secrets: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// bulkTouch moves expirations of the selected records and returns the number of records updated.
+// S4 signatures cover the expiration, so every touched record must be re-signed by the owner.
+// All signatures are verified before the first write, so a bad signature leaves all records intact.
+func (h *functionsConnectorHandler) bulkTouch(ctx context.Context, address ethCommon.Address, slotIds []uint, extendByMs int64, expiration int64, signatures map[uint][]byte) (int, error) {
+	if len(slotIds) == 0 {
+		snapshot, err := h.storage.List(ctx, address)
+		if err != nil {
+			return 0, err
+		}
+		for _, row := range snapshot {
+			slotIds = append(slotIds, row.SlotId)
+		}
+	}
+	defer h.lockSlots(address, slotIds)()
+
+	type touch struct {
+		key       s4.Key
+		record    s4.Record
+		signature []byte
+	}
+	touches := make([]touch, 0, len(slotIds))
+	for _, slotId := range slotIds {
+		record, metadata, err := h.storage.Get(ctx, &s4.Key{Address: address, SlotId: slotId})
+		if err != nil {
+			return 0, fmt.Errorf("slot %d: %w", slotId, err)
+		}
+		version, err := h.nextVersion(metadata.Version)
+		if err != nil {
+			return 0, fmt.Errorf("slot %d: %w", slotId, err)
+		}
+		t := touch{
+			key:       s4.Key{Address: address, SlotId: slotId, Version: version},
+			record:    s4.Record{Payload: record.Payload, Expiration: expiration},
+			signature: signatures[slotId],
+		}
+		if extendByMs != 0 {
+			t.record.Expiration = record.Expiration + extendByMs
+		}
+		if err = h.checkRetention(t.record.Expiration); err != nil {
+			return 0, fmt.Errorf("slot %d: %w", slotId, err)
+		}
+		signer, err := h.getSignerAddress(s4.NewEnvelopeFromRecord(&t.key, &t.record), t.signature)
+		if err != nil || signer != address {
+			return 0, fmt.Errorf("slot %d: %w", slotId, s4.ErrWrongSignature)
+		}
+		touches = append(touches, t)
+	}
+
+	for i := range touches {
+		if err := h.storage.Put(ctx, &touches[i].key, &touches[i].record, touches[i].signature); err != nil {
+			return i, fmt.Errorf("slot %d: %w", touches[i].key.SlotId, err)
+		}
+		h.notifySecretsChanged(touches[i].key, SecretsActionSet)
+	}
+	return len(touches), nil
+}
+
+// copySecret writes the payload stored under srcKey to dstKey. The signature must be
+// produced by the owner over the destination record, so that S4 keeps accepting only owner writes.
+func (h *functionsConnectorHandler) copySecret(ctx context.Context, srcKey *s4.Key, dstKey *s4.Key, expiration int64, signature []byte) error {
+	defer h.lockSlot(dstKey.Address, dstKey.SlotId)()
+	record, metadata, err := h.storage.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if metadata.Version != srcKey.Version {
+		return fmt.Errorf("source version mismatch: stored version is %d", metadata.Version)
+	}
+
+	dstRecord := s4.Record{
+		Payload:    record.Payload,
+		Expiration: record.Expiration,
+	}
+	if expiration != 0 {
+		dstRecord.Expiration = expiration
+	}
+	signer, err := h.getSignerAddress(s4.NewEnvelopeFromRecord(dstKey, &dstRecord), signature)
+	if err != nil || signer != dstKey.Address {
+		return s4.ErrWrongSignature
+	}
+	if err = h.storage.Put(ctx, dstKey, &dstRecord, signature); err != nil {
+		return err
+	}
+	h.notifySecretsChanged(*dstKey, SecretsActionSet)
+	return nil
+}
+
+func (h *functionsConnectorHandler) handleSecretsSwap(ctx context.Context, gatewayId string, body *api.MessageBody, fromAddr ethCommon.Address) {
+	type SwapSlot struct {
+		SlotID uint `json:"slot_id"`
+		// Version is the stored version of the slot, NewVersion the version of its swapped record.
+		Version    uint64 `json:"version"`
+		NewVersion uint64 `json:"new_version"`
+		// Signature over the swapped record, i.e. the other slot's payload and expiration at NewVersion (see s4.Envelope).
+		Signature []byte `json:"signature"`
+	}
+
+	type SwapRequest struct {
+		Slots []SwapSlot `json:"slots"`
+	}
+
+	type SwapResponse struct {
+		Success      bool   `json:"success"`
+		ErrorMessage string `json:"error_message,omitempty"`
+	}
+
+	var request SwapRequest
+	var response SwapResponse
+	err := json.Unmarshal(body.Payload, &request)
+	if field := malformedBase64Field(err, body.Payload, &request); field != "" {
+		h.sendErrorResponse(ctx, gatewayId, body, errorCodeBadBase64, fmt.Sprintf("Field %s is not valid base64", field))
+		return
+	}
+	if err == nil && len(request.Slots) != 2 {
+		err = fmt.Errorf("exactly 2 slots must be given, got %d", len(request.Slots))
+	}
+	if err == nil && request.Slots[0].SlotID == request.Slots[1].SlotID {
+		err = errors.New("slots must differ")
+	}
+	for i := 0; err == nil && i < len(request.Slots); i++ {
+		if h.sendIfVersionOutOfRange(ctx, gatewayId, body, request.Slots[i].NewVersion) {
+			return
+		}
+	}
+	if err == nil {
+		a, b := request.Slots[0], request.Slots[1]
+		var written bool
+		written, err = h.swapSecrets(ctx, fromAddr,
+			[2]s4.Key{{Address: fromAddr, SlotId: a.SlotID, Version: a.Version}, {Address: fromAddr, SlotId: b.SlotID, Version: b.Version}},
+			[2]uint64{a.NewVersion, b.NewVersion},
+			[2][]byte{a.Signature, b.Signature})
+		if written {
+			h.sendErrorResponse(ctx, gatewayId, body, errorCodeSwapIncomplete, fmt.Sprintf("Slot %d was swapped, but writing slot %d failed: %v", a.SlotID, b.SlotID, err))
+			return
+		}
+		if err == nil {
+			response.Success = true
+		} else {
+			response.ErrorMessage = fmt.Sprintf("Failed to swap secrets: %v", err)
+		}
+	} else {
+		response.ErrorMessage = fmt.Sprintf("Bad request to swap secrets: %v", err)
+	}
+
+	if err := h.sendResponse(ctx, gatewayId, body, response); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// swapSecrets writes the record of each slot into the other one. Both records and signatures are checked before
+// anything is written, so the swap is only left half done (written is true) if the second write fails in storage.
+// The first write can't be rolled back then: S4 doesn't accept the replaced, lower version again, and only
+// the owner can sign a newer one.
+func (h *functionsConnectorHandler) swapSecrets(ctx context.Context, address ethCommon.Address, keys [2]s4.Key, newVersions [2]uint64, signatures [2][]byte) (written bool, err error) {
+	defer h.lockSlots(address, []uint{keys[0].SlotId, keys[1].SlotId})()
+
+	var records [2]*s4.Record
+	for i := range keys {
+		var metadata *s4.Metadata
+		records[i], metadata, err = h.storage.Get(ctx, &keys[i])
+		if err != nil {
+			return false, fmt.Errorf("slot %d: %w", keys[i].SlotId, err)
+		}
+		if metadata.Version != keys[i].Version {
+			return false, fmt.Errorf("slot %d version mismatch: stored version is %d", keys[i].SlotId, metadata.Version)
+		}
+		if h.isTombstone(uint64(len(records[i].Payload))) {
+			return false, fmt.Errorf("slot %d is deleted", keys[i].SlotId)
+		}
+	}
+
+	var newKeys [2]s4.Key
+	var newRecords [2]s4.Record
+	for i := range keys {
+		other := records[1-i]
+		newKeys[i] = s4.Key{Address: address, SlotId: keys[i].SlotId, Version: newVersions[i]}
+		newRecords[i] = s4.Record{Payload: other.Payload, Expiration: other.Expiration}
+		signer, signerErr := h.getSignerAddress(s4.NewEnvelopeFromRecord(&newKeys[i], &newRecords[i]), signatures[i])
+		if signerErr != nil || signer != address {
+			return false, fmt.Errorf("slot %d: %w", keys[i].SlotId, s4.ErrWrongSignature)
+		}
+	}
+
+	for i := range newKeys {
+		if err = h.storage.Put(ctx, &newKeys[i], &newRecords[i], signatures[i]); err != nil {
+			return i > 0, err
+		}
+		h.notifySecretsChanged(newKeys[i], SecretsActionSet)
+	}
+	return false, nil
+}
+
+// unixMilli converts timestamps to the units used for expirations, leaving zero (unknown) times as zero.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func (h *functionsConnectorHandler) getSignerAddress(envelope *s4.Envelope, signature []byte) (ethCommon.Address, error) {
+	if h.signerCache != nil {
+		return h.signerCache.GetSignerAddress(envelope, signature)
+	}
+	return envelope.GetSignerAddress(signature)
+}
+
+// identity returns the sender address and signing key of responses to requests for donId.
+func (h *functionsConnectorHandler) identity(donId string) (string, *ecdsa.PrivateKey) {
+	if signerKey, ok := h.donIdentities[donId]; ok {
+		return crypto.PubkeyToAddress(signerKey.PublicKey).Hex(), signerKey
+	}
+	return h.nodeAddress, h.signerKey
+}
+
+// signer signs with the key of identity(donId), so that signed data verifies against that DON's public_key.
+func (h *functionsConnectorHandler) signer(donId string) func(data ...[]byte) ([]byte, error) {
+	_, signerKey := h.identity(donId)
+	return func(data ...[]byte) ([]byte, error) {
+		return common.SignData(signerKey, data...)
+	}
+}
+
+func (h *functionsConnectorHandler) sendErrorResponse(ctx context.Context, gatewayId string, requestBody *api.MessageBody, errorCode string, errorMessage string) {
+	type ErrorResponse struct {
+		Success      bool   `json:"success"`
+		ErrorCode    string `json:"error_code,omitempty"`
+		ErrorMessage string `json:"error_message,omitempty"`
+	}
+
+	response := ErrorResponse{ErrorCode: errorCode, ErrorMessage: errorMessage}
+	_, transient := transientErrorCodes[errorCode]
+	if err := h.sendResponseWithCaching(ctx, gatewayId, requestBody, response, !transient); err != nil {
+		h.lggr.Errorw("failed to send response to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// sendAck signals that a request passed validation and is being handled. The final response follows with the
+// same MessageId. Acks are always signed, but they don't go through response post-processing and are never cached.
+func (h *functionsConnectorHandler) sendAck(ctx context.Context, gatewayId string, requestBody *api.MessageBody) {
+	type AckResponse struct {
+		Ack bool `json:"ack"`
+	}
+	payloadJson, err := json.Marshal(AckResponse{Ack: true})
+	if err != nil {
+		h.lggr.Errorw("failed to marshal ack", "id", gatewayId, "error", err)
+		return
+	}
+	nodeAddress, signerKey := h.identity(requestBody.DonId)
+	msg := &api.Message{
+		Body: api.MessageBody{
+			MessageId: requestBody.MessageId,
+			DonId:     requestBody.DonId,
+			Method:    requestBody.Method,
+			Sender:    nodeAddress,
+			Payload:   payloadJson,
+		},
+	}
+	if err = msg.Sign(signerKey); err != nil {
+		h.lggr.Errorw("failed to sign ack", "id", gatewayId, "error", err)
+		return
+	}
+	if err = h.sendToGateway(ctx, gatewayId, requestBody, msg); err != nil {
+		h.lggr.Errorw("failed to send ack to gateway", "id", gatewayId, "error", err)
+	}
+}
+
+// sendResponse sends a response, which is cached unless it reports a failure. Failures without an error code
+// include storage errors that a retry may not hit.
+func (h *functionsConnectorHandler) sendResponse(ctx context.Context, gatewayId string, requestBody *api.MessageBody, payload any) error {
+	return h.sendResponseWithCaching(ctx, gatewayId, requestBody, payload, !failedResponse(payload))
+}
+
+// failedResponse reports whether a response payload has a false Success field.
+func failedResponse(payload any) bool {
+	value := reflect.Indirect(reflect.ValueOf(payload))
+	if value.Kind() != reflect.Struct {
+		return false
+	}
+	success := value.FieldByName("Success")
+	return success.IsValid() && success.Kind() == reflect.Bool && !success.Bool()
+}
+
+// sendResponseWithCaching sends a response, which is added to the response cache (if enabled) only if cacheable is set
+// and the request passed authentication and the allowlist (see verifiedSenders).
+// Responses asking the client to retry later must not be cached, or retries would get them until the entry expires.
+func (h *functionsConnectorHandler) sendResponseWithCaching(ctx context.Context, gatewayId string, requestBody *api.MessageBody, payload any, cacheable bool) error {
+	if origin, ok := h.originGateways.Load(requestBody); ok && origin != gatewayId {
+		return fmt.Errorf("refusing to send a response for a request from gateway %s to gateway %s", origin, gatewayId)
+	}
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if h.config.MaxRequestTagLength > 0 {
+		if tag := requestTag(requestBody.Payload); tag != "" && len(tag) <= int(h.config.MaxRequestTagLength) {
+			payloadJson, err = appendField(payloadJson, "request_tag", tag)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if h.config.IncludeSigAlg {
+		payloadJson, err = appendField(payloadJson, "sig_alg", SigAlgEcdsaSecp256k1)
+		if err != nil {
+			return err
+		}
+	}
+	if h.config.CanonicalResponses {
+		payloadJson, err = canonicalJSON(payloadJson)
+		if err != nil {
+			return err
+		}
+	}
+	if h.partialSigner != nil {
+		payloadJson, err = partiallySign(h.partialSigner, payloadJson)
+		if err != nil {
+			return err
+		}
+		if h.config.CanonicalResponses {
+			payloadJson, err = canonicalJSON(payloadJson)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if acceptsCompression(requestBody.Payload) {
+		payloadJson, err = compressIfSmaller(payloadJson)
+		if err != nil {
+			return err
+		}
+	}
+
+	nodeAddress, signerKey := h.identity(requestBody.DonId)
+	msg := &api.Message{
+		Body: api.MessageBody{
+			MessageId: requestBody.MessageId,
+			DonId:     requestBody.DonId,
+			Method:    requestBody.Method,
+			Sender:    nodeAddress,
+			Payload:   payloadJson,
+		},
+	}
+	if _, unsigned := h.unsignedResponseMethods[requestBody.Method]; !unsigned {
+		if err = msg.Sign(signerKey); err != nil {
+			return err
+		}
+	}
+
+	if _, responded := h.respondedRequests.LoadOrStore(requestBody, struct{}{}); responded {
+		h.lggr.Warnw("dropping duplicate response", "id", gatewayId, "messageId", requestBody.MessageId, "method", requestBody.Method)
+		return nil
+	}
+	if sender, verified := h.verifiedSenders.Load(requestBody); verified && cacheable {
+		h.responseCache.Put(sender.(ethCommon.Address), requestBody, msg)
+	}
+	err = h.sendToGateway(ctx, gatewayId, requestBody, msg)
+	if err != nil {
+		// Nothing was delivered, so another response may be sent.
+		h.respondedRequests.Delete(requestBody)
+	}
+	return err
+}
+
+// sendCachedResponse sends a cached response to a retried request. A retry sharing only the idempotency key
+// of the original request gets the response re-addressed to its own MessageId.
+func (h *functionsConnectorHandler) sendCachedResponse(ctx context.Context, gatewayId string, requestBody *api.MessageBody, cached *api.Message) error {
+	msg := cached
+	if cached.Body.MessageId != requestBody.MessageId {
+		msg = &api.Message{Body: cached.Body}
+		msg.Body.MessageId = requestBody.MessageId
+		if _, unsigned := h.unsignedResponseMethods[requestBody.Method]; !unsigned {
+			_, signerKey := h.identity(requestBody.DonId)
+			if err := msg.Sign(signerKey); err != nil {
+				return err
+			}
+		}
+	}
+	return h.sendToGateway(ctx, gatewayId, requestBody, msg)
+}
+
+func (h *functionsConnectorHandler) sendToGateway(ctx context.Context, gatewayId string, requestBody *api.MessageBody, msg *api.Message) error {
+	err := h.connector.SendToGateway(ctx, gatewayId, msg)
+	if err != nil {
+		h.metrics.gatewaySendFailure.WithLabelValues(h.gatewayLabel(gatewayId)).Inc()
+		return err
+	}
+	h.metrics.gatewaySendSuccess.WithLabelValues(h.gatewayLabel(gatewayId)).Inc()
+	h.debugw(requestBody, "sent to gateway", "id", gatewayId, "messageId", requestBody.MessageId, "donId", requestBody.DonId, "method", requestBody.Method)
+	return nil
+}
+
+// debugw logs at debug level, or at info level for requests that asked for debug logging.
+func (h *functionsConnectorHandler) debugw(requestBody *api.MessageBody, msg string, keysAndValues ...interface{}) {
+	if _, debug := h.debugRequests.Load(requestBody); debug {
+		h.lggr.Infow(msg, keysAndValues...)
+		return
+	}
+	h.lggr.Debugw(msg, keysAndValues...)
+}
+
+func (h *functionsConnectorHandler) gatewayLabel(gatewayId string) string {
+	h.gatewayLabelsMu.Lock()
+	defer h.gatewayLabelsMu.Unlock()
+	if _, ok := h.gatewayLabels[gatewayId]; ok {
+		return gatewayId
+	}
+	if len(h.gatewayLabels) >= maxGatewayMetricLabels {
+		return otherGatewaysLabel
+	}
+	h.gatewayLabels[gatewayId] = struct{}{}
+	return gatewayId
+}
+
+// malformedBase64Field returns the name of the base64-encoded field of request that made decoding fail, if any.
+// Fields are []byte (e.g. "payload") or map values of type []byte (e.g. "signatures[2]").
+func malformedBase64Field(err error, payload json.RawMessage, request any) string {
+	var corruptInput base64.CorruptInputError
+	if !errors.As(err, &corruptInput) {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(payload, &fields) != nil {
+		return ""
+	}
+	isMalformed := func(raw json.RawMessage) bool {
+		var encoded string
+		if json.Unmarshal(raw, &encoded) != nil {
+			return false
+		}
+		_, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		return decodeErr != nil
+	}
+	requestType := reflect.TypeOf(request).Elem()
+	bytesType := reflect.TypeOf([]byte(nil))
+	for i := 0; i < requestType.NumField(); i++ {
+		field := requestType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		switch {
+		case field.Type == bytesType:
+			if isMalformed(raw) {
+				return name
+			}
+		case field.Type.Kind() == reflect.Map && field.Type.Elem() == bytesType:
+			var values map[string]json.RawMessage
+			if json.Unmarshal(raw, &values) != nil {
+				continue
+			}
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if isMalformed(values[key]) {
+					return fmt.Sprintf("%s[%s]", name, key)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// requestsAck reports whether the client asked for an early acknowledgment with "ack": true.
+func requestsAck(payload json.RawMessage) bool {
+	var request struct {
+		Ack bool `json:"ack"`
+	}
+	if len(payload) == 0 || json.Unmarshal(payload, &request) != nil {
+		return false
+	}
+	return request.Ack
+}
+
+// requestsDebug reports whether the client asked for its request to be logged at info level with "debug": true.
+func requestsDebug(payload json.RawMessage) bool {
+	var request struct {
+		Debug bool `json:"debug"`
+	}
+	if len(payload) == 0 || json.Unmarshal(payload, &request) != nil {
+		return false
+	}
+	return request.Debug
+}
+
+// requestTag returns the client-supplied tag to be echoed back in the response, if any.
+func requestTag(payload json.RawMessage) string {
+	var tagged struct {
+		RequestTag string `json:"request_tag"`
+	}
+	if len(payload) == 0 || json.Unmarshal(payload, &tagged) != nil {
+		return ""
+	}
+	return tagged.RequestTag
+}
+
+// requestIdempotencyKey returns the client-supplied key identifying retries of the same logical request, if any.
+func requestIdempotencyKey(payload json.RawMessage) string {
+	var request struct {
+		IdempotencyKey string `json:"idempotency_key"`
+	}
+	if len(payload) == 0 || json.Unmarshal(payload, &request) != nil {
+		return ""
+	}
+	return request.IdempotencyKey
+}
+
+// appendField adds a field to a JSON object, preserving the order of existing fields.
+func appendField(payloadJson []byte, name string, value any) ([]byte, error) {
+	n := len(payloadJson)
+	if n < 2 || payloadJson[0] != '{' || payloadJson[n-1] != '}' {
+		return nil, errors.New("response payload is not a JSON object")
+	}
+	nameJson, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 0, n+len(nameJson)+len(valueJson)+2)
+	result = append(result, payloadJson[:n-1]...)
+	if n > 2 {
+		result = append(result, ',')
+	}
+	result = append(result, nameJson...)
+	result = append(result, ':')
+	result = append(result, valueJson...)
+	return append(result, '}'), nil
 }
@@ -0,0 +1,83 @@
+//go:build go1.18
+
+package functions_test
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
+	gcmocks "github.com/smartcontractkit/chainlink/v2/core/services/gateway/connector/mocks"
+	gfmocks "github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers/functions/mocks"
+	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions/config"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+func FuzzHandleSecretsSet(f *testing.F) {
+	nodeKey, nodeAddr := testutils.NewPrivateKeyAndAddress(f)
+	clientKey, clientAddr := testutils.NewPrivateKeyAndAddress(f)
+	now := time.Now()
+	clock := utils.NewFixedClock(now)
+	constraints := s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5}
+	storage := s4.NewStorage(logger.NullLogger, constraints, s4.NewInMemoryORM(), clock)
+
+	key := s4.Key{Address: clientAddr, SlotId: 1, Version: 1}
+	record := s4.Record{Payload: []byte("test"), Expiration: now.Add(time.Hour).UnixMilli()}
+	signature, err := s4.NewEnvelopeFromRecord(&key, &record).Sign(clientKey)
+	require.NoError(f, err)
+	signatureB64 := base64.StdEncoding.EncodeToString(signature)
+
+	f.Add([]byte(`{"slot_id":1,"version":1,"expiration":` + strconv.FormatInt(record.Expiration, 10) + `,"payload":"dGVzdA==","signature":"` + signatureB64 + `"}`))
+	f.Add([]byte(`{"slot_id":1,"version":1,"expiration":-9223372036854775808,"payload":"dGVzdA==","signature":"` + signatureB64 + `"}`))
+	f.Add([]byte(`{"slot_id":18446744073709551615,"version":18446744073709551615,"expiration":9223372036854775807}`))
+	f.Add([]byte(`{"payload":"` + base64.StdEncoding.EncodeToString(make([]byte, 4096)) + `"}`))
+	f.Add([]byte(`{"signature":"AAAA"}`))
+	f.Add([]byte(`{"payload":"!!!"}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if len(payload) > 1_000_000 {
+			t.Skip()
+		}
+
+		allowlist := gfmocks.NewOnchainAllowlist(t)
+		allowlist.On("Allow", clientAddr).Return(true)
+		connector := gcmocks.NewGatewayConnector(t)
+		var responses []*api.Message
+		connector.On("SendToGateway", mock.Anything, "gw1", mock.Anything).Run(func(args mock.Arguments) {
+			responses = append(responses, args[2].(*api.Message))
+		}).Return(nil)
+		handler, err := functions.NewFunctionsConnectorHandler(nodeAddr.Hex(), nodeKey, storage, allowlist, config.ConnectorHandlerConfig{}, clock, logger.NullLogger)
+		require.NoError(t, err)
+		handler.SetConnector(connector)
+
+		msg := &api.Message{
+			Body: api.MessageBody{
+				DonId:     "fun4",
+				MessageId: "1",
+				Method:    "secrets_set",
+				Sender:    clientAddr.Hex(),
+				Payload:   payload,
+			},
+		}
+		require.NotPanics(t, func() {
+			handler.HandleGatewayMessage(testutils.Context(t), "gw1", msg)
+		})
+
+		require.Len(t, responses, 1)
+		signer, err := responses[0].ExtractSigner()
+		require.NoError(t, err)
+		require.Equal(t, nodeAddr.Bytes(), signer)
+	})
+}
@@ -1,24 +1,49 @@
 package functions_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
 	"github.com/smartcontractkit/chainlink/v2/core/logger"
 	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	fmocks "github.com/smartcontractkit/chainlink/v2/core/services/functions/mocks"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions/testhelpers"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/connector"
 	gcmocks "github.com/smartcontractkit/chainlink/v2/core/services/gateway/connector/mocks"
 	gfmocks "github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers/functions/mocks"
+	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions/config"
 	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
 	s4mocks "github.com/smartcontractkit/chainlink/v2/core/services/s4/mocks"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
 
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestFunctionsConnectorHandler(t *testing.T) {
@@ -27,16 +52,17 @@ func TestFunctionsConnectorHandler(t *testing.T) {
 	logger := logger.TestLogger(t)
 	privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
 	storage := s4mocks.NewStorage(t)
+	storage.On("Constraints").Return(s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5}).Maybe()
 	connector := gcmocks.NewGatewayConnector(t)
 	allowlist := gfmocks.NewOnchainAllowlist(t)
 	allowlist.On("Start", mock.Anything).Return(nil)
 	allowlist.On("Close", mock.Anything).Return(nil)
-	handler := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, storage, allowlist, logger)
-	require.NotNil(t, handler)
+	handler, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, storage, allowlist, config.ConnectorHandlerConfig{}, utils.NewRealClock(), logger)
+	require.NoError(t, err)
 
 	handler.SetConnector(connector)
 
-	err := handler.Start(testutils.Context(t))
+	err = handler.Start(testutils.Context(t))
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		assert.NoError(t, handler.Close())
@@ -163,6 +189,20 @@ func TestFunctionsConnectorHandler(t *testing.T) {
 				handler.HandleGatewayMessage(ctx, "gw1", &msg)
 			})
 
+			t.Run("request too big", func(t *testing.T) {
+				msg.Body.Payload = json.RawMessage(`{"payload":"` + base64.StdEncoding.EncodeToString(make([]byte, 2048)) + `"}`)
+				require.NoError(t, msg.Sign(privateKey))
+				allowlist.On("Allow", addr).Return(true).Once()
+				connector.On("SendToGateway", ctx, "gw1", mock.Anything).Run(func(args mock.Arguments) {
+					msg, ok := args[2].(*api.Message)
+					require.True(t, ok)
+					require.Equal(t, `{"success":false,"error_message":"Bad request to set secret: request is too big: 2746 bytes, max 2392"}`, string(msg.Body.Payload))
+
+				}).Return(nil).Once()
+
+				handler.HandleGatewayMessage(ctx, "gw1", &msg)
+			})
+
 			t.Run("malformed request", func(t *testing.T) {
 				msg.Body.Payload = json.RawMessage(`{sdfgdfgoscsicosd:sdf:::sdf ::; xx}`)
 				require.NoError(t, msg.Sign(privateKey))
@@ -195,3 +235,3711 @@ func TestFunctionsConnectorHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestFunctionsConnectorHandler_NodeAddressMismatch(t *testing.T) {
+	t.Parallel()
+
+	privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+	_, otherAddr := testutils.NewPrivateKeyAndAddress(t)
+	storage := s4mocks.NewStorage(t)
+	allowlist := gfmocks.NewOnchainAllowlist(t)
+
+	_, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, storage, allowlist, config.ConnectorHandlerConfig{}, utils.NewRealClock(), logger.TestLogger(t))
+	require.NoError(t, err)
+
+	_, err = functions.NewFunctionsConnectorHandler(otherAddr.Hex(), privateKey, storage, allowlist, config.ConnectorHandlerConfig{}, utils.NewRealClock(), logger.TestLogger(t))
+	require.ErrorContains(t, err, "doesn't match signer key address")
+
+	_, err = functions.NewFunctionsConnectorHandler(addr.Hex(), nil, storage, allowlist, config.ConnectorHandlerConfig{}, utils.NewRealClock(), logger.TestLogger(t))
+	require.Error(t, err)
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type testHandlerDeps struct {
+	privateKey *ecdsa.PrivateKey
+	addr       ethCommon.Address
+	storage    *s4mocks.Storage
+	connector  *gcmocks.GatewayConnector
+	allowlist  *gfmocks.OnchainAllowlist
+}
+
+func newTestConnectorHandler(t *testing.T, handlerConfig config.ConnectorHandlerConfig, clock utils.Clock, opts ...functions.ConnectorHandlerOpt) (connector.GatewayConnectorHandler, *testHandlerDeps) {
+	privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+	deps := &testHandlerDeps{
+		privateKey: privateKey,
+		addr:       addr,
+		storage:    s4mocks.NewStorage(t),
+		connector:  gcmocks.NewGatewayConnector(t),
+		allowlist:  gfmocks.NewOnchainAllowlist(t),
+	}
+	deps.storage.On("Constraints").Return(s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5}).Maybe()
+	deps.allowlist.On("Start", mock.Anything).Return(nil)
+	deps.allowlist.On("Close", mock.Anything).Return(nil)
+	handler, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, deps.storage, deps.allowlist, handlerConfig, clock, logger.TestLogger(t), opts...)
+	require.NoError(t, err)
+	handler.SetConnector(deps.connector)
+	require.NoError(t, handler.Start(testutils.Context(t)))
+	return handler, deps
+}
+
+func newTestMessage(t *testing.T, privateKey *ecdsa.PrivateKey, method string, payload string) *api.Message {
+	msg := &api.Message{
+		Body: api.MessageBody{
+			DonId:     "fun4",
+			MessageId: "1",
+			Method:    method,
+			Sender:    crypto.PubkeyToAddress(privateKey.PublicKey).Hex(),
+		},
+	}
+	if payload != "" {
+		msg.Body.Payload = json.RawMessage(payload)
+	}
+	require.NoError(t, msg.Sign(privateKey))
+	return msg
+}
+
+// expectResponse registers a single expected response and returns a channel receiving its payload.
+func expectResponse(connector *gcmocks.GatewayConnector, gatewayId string) <-chan string {
+	ch := make(chan string, 1)
+	connector.On("SendToGateway", mock.Anything, gatewayId, mock.Anything).Run(func(args mock.Arguments) {
+		ch <- string(args[2].(*api.Message).Body.Payload)
+	}).Return(nil).Once()
+	return ch
+}
+
+func TestFunctionsConnectorHandler_RateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{SenderRateLimitRPS: 0.1, SenderRateLimitBurst: 2})
+
+	for i := 0; i < 2; i++ {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+	}
+	// The bucket is empty and refills one request every 10 seconds.
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+	require.Equal(t, `{"success":false,"error_code":"RATE_LIMITED","error_message":"Too many requests, retry later","retry_after_sec":10}`, handles.Connector.LastResponsePayload())
+
+	t.Run("other senders have their own bucket", func(t *testing.T) {
+		otherKey, otherAddr := testutils.NewPrivateKeyAndAddress(t)
+		handles.Allowlist.Add(otherAddr)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, otherKey, "status", ""))
+		require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("heavy methods take more tokens", func(t *testing.T) {
+		weightedConfig := config.ConnectorHandlerConfig{SenderRateLimitRPS: 0.1, SenderRateLimitBurst: 4, DailyQuotaMethodWeights: map[string]uint32{"secrets_list": 2}}
+		handler, handles := testhelpers.NewTestHandler(t, weightedConfig)
+		for i := 0; i < 2; i++ {
+			handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+			require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+		}
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Equal(t, `{"success":false,"error_code":"RATE_LIMITED","error_message":"Too many requests, retry later","retry_after_sec":20}`, handles.Connector.LastResponsePayload())
+
+		handles.Clock.Advance(10 * time.Second)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"RATE_LIMITED"`)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+	})
+}
+
+func TestFunctionsConnectorHandler_DonRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{
+		DonRateLimitRPS:   0.1,
+		DonRateLimitBurst: 1,
+		DonRateLimits:     map[string]config.DonRateLimit{"fun5": {RPS: 0.1, Burst: 2}, "fun6": {}},
+	})
+	messageFor := func(donId string) *api.Message {
+		msg := handles.NewMessage("status", "")
+		msg.Body.DonId = donId
+		require.NoError(t, msg.Sign(handles.PrivateKey))
+		return msg
+	}
+	const okResponse = `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`
+
+	handler.HandleGatewayMessage(ctx, "gw1", messageFor("fun4"))
+	require.Equal(t, okResponse, handles.Connector.LastResponsePayload())
+	handler.HandleGatewayMessage(ctx, "gw1", messageFor("fun4"))
+	require.Equal(t, `{"success":false,"error_code":"DON_RATE_LIMITED","error_message":"Too many requests for this DON, retry later","retry_after_sec":10}`, handles.Connector.LastResponsePayload())
+
+	t.Run("other DONs have their own budget", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			handler.HandleGatewayMessage(ctx, "gw1", messageFor("fun5"))
+			require.Equal(t, okResponse, handles.Connector.LastResponsePayload())
+		}
+		handler.HandleGatewayMessage(ctx, "gw1", messageFor("fun5"))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"DON_RATE_LIMITED"`)
+	})
+
+	t.Run("DON overrides without a rate are unlimited", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			handler.HandleGatewayMessage(ctx, "gw1", messageFor("fun6"))
+			require.Equal(t, okResponse, handles.Connector.LastResponsePayload())
+		}
+	})
+}
+
+func TestFunctionsConnectorHandler_MissingMessageId(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+
+	t.Run("rejected by default", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+		msg := handles.NewMessage("status", "")
+		msg.Body.MessageId = ""
+		require.NoError(t, msg.Sign(handles.PrivateKey))
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":false,"error_code":"MISSING_MESSAGE_ID","error_message":"Message ID must not be empty"}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("generated if configured", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{GenerateMissingMessageIds: true})
+		for i := 0; i < 2; i++ {
+			msg := handles.NewMessage("status", "")
+			msg.Body.MessageId = ""
+			require.NoError(t, msg.Sign(handles.PrivateKey))
+			handler.HandleGatewayMessage(ctx, "gw1", msg)
+			require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+		}
+		responses := handles.Connector.Responses()
+		require.Len(t, responses, 2)
+		require.NotEmpty(t, responses[0].Body.MessageId)
+		require.NotEqual(t, responses[0].Body.MessageId, responses[1].Body.MessageId)
+	})
+}
+
+func TestFunctionsConnectorHandler_RetrySafeWrites(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{RetrySafeWrites: true})
+	setPayload := func(version uint64, payload string) string {
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: version}
+		record := s4.Record{Payload: []byte(payload), Expiration: handles.Clock.Now().Add(time.Hour).UnixMilli()}
+		signature := handles.SignRecord(&key, &record)
+		return fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"%s","signature":"%s"}`, version, record.Expiration, base64.StdEncoding.EncodeToString(record.Payload), base64.StdEncoding.EncodeToString(signature))
+	}
+	digest := crypto.Keccak256Hash([]byte("secret")).Hex()
+
+	request := setPayload(1, "secret")
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", request))
+	require.Equal(t, fmt.Sprintf(`{"success":true,"version":1,"digest":"%s"}`, digest), handles.Connector.LastResponsePayload())
+
+	t.Run("retry after the response was lost", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_check_write", fmt.Sprintf(`{"slot_id":1,"version":1,"digest":"%s"}`, digest)))
+		require.Equal(t, fmt.Sprintf(`{"success":true,"landed":true,"current_version":1,"current_digest":"%s"}`, digest), handles.Connector.LastResponsePayload())
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", request))
+		require.Equal(t, fmt.Sprintf(`{"success":true,"version":1,"digest":"%s","already_written":true}`, digest), handles.Connector.LastResponsePayload())
+
+		_, metadata, err := handles.Storage.Get(ctx, &s4.Key{Address: handles.Address, SlotId: 1})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), metadata.Version)
+	})
+
+	t.Run("write that didn't land", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_check_write", fmt.Sprintf(`{"slot_id":1,"version":2,"digest":"%s"}`, digest)))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"landed":false,"current_version":1`)
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_check_write", fmt.Sprintf(`{"slot_id":2,"version":1,"digest":"%s"}`, digest)))
+		require.Equal(t, `{"success":true,"landed":false}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("different record with the same version", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", setPayload(1, "other")))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"STALE_VERSION"`)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_check_write", fmt.Sprintf(`{"slot_id":1,"version":1,"digest":"%s"}`, digest)))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to check write: retry-safe writes are disabled","landed":false}`, handles.Connector.LastResponsePayload())
+	})
+}
+
+func TestFunctionsConnectorHandler_SecureTransportMethods(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handlerConfig := config.ConnectorHandlerConfig{SecureTransportMethods: []string{"secrets_get"}}
+	handler, handles := testhelpers.NewTestHandler(t, handlerConfig)
+	handles.Connector.SetInsecure("gw_insecure")
+
+	handler.HandleGatewayMessage(ctx, "gw_insecure", handles.NewMessage("secrets_get", `{"slot_id":1}`))
+	require.Equal(t, `{"success":false,"error_code":"INSECURE_TRANSPORT","error_message":"Method secrets_get requires a secure transport"}`, handles.Connector.LastResponsePayload())
+
+	handler.HandleGatewayMessage(ctx, "gw_secure", handles.NewMessage("secrets_get", `{"slot_id":1}`))
+	require.NotContains(t, handles.Connector.LastResponsePayload(), "INSECURE_TRANSPORT")
+
+	// Methods not listed are served over any transport.
+	handler.HandleGatewayMessage(ctx, "gw_insecure", handles.NewMessage("status", ""))
+	require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+
+	t.Run("connector not reporting transport security", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Contains(t, <-resp, `"error_code":"INSECURE_TRANSPORT"`)
+	})
+}
+
+func TestFunctionsConnectorHandler_DailyQuota(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 23, 58, 0, 0, time.UTC)}
+	handlerConfig := config.ConnectorHandlerConfig{MaxDailyRequestsPerSender: 2}
+
+	t.Run("rejects after quota and resets at day boundary", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, handlerConfig, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+
+		for i := 0; i < 2; i++ {
+			resp := expectResponse(deps.connector, "gw1")
+			handler.HandleGatewayMessage(ctx, "gw1", msg)
+			require.Equal(t, `{"success":true}`, <-resp)
+		}
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":false,"error_code":"DAILY_QUOTA_EXCEEDED","error_message":"Daily request quota exceeded"}`, <-resp)
+
+		clock.Advance(2 * time.Minute)
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("reset offset", func(t *testing.T) {
+		clock := &testClock{now: time.Date(2023, 6, 1, 23, 58, 0, 0, time.UTC)}
+		offsetConfig := handlerConfig
+		offsetConfig.DailyQuotaResetOffsetSec = 3600
+		handler, deps := newTestConnectorHandler(t, offsetConfig, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+
+		for i := 0; i < 2; i++ {
+			resp := expectResponse(deps.connector, "gw1")
+			handler.HandleGatewayMessage(ctx, "gw1", msg)
+			require.Equal(t, `{"success":true}`, <-resp)
+		}
+
+		// midnight UTC is not a boundary with a one hour offset
+		clock.Advance(2 * time.Minute)
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Contains(t, <-resp, "DAILY_QUOTA_EXCEEDED")
+
+		clock.Advance(time.Hour)
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("method weights", func(t *testing.T) {
+		weightedConfig := config.ConnectorHandlerConfig{MaxDailyRequestsPerSender: 6, DailyQuotaMethodWeights: map[string]uint32{"secrets_set": 3}}
+		handler, deps := newTestConnectorHandler(t, weightedConfig, &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)})
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		send := func(method string, payload string) string {
+			resp := expectResponse(deps.connector, "gw1")
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, method, payload))
+			return <-resp
+		}
+
+		// Two writes use up the budget that allows six reads.
+		require.Equal(t, `{"success":true}`, send("secrets_set", `{"slot_id":1,"payload":"dGVzdA=="}`))
+		require.Equal(t, `{"success":true}`, send("secrets_list", ""))
+		require.Equal(t, `{"success":true}`, send("secrets_list", ""))
+		require.Contains(t, send("secrets_set", `{"slot_id":1,"payload":"dGVzdA=="}`), "DAILY_QUOTA_EXCEEDED")
+		require.Equal(t, `{"success":true}`, send("secrets_list", ""))
+		require.Contains(t, send("secrets_list", ""), "DAILY_QUOTA_EXCEEDED")
+	})
+
+	t.Run("counters are restored and saved", func(t *testing.T) {
+		clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+		store := fmocks.NewDailyQuotaStore(t)
+		privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+		today := clock.Now().Unix() / (24 * 60 * 60)
+		store.On("Load", mock.Anything).Return(&functions.DailyQuotaSnapshot{
+			Day:    today,
+			Counts: map[ethCommon.Address]uint32{addr: 2},
+		}, nil).Once()
+
+		handler, deps := newTestConnectorHandler(t, handlerConfig, clock, functions.WithDailyQuotaStore(store))
+		msg := newTestMessage(t, privateKey, "secrets_list", "")
+		deps.allowlist.On("Allow", addr).Return(true)
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Contains(t, <-resp, "DAILY_QUOTA_EXCEEDED")
+
+		store.On("Save", mock.Anything, &functions.DailyQuotaSnapshot{
+			Day:    today,
+			Counts: map[ethCommon.Address]uint32{addr: 2},
+		}).Return(nil).Once()
+		require.NoError(t, handler.Close())
+	})
+
+	t.Run("stale snapshot is ignored", func(t *testing.T) {
+		clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+		store := fmocks.NewDailyQuotaStore(t)
+		privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+		yesterday := clock.Now().Unix()/(24*60*60) - 1
+		store.On("Load", mock.Anything).Return(&functions.DailyQuotaSnapshot{
+			Day:    yesterday,
+			Counts: map[ethCommon.Address]uint32{addr: 2},
+		}, nil).Once()
+
+		handler, deps := newTestConnectorHandler(t, handlerConfig, clock, functions.WithDailyQuotaStore(store))
+		msg := newTestMessage(t, privateKey, "secrets_list", "")
+		deps.allowlist.On("Allow", addr).Return(true)
+		deps.storage.On("List", mock.Anything, addr).Return([]*s4.SnapshotRow{}, nil)
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":true}`, <-resp)
+
+		store.On("Save", mock.Anything, mock.Anything).Return(nil).Once()
+		require.NoError(t, handler.Close())
+	})
+
+	t.Run("per-sender quotas", func(t *testing.T) {
+		accepted := func(customQuota bool) (n int) {
+			resolver := testQuotaResolver{ethCommon.HexToAddress("0x1"): 10}
+			handler, deps := newTestConnectorHandler(t, handlerConfig, &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}, functions.WithQuotaResolver(resolver))
+			t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+			if customQuota {
+				resolver[deps.addr] = 4
+			}
+			deps.allowlist.On("Allow", deps.addr).Return(true)
+			deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+			for i := 0; i < 5; i++ {
+				resp := expectResponse(deps.connector, "gw1")
+				handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+				if <-resp == `{"success":true}` {
+					n++
+				}
+			}
+			return n
+		}
+
+		require.Equal(t, 2, accepted(false))
+		require.Equal(t, 4, accepted(true))
+	})
+}
+
+// memoryQuotaStore outlives handlers to simulate node restarts.
+type memoryQuotaStore struct {
+	mu       sync.Mutex
+	snapshot *functions.DailyQuotaSnapshot
+	saves    int
+}
+
+func (s *memoryQuotaStore) Load(context.Context) (*functions.DailyQuotaSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot, nil
+}
+
+func (s *memoryQuotaStore) Save(_ context.Context, snapshot *functions.DailyQuotaSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = snapshot
+	s.saves++
+	return nil
+}
+
+func (s *memoryQuotaStore) Saves() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves
+}
+
+func TestFunctionsConnectorHandler_StateCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handlerConfig := config.ConnectorHandlerConfig{MaxDailyRequestsPerSender: 1, StateCheckpointFrequencySec: 1}
+	store := &memoryQuotaStore{}
+
+	handler, deps := newTestConnectorHandler(t, handlerConfig, clock, functions.WithDailyQuotaStore(store))
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+	resp := expectResponse(deps.connector, "gw1")
+	handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+	require.Equal(t, `{"success":true}`, <-resp)
+
+	// state is checkpointed while running, not only on Close
+	gomega.NewWithT(t).Eventually(store.Saves).Should(gomega.BeNumerically(">", 0))
+	require.NoError(t, handler.Close())
+
+	// simulated restart, the same sender keeps its exhausted budget
+	restarted, restartedDeps := newTestConnectorHandler(t, handlerConfig, clock, functions.WithDailyQuotaStore(store))
+	t.Cleanup(func() { assert.NoError(t, restarted.Close()) })
+	restartedDeps.allowlist.On("Allow", deps.addr).Return(true)
+	resp = expectResponse(restartedDeps.connector, "gw1")
+	restarted.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+	require.Contains(t, <-resp, "DAILY_QUOTA_EXCEEDED")
+}
+
+func TestFunctionsConnectorHandler_StateRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handlerConfig := config.ConnectorHandlerConfig{SenderRateLimitRPS: 0.1, SenderRateLimitBurst: 1, ResponseCacheSize: 10, ResponseCacheTTLSec: 60}
+	store := &memoryQuotaStore{}
+
+	handler, deps := newTestConnectorHandler(t, handlerConfig, clock, functions.WithDailyQuotaStore(store))
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Once()
+	resp := expectResponse(deps.connector, "gw1")
+	handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+	require.Equal(t, `{"success":true}`, <-resp)
+	require.NoError(t, handler.Close())
+
+	// simulated restart, the retry is answered from the restored cache and the rate limit still applies
+	restarted, restartedDeps := newTestConnectorHandler(t, handlerConfig, clock, functions.WithDailyQuotaStore(store))
+	t.Cleanup(func() { assert.NoError(t, restarted.Close()) })
+	restartedDeps.allowlist.On("Allow", deps.addr).Return(true)
+	resp = expectResponse(restartedDeps.connector, "gw1")
+	restarted.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+	require.Equal(t, `{"success":true}`, <-resp)
+
+	resp = expectResponse(restartedDeps.connector, "gw1")
+	restarted.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"sort_by":"version"}`))
+	require.Contains(t, <-resp, `"error_code":"MESSAGE_ID_REUSE"`)
+
+	msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+	msg.Body.MessageId = "2"
+	require.NoError(t, msg.Sign(deps.privateKey))
+	resp = expectResponse(restartedDeps.connector, "gw1")
+	restarted.HandleGatewayMessage(ctx, "gw1", msg)
+	require.Equal(t, `{"success":false,"error_code":"RATE_LIMITED","error_message":"Too many requests, retry later","retry_after_sec":10}`, <-resp)
+}
+
+func TestFunctionsConnectorHandler_PanicRecovery(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+
+	t.Run("recovers and responds", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Run(func(args mock.Arguments) {
+			panic("boom")
+		}).Return(nil, nil).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		require.NotPanics(t, func() {
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		})
+		require.Equal(t, `{"success":false,"error_code":"INTERNAL_ERROR","error_message":"Internal error"}`, <-resp)
+	})
+
+	t.Run("no second response after a panic in send", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Once()
+		// The response is delivered, then the connector panics.
+		deps.connector.On("SendToGateway", mock.Anything, "gw1", mock.Anything).Run(func(args mock.Arguments) {
+			panic("connection reset")
+		}).Return(nil).Once()
+
+		require.NotPanics(t, func() {
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		})
+		deps.connector.AssertNumberOfCalls(t, "SendToGateway", 1)
+	})
+
+	t.Run("rethrows when configured", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{RethrowPanics: true}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Run(func(args mock.Arguments) {
+			panic("boom")
+		}).Return(nil, nil).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		require.PanicsWithValue(t, "boom", func() {
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		})
+		require.Contains(t, <-resp, "INTERNAL_ERROR")
+	})
+}
+
+func TestFunctionsConnectorHandler_SecretsListSorting(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return(func(context.Context, ethCommon.Address) []*s4.SnapshotRow {
+		return []*s4.SnapshotRow{
+			{SlotId: 2, Version: 1, Expiration: 300},
+			{SlotId: 0, Version: 7, Expiration: 200},
+			{SlotId: 1, Version: 3, Expiration: 200},
+		}
+	}, nil)
+
+	row0 := `{"slot_id":0,"version":7,"expiration":200}`
+	row1 := `{"slot_id":1,"version":3,"expiration":200}`
+	row2 := `{"slot_id":2,"version":1,"expiration":300}`
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected string
+	}{
+		{"default", "", `{"success":true,"rows":[` + row0 + `,` + row1 + `,` + row2 + `]}`},
+		{"slot descending", `{"sort_by":"slot","descending":true}`, `{"success":true,"rows":[` + row2 + `,` + row1 + `,` + row0 + `]}`},
+		{"expiration", `{"sort_by":"expiration"}`, `{"success":true,"rows":[` + row0 + `,` + row1 + `,` + row2 + `]}`},
+		{"expiration descending", `{"sort_by":"expiration","descending":true}`, `{"success":true,"rows":[` + row2 + `,` + row0 + `,` + row1 + `]}`},
+		{"version", `{"sort_by":"version"}`, `{"success":true,"rows":[` + row2 + `,` + row1 + `,` + row0 + `]}`},
+		{"version descending", `{"sort_by":"version","descending":true}`, `{"success":true,"rows":[` + row0 + `,` + row1 + `,` + row2 + `]}`},
+		{"unsupported", `{"sort_by":"payload"}`, `{"success":false,"error_message":"Bad request to list secrets: unsupported sort_by: \"payload\""}`},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp := expectResponse(deps.connector, "gw1")
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", test.payload))
+			require.Equal(t, test.expected, <-resp)
+		})
+	}
+}
+
+func TestFunctionsConnectorHandler_SecretsCopy(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	srcKey := s4.Key{Address: deps.addr, SlotId: 1, Version: 5}
+	srcRecord := s4.Record{Payload: []byte("test"), Expiration: 1000}
+	dstKey := s4.Key{Address: deps.addr, SlotId: 2, Version: 1}
+	dstRecord := s4.Record{Payload: []byte("test"), Expiration: 2000}
+	signature, err := s4.NewEnvelopeFromRecord(&dstKey, &dstRecord).Sign(deps.privateKey)
+	require.NoError(t, err)
+	copyPayload := func(signature []byte) string {
+		return `{"slot_id":1,"version":5,"dest_slot_id":2,"dest_version":1,"expiration":2000,"signature":"` + base64.StdEncoding.EncodeToString(signature) + `"}`
+	}
+
+	t.Run("success", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &srcKey).Return(&srcRecord, &s4.Metadata{Version: 5}, nil).Once()
+		deps.storage.On("Put", mock.Anything, &dstKey, &dstRecord, signature).Return(nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_copy", copyPayload(signature)))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("missing source", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &srcKey).Return(nil, nil, s4.ErrNotFound).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_copy", copyPayload(signature)))
+		require.Equal(t, `{"success":false,"error_message":"Failed to copy secret: not found"}`, <-resp)
+	})
+
+	t.Run("source version mismatch", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &srcKey).Return(&srcRecord, &s4.Metadata{Version: 6}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_copy", copyPayload(signature)))
+		require.Equal(t, `{"success":false,"error_message":"Failed to copy secret: source version mismatch: stored version is 6"}`, <-resp)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		otherKey, _ := testutils.NewPrivateKeyAndAddress(t)
+		otherSignature, err := s4.NewEnvelopeFromRecord(&dstKey, &dstRecord).Sign(otherKey)
+		require.NoError(t, err)
+		deps.storage.On("Get", mock.Anything, &srcKey).Return(&srcRecord, &s4.Metadata{Version: 5}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_copy", copyPayload(otherSignature)))
+		require.Equal(t, `{"success":false,"error_message":"Failed to copy secret: wrong signature"}`, <-resp)
+	})
+
+	t.Run("same slot", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_copy", `{"slot_id":1,"dest_slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to copy secret: destination slot must differ from the source slot"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_SecretsSwap(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	keyA, recordA := s4.Key{Address: deps.addr, SlotId: 1, Version: 3}, s4.Record{Payload: []byte("staged"), Expiration: 1000}
+	keyB, recordB := s4.Key{Address: deps.addr, SlotId: 2, Version: 7}, s4.Record{Payload: []byte("live"), Expiration: 2000}
+	newKeyA, newKeyB := s4.Key{Address: deps.addr, SlotId: 1, Version: 4}, s4.Key{Address: deps.addr, SlotId: 2, Version: 8}
+	signatureA, err := s4.NewEnvelopeFromRecord(&newKeyA, &recordB).Sign(deps.privateKey)
+	require.NoError(t, err)
+	signatureB, err := s4.NewEnvelopeFromRecord(&newKeyB, &recordA).Sign(deps.privateKey)
+	require.NoError(t, err)
+	swap := func(signatureA, signatureB []byte) string {
+		payload := fmt.Sprintf(`{"slots":[{"slot_id":1,"version":3,"new_version":4,"signature":"%s"},{"slot_id":2,"version":7,"new_version":8,"signature":"%s"}]}`,
+			base64.StdEncoding.EncodeToString(signatureA), base64.StdEncoding.EncodeToString(signatureB))
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_swap", payload))
+		return <-resp
+	}
+	expectGets := func() {
+		deps.storage.On("Get", mock.Anything, &keyA).Return(&recordA, &s4.Metadata{Version: 3}, nil).Once()
+		deps.storage.On("Get", mock.Anything, &keyB).Return(&recordB, &s4.Metadata{Version: 7}, nil).Once()
+	}
+
+	t.Run("success", func(t *testing.T) {
+		expectGets()
+		deps.storage.On("Put", mock.Anything, &newKeyA, &recordB, signatureA).Return(nil).Once()
+		deps.storage.On("Put", mock.Anything, &newKeyB, &recordA, signatureB).Return(nil).Once()
+		require.Equal(t, `{"success":true}`, swap(signatureA, signatureB))
+	})
+
+	t.Run("failure mid-swap", func(t *testing.T) {
+		expectGets()
+		deps.storage.On("Put", mock.Anything, &newKeyA, &recordB, signatureA).Return(nil).Once()
+		deps.storage.On("Put", mock.Anything, &newKeyB, &recordA, signatureB).Return(errors.New("connection reset")).Once()
+		require.Equal(t, `{"success":false,"error_code":"SWAP_INCOMPLETE","error_message":"Slot 1 was swapped, but writing slot 2 failed: connection reset"}`, swap(signatureA, signatureB))
+	})
+
+	t.Run("nothing is written without both signatures", func(t *testing.T) {
+		expectGets()
+		require.Equal(t, `{"success":false,"error_message":"Failed to swap secrets: slot 2: wrong signature"}`, swap(signatureA, signatureA))
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &keyA).Return(&recordA, &s4.Metadata{Version: 4}, nil).Once()
+		require.Equal(t, `{"success":false,"error_message":"Failed to swap secrets: slot 1 version mismatch: stored version is 4"}`, swap(signatureA, signatureB))
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_swap", `{"slots":[{"slot_id":1},{"slot_id":1}]}`))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to swap secrets: slots must differ"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_VerifyRecordsOnRead(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handlerConfig := config.ConnectorHandlerConfig{VerifyRecordsOnRead: true, MaxInlinePayloadBytes: 16}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	expiration := time.Now().Add(time.Hour).UnixMilli()
+	signature, err := s4.NewEnvelopeFromRecord(&s4.Key{Address: deps.addr, SlotId: 1, Version: 2}, &s4.Record{Payload: []byte("test"), Expiration: expiration}).Sign(deps.privateKey)
+	require.NoError(t, err)
+	metadata := &s4.Metadata{Version: 2, Signature: signature}
+	send := func(method string, payload string) string {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, method, payload))
+		return <-resp
+	}
+
+	t.Run("intact record", func(t *testing.T) {
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(&s4.Record{Payload: []byte("test"), Expiration: expiration}, metadata, nil).Once()
+		require.Contains(t, send("secrets_get", `{"slot_id":1}`), `"payload":"dGVzdA=="`)
+	})
+
+	t.Run("corrupted payload", func(t *testing.T) {
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(&s4.Record{Payload: []byte("tesT"), Expiration: expiration}, metadata, nil).Once()
+		require.Equal(t, `{"success":false,"error_code":"INTEGRITY_ERROR","error_message":"Stored record failed the integrity check"}`, send("secrets_get", `{"slot_id":1}`))
+	})
+
+	t.Run("corrupted inlined payload", func(t *testing.T) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1, Version: 2, Expiration: expiration, PayloadSize: 4}}, nil).Once()
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(&s4.Record{Payload: []byte("tesT"), Expiration: expiration}, metadata, nil).Once()
+		require.Equal(t, `{"success":false,"error_code":"INTEGRITY_ERROR","error_message":"Stored record failed the integrity check: slot 1: record doesn't match its signature"}`, send("secrets_list", `{"include_payloads":true}`))
+	})
+}
+
+func TestFunctionsConnectorHandler_SecretsGetExpired(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	expiredRecord := s4.Record{Payload: []byte("test"), Expiration: clock.Now().Add(-time.Minute).UnixMilli()}
+	expirationStr := strconv.FormatInt(expiredRecord.Expiration, 10)
+
+	t.Run("rejects expired by default", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		key := s4.Key{Address: deps.addr, SlotId: 1}
+		deps.storage.On("GetIncludingExpired", mock.Anything, &key).Return(&expiredRecord, &s4.Metadata{Version: 3}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_code":"EXPIRED","error_message":"Secret has expired"}`, <-resp)
+	})
+
+	t.Run("returns expired with flag when allowed", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{AllowExpiredReads: true}, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		key := s4.Key{Address: deps.addr, SlotId: 1}
+		deps.storage.On("GetIncludingExpired", mock.Anything, &key).Return(&expiredRecord, &s4.Metadata{Version: 3}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":true,"version":3,"expiration":`+expirationStr+`,"payload":"dGVzdA==","expired":true}`, <-resp)
+	})
+
+	t.Run("fresh record is not flagged", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{AllowExpiredReads: true}, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		key := s4.Key{Address: deps.addr, SlotId: 1}
+		freshRecord := s4.Record{Payload: []byte("test"), Expiration: clock.Now().Add(time.Minute).UnixMilli()}
+		deps.storage.On("GetIncludingExpired", mock.Anything, &key).Return(&freshRecord, &s4.Metadata{Version: 3}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":true,"version":3,"expiration":`+strconv.FormatInt(freshRecord.Expiration, 10)+`,"payload":"dGVzdA=="}`, <-resp)
+	})
+
+	t.Run("read grace window", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{ReadGraceSec: 60}, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		key := s4.Key{Address: deps.addr, SlotId: 1}
+		insideRecord := expiredRecord
+		outsideRecord := s4.Record{Payload: []byte("test"), Expiration: expiredRecord.Expiration - 1}
+		deps.storage.On("GetIncludingExpired", mock.Anything, &key).Return(&insideRecord, &s4.Metadata{Version: 3}, nil).Once()
+		deps.storage.On("GetIncludingExpired", mock.Anything, &key).Return(&outsideRecord, &s4.Metadata{Version: 3}, nil).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":true,"version":3,"expiration":`+expirationStr+`,"payload":"dGVzdA==","stale":true}`, <-resp)
+
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_code":"EXPIRED","error_message":"Secret has expired"}`, <-resp)
+	})
+
+	t.Run("missing record", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, clock)
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(nil, nil, s4.ErrNotFound).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_message":"Failed to get secret: not found"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_Timestamps(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	// Real storage stamps records with the injected clock.
+	storage := s4.NewStorage(logger.TestLogger(t), s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5}, s4.NewInMemoryORM(), clock)
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(func(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+		return storage.Put(ctx, key, record, signature)
+	})
+	deps.storage.On("List", mock.Anything, deps.addr).Return(func(ctx context.Context, address ethCommon.Address) ([]*s4.SnapshotRow, error) {
+		return storage.List(ctx, address)
+	})
+	deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(func(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metadata, error) {
+		return storage.GetIncludingExpired(ctx, key)
+	})
+
+	// The in-memory ORM filters snapshots by the wall clock.
+	expiration := time.Now().Add(24 * time.Hour).UnixMilli()
+	set := func(version uint64) {
+		key := s4.Key{Address: deps.addr, SlotId: 1, Version: version}
+		record := s4.Record{Payload: []byte("test"), Expiration: expiration}
+		signature, err := s4.NewEnvelopeFromRecord(&key, &record).Sign(deps.privateKey)
+		require.NoError(t, err)
+		payload := fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, version, expiration, base64.StdEncoding.EncodeToString(signature))
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", payload))
+		require.Equal(t, `{"success":true}`, <-resp)
+	}
+
+	createdAt := clock.Now().UnixMilli()
+	set(1)
+	clock.Advance(time.Minute)
+	updatedAt := clock.Now().UnixMilli()
+	set(2)
+
+	resp := expectResponse(deps.connector, "gw1")
+	handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+	require.Equal(t, fmt.Sprintf(`{"success":true,"rows":[{"slot_id":1,"version":2,"expiration":%d,"created_at":%d,"updated_at":%d}]}`, expiration, createdAt, updatedAt), <-resp)
+
+	resp = expectResponse(deps.connector, "gw1")
+	handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+	require.Equal(t, fmt.Sprintf(`{"success":true,"version":2,"expiration":%d,"payload":"dGVzdA==","created_at":%d,"updated_at":%d}`, expiration, createdAt, updatedAt), <-resp)
+}
+
+func TestFunctionsConnectorHandler_SecretsBulkTouch(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	now := time.Now()
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	records := map[uint]*s4.Record{
+		1: {Payload: []byte("one"), Expiration: now.Add(time.Hour).UnixMilli()},
+		3: {Payload: []byte("three"), Expiration: now.Add(2 * time.Hour).UnixMilli()},
+	}
+	mockGets := func() {
+		for slotId, record := range records {
+			deps.storage.On("Get", mock.Anything, &s4.Key{Address: deps.addr, SlotId: slotId}).Return(record, &s4.Metadata{Version: uint64(slotId)}, nil).Once()
+		}
+	}
+	// sign returns the signatures field for new expirations of the given slots and mocks the matching Puts.
+	sign := func(expirations map[uint]int64) string {
+		signatures := make(map[uint][]byte)
+		for slotId, expiration := range expirations {
+			key := s4.Key{Address: deps.addr, SlotId: slotId, Version: uint64(slotId) + 1}
+			record := s4.Record{Payload: records[slotId].Payload, Expiration: expiration}
+			signature, err := s4.NewEnvelopeFromRecord(&key, &record).Sign(deps.privateKey)
+			require.NoError(t, err)
+			signatures[slotId] = signature
+			deps.storage.On("Put", mock.Anything, &key, &record, signature).Return(nil).Once()
+		}
+		js, err := json.Marshal(signatures)
+		require.NoError(t, err)
+		return string(js)
+	}
+
+	t.Run("delta for all records", func(t *testing.T) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1}, {SlotId: 3}}, nil).Once()
+		mockGets()
+		signatures := sign(map[uint]int64{1: records[1].Expiration + 60000, 3: records[3].Expiration + 60000})
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"extend_by_ms":60000,"signatures":`+signatures+`}`))
+		require.Equal(t, `{"success":true,"updated":2}`, <-resp)
+	})
+
+	t.Run("absolute for all records", func(t *testing.T) {
+		expiration := now.Add(24 * time.Hour).UnixMilli()
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1}, {SlotId: 3}}, nil).Once()
+		mockGets()
+		signatures := sign(map[uint]int64{1: expiration, 3: expiration})
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"expiration":`+strconv.FormatInt(expiration, 10)+`,"signatures":`+signatures+`}`))
+		require.Equal(t, `{"success":true,"updated":2}`, <-resp)
+	})
+
+	t.Run("subset", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 3}).Return(records[3], &s4.Metadata{Version: 3}, nil).Once()
+		signatures := sign(map[uint]int64{3: records[3].Expiration + 1000})
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"slot_ids":[3],"extend_by_ms":1000,"signatures":`+signatures+`}`))
+		require.Equal(t, `{"success":true,"updated":1}`, <-resp)
+	})
+
+	t.Run("missing signature writes nothing", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(records[1], &s4.Metadata{Version: 1}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"slot_ids":[1],"extend_by_ms":1000}`))
+		require.Equal(t, `{"success":false,"error_message":"Failed to touch secrets: slot 1: wrong signature","updated":0}`, <-resp)
+	})
+
+	t.Run("both modes", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"extend_by_ms":1000,"expiration":1000}`))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to touch secrets: exactly one of extend_by_ms and expiration must be set","updated":0}`, <-resp)
+	})
+
+	t.Run("version at the uint64 maximum", func(t *testing.T) {
+		deps.storage.On("Get", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(records[1], &s4.Metadata{Version: math.MaxUint64}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"slot_ids":[1],"extend_by_ms":1000}`))
+		require.Equal(t, `{"success":false,"error_code":"VERSION_OUT_OF_RANGE","error_message":"Failed to touch secrets: slot 1: version can't be incremented beyond 18446744073709551615"}`, <-resp)
+	})
+
+	t.Run("version at MaxVersion", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxVersion: 3}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("Get", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 3}).Return(records[3], &s4.Metadata{Version: 3}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_bulk_touch", `{"slot_ids":[3],"extend_by_ms":1000}`))
+		require.Equal(t, `{"success":false,"error_code":"VERSION_OUT_OF_RANGE","error_message":"Failed to touch secrets: slot 3: version can't be incremented beyond 3"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_StrictDonIdMatching(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handlerConfig := config.ConnectorHandlerConfig{StrictDonIdMatching: true, AcceptedDonIds: []string{"fun4", "fun5"}}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true).Maybe()
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Maybe()
+
+	for _, donId := range []string{"fun4", "fun5"} {
+		t.Run("accepted "+donId, func(t *testing.T) {
+			msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+			msg.Body.DonId = donId
+			require.NoError(t, msg.Sign(deps.privateKey))
+			resp := make(chan *api.Message, 1)
+			deps.connector.On("SendToGateway", mock.Anything, "gw1", mock.Anything).Run(func(args mock.Arguments) {
+				resp <- args[2].(*api.Message)
+			}).Return(nil).Once()
+			handler.HandleGatewayMessage(ctx, "gw1", msg)
+			require.Equal(t, donId, (<-resp).Body.DonId)
+		})
+	}
+
+	t.Run("mismatched DON is dropped", func(t *testing.T) {
+		msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+		msg.Body.DonId = "fun6"
+		require.NoError(t, msg.Sign(deps.privateKey))
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		deps.connector.AssertNotCalled(t, "SendToGateway", mock.Anything, "gw1", mock.MatchedBy(func(msg *api.Message) bool {
+			return msg.Body.DonId == "fun6"
+		}))
+	})
+}
+
+func TestFunctionsConnectorHandler_Tombstones(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{TombstoneRetentionSec: 3600})
+	write := func(method string, version uint64, payload []byte, expiration int64) string {
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: version}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: payload, Expiration: expiration})
+		request := fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"%s","signature":"%s"}`,
+			version, expiration, base64.StdEncoding.EncodeToString(payload), base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage(method, request))
+		return handles.Connector.LastResponsePayload()
+	}
+	// The in-memory ORM filters snapshots by the wall clock.
+	expiration := time.Now().Add(30 * time.Minute).UnixMilli()
+
+	require.Equal(t, `{"success":true}`, write("secrets_set", 1, []byte("test"), expiration))
+	require.Equal(t, `{"success":false,"error_message":"Bad request to set secret: empty payload is reserved for deleted secrets"}`, write("secrets_set", 2, []byte{}, expiration))
+	require.Equal(t, `{"success":false,"error_message":"Bad request to delete secret: tombstone must expire within 1h0m0s"}`, write("secrets_delete", 2, []byte{}, handles.Clock.Now().Add(2*time.Hour).UnixMilli()))
+
+	handles.Clock.Advance(time.Minute)
+	deletedAt := handles.Clock.Now().UnixMilli()
+	require.Equal(t, `{"success":true}`, write("secrets_delete", 2, []byte{}, expiration))
+
+	t.Run("listed as deleted", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		var response struct {
+			Rows []struct {
+				SlotID             uint   `json:"slot_id"`
+				Version            uint64 `json:"version"`
+				Deleted            bool   `json:"deleted"`
+				TombstoneSignature []byte `json:"tombstone_signature"`
+			} `json:"rows"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(handles.Connector.LastResponsePayload()), &response))
+		require.Len(t, response.Rows, 1)
+		require.True(t, response.Rows[0].Deleted)
+		tombstone := functions.Tombstone{Address: handles.Address, SlotID: 1, Version: 2, DeletedAt: deletedAt}
+		signer, err := tombstone.GetSignerAddress(response.Rows[0].TombstoneSignature)
+		require.NoError(t, err)
+		require.Equal(t, handles.Address, signer)
+	})
+
+	t.Run("get returns deleted flag", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", `{"slot_id":1}`))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"deleted":true`)
+	})
+
+	t.Run("garbage collected after retention", func(t *testing.T) {
+		_, err := handles.ORM.DeleteExpired(100, time.UnixMilli(expiration+1))
+		require.NoError(t, err)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+	})
+}
+
+func TestFunctionsConnectorHandler_TombstonesDisabled(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_delete", `{"slot_id":1}`))
+	require.Equal(t, `{"success":false,"error_message":"Bad request to delete secret: deletes are disabled"}`, handles.Connector.LastResponsePayload())
+}
+
+func TestFunctionsConnectorHandler_SecretsSetLargeNumbers(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	// Neither value is exactly representable as a float64.
+	key := s4.Key{Address: deps.addr, SlotId: 1, Version: math.MaxUint64}
+	record := s4.Record{Payload: []byte("test"), Expiration: math.MaxInt64 - 1}
+
+	for _, tc := range []struct {
+		name    string
+		payload string
+	}{
+		{"numbers", `{"slot_id":1,"version":18446744073709551615,"expiration":9223372036854775806,"payload":"dGVzdA=="}`},
+		{"strings", `{"slot_id":1,"version":"18446744073709551615","expiration":"9223372036854775806","payload":"dGVzdA=="}`},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			deps.storage.On("Put", mock.Anything, &key, &record, mock.Anything).Return(nil).Once()
+			resp := expectResponse(deps.connector, "gw1")
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", tc.payload))
+			require.Equal(t, `{"success":true}`, <-resp)
+		})
+	}
+
+	t.Run("invalid string", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":"1x"}`))
+		require.Contains(t, <-resp, `"error_message":"Bad request to set secret: invalid version: `)
+	})
+}
+
+func TestFunctionsConnectorHandler_ResponsesGoToOriginGateway(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxDailyRequestsPerSender: 2}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+
+	var mu sync.Mutex
+	sent := make(map[string]int)
+	deps.connector.On("SendToGateway", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent[args[1].(string)]++
+	}).Return(nil)
+
+	var wg sync.WaitGroup
+	// The third request exceeds the daily quota, error responses must be routed to the origin too.
+	for _, gatewayId := range []string{"gw1", "gw2", "gw3"} {
+		gatewayId := gatewayId
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.HandleGatewayMessage(ctx, gatewayId, newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, map[string]int{"gw1": 1, "gw2": 1, "gw3": 1}, sent)
+}
+
+func TestFunctionsConnectorHandler_SignatureFormat(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{SignatureLength: crypto.SignatureLength})
+	expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	set := func(signature []byte) string {
+		request := fmt.Sprintf(`{"slot_id":1,"version":1,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, expiration, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", request))
+		return handles.Connector.LastResponsePayload()
+	}
+
+	require.Equal(t, `{"success":false,"error_code":"BAD_SIGNATURE_FORMAT","error_message":"Signature must be 65 bytes long, got 0"}`, set(nil))
+	require.Equal(t, `{"success":false,"error_code":"BAD_SIGNATURE_FORMAT","error_message":"Signature must be 65 bytes long, got 64"}`, set(make([]byte, 64)))
+	// Well-formed signatures are verified by storage.
+	require.Equal(t, `{"success":false,"error_message":"Failed to set secret: wrong signature"}`, set(make([]byte, 65)))
+
+	key := s4.Key{Address: handles.Address, SlotId: 1, Version: 1}
+	require.Equal(t, `{"success":true}`, set(handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration})))
+}
+
+func TestFunctionsConnectorHandler_MirrorStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	record := s4.Record{Payload: []byte("test"), Expiration: time.Now().Add(time.Hour).UnixMilli()}
+	expiration := strconv.FormatInt(record.Expiration, 10)
+	newHandler := func(t *testing.T, mirror *s4mocks.Storage, fallbackReads bool) (connector.GatewayConnectorHandler, *testHandlerDeps) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithMirrorStorage(mirror, fallbackReads))
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		return handler, deps
+	}
+	set := func(t *testing.T, handler connector.GatewayConnectorHandler, deps *testHandlerDeps, mirror *s4mocks.Storage, mirrorErr error) {
+		mirrored := make(chan *s4.Key, 1)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		mirror.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			mirrored <- args.Get(1).(*s4.Key)
+		}).Return(mirrorErr).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":2,"payload":"dGVzdA=="}`))
+		require.Equal(t, `{"success":true}`, <-resp)
+		require.Equal(t, &s4.Key{Address: deps.addr, SlotId: 1, Version: 2}, <-mirrored)
+	}
+
+	t.Run("writes reach both stores", func(t *testing.T) {
+		mirror := s4mocks.NewStorage(t)
+		handler, deps := newHandler(t, mirror, false)
+		set(t, handler, deps, mirror, nil)
+	})
+
+	t.Run("mirror failures don't fail writes", func(t *testing.T) {
+		mirror := s4mocks.NewStorage(t)
+		handler, deps := newHandler(t, mirror, false)
+		set(t, handler, deps, mirror, errors.New("connection refused"))
+	})
+
+	t.Run("failed writes aren't mirrored", func(t *testing.T) {
+		mirror := s4mocks.NewStorage(t)
+		handler, deps := newHandler(t, mirror, false)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(s4.ErrWrongSignature).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"payload":"dGVzdA=="}`))
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: wrong signature"}`, <-resp)
+	})
+
+	t.Run("reads fall back to the mirror", func(t *testing.T) {
+		mirror := s4mocks.NewStorage(t)
+		handler, deps := newHandler(t, mirror, true)
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(nil, nil, errors.New("connection refused")).Once()
+		mirror.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(&record, &s4.Metadata{Version: 2}, nil).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":true,"version":2,"expiration":`+expiration+`,"payload":"dGVzdA=="}`, <-resp)
+
+		// Secrets missing from the primary storage are not looked up in the mirror.
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(nil, nil, s4.ErrNotFound).Once()
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_message":"Failed to get secret: not found"}`, <-resp)
+	})
+
+	t.Run("pending mirror writes are bounded", func(t *testing.T) {
+		mirror := s4mocks.NewStorage(t)
+		handler, deps := newHandler(t, mirror, false)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		mirrorStarted, releaseMirror := make(chan struct{}, 32), make(chan struct{})
+		mirror.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			mirrorStarted <- struct{}{}
+			<-releaseMirror
+		}).Return(nil).Times(32)
+		defer close(releaseMirror)
+
+		for i := 0; i < 33; i++ {
+			resp := expectResponse(deps.connector, "gw1")
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":2,"payload":"dGVzdA=="}`))
+			require.Equal(t, `{"success":true}`, <-resp)
+		}
+		for i := 0; i < 32; i++ {
+			<-mirrorStarted
+		}
+	})
+
+	t.Run("writes after close aren't mirrored", func(t *testing.T) {
+		mirror := s4mocks.NewStorage(t)
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithMirrorStorage(mirror, false))
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		require.NoError(t, handler.Close())
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":2,"payload":"dGVzdA=="}`))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_ReadReplica(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	record := s4.Record{Payload: []byte("test"), Expiration: time.Now().Add(time.Hour).UnixMilli()}
+	expiration := strconv.FormatInt(record.Expiration, 10)
+
+	t.Run("reads go to replica, writes to primary", func(t *testing.T) {
+		replica := s4mocks.NewStorage(t)
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithReadReplica(replica, false))
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		replica.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1, Version: 2, Expiration: 3}}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":2,"expiration":3}]}`, <-resp)
+
+		replica.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(&record, &s4.Metadata{Version: 2}, nil).Once()
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":true,"version":2,"expiration":`+expiration+`,"payload":"dGVzdA=="}`, <-resp)
+
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"payload":"dGVzdA=="}`))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("misses fall back to primary", func(t *testing.T) {
+		replica := s4mocks.NewStorage(t)
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithReadReplica(replica, true))
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		replica.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Once()
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1, Version: 2, Expiration: 3}}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":2,"expiration":3}]}`, <-resp)
+
+		replica.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(nil, nil, s4.ErrNotFound).Once()
+		deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(&record, &s4.Metadata{Version: 2}, nil).Once()
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":true,"version":2,"expiration":`+expiration+`,"payload":"dGVzdA=="}`, <-resp)
+	})
+
+	t.Run("misses without fallback", func(t *testing.T) {
+		replica := s4mocks.NewStorage(t)
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithReadReplica(replica, false))
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		replica.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(nil, nil, s4.ErrNotFound).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_message":"Failed to get secret: not found"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_MaxListRows(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxListRows: 2}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	snapshot := func(n int) []*s4.SnapshotRow {
+		rows := make([]*s4.SnapshotRow, n)
+		for i := range rows {
+			rows[i] = &s4.SnapshotRow{SlotId: uint(n - i), Version: 1, Expiration: 1}
+		}
+		return rows
+	}
+
+	t.Run("at cap", func(t *testing.T) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return(snapshot(2), nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":1,"expiration":1},{"slot_id":2,"version":1,"expiration":1}]}`, <-resp)
+	})
+
+	t.Run("above cap keeps the first rows in order", func(t *testing.T) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return(snapshot(5), nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"descending":true}`))
+		require.Equal(t, `{"success":true,"rows":[{"slot_id":5,"version":1,"expiration":1},{"slot_id":4,"version":1,"expiration":1}],"truncated":true,"next_cursor":"eyJzIjoic2xvdCIsImQiOnRydWUsImkiOjQsInYiOjEsImUiOjF9"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_MaxListResponseBytes(t *testing.T) {
+	t.Parallel()
+
+	const maxBytes = 4096
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxListResponseBytes: maxBytes}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	snapshot := make([]*s4.SnapshotRow, 5000)
+	for i := range snapshot {
+		snapshot[i] = &s4.SnapshotRow{SlotId: uint(i), Version: 1, Expiration: 1}
+	}
+	deps.storage.On("List", mock.Anything, deps.addr).Return(func(context.Context, ethCommon.Address) []*s4.SnapshotRow {
+		return snapshot
+	}, nil)
+
+	var listed []uint
+	var pages int
+	cursor := ""
+	for {
+		resp := expectResponse(deps.connector, "gw1")
+		payload := ""
+		if cursor != "" {
+			payload = fmt.Sprintf(`{"cursor":"%s"}`, cursor)
+		}
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", payload))
+		var page struct {
+			Success bool            `json:"success"`
+			Rows    json.RawMessage `json:"rows"`
+			// NextCursor is set on all but the last page.
+			NextCursor string `json:"next_cursor"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(<-resp), &page))
+		require.True(t, page.Success)
+		require.LessOrEqual(t, len(page.Rows), maxBytes)
+		var rows []struct {
+			SlotID uint `json:"slot_id"`
+		}
+		require.NoError(t, json.Unmarshal(page.Rows, &rows))
+		require.NotEmpty(t, rows)
+		for _, row := range rows {
+			listed = append(listed, row.SlotID)
+		}
+		pages++
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	require.Len(t, listed, len(snapshot))
+	for i, slot := range listed {
+		require.Equal(t, uint(i), slot)
+	}
+	require.Greater(t, pages, 1)
+}
+
+func TestFunctionsConnectorHandler_ListCursor(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxListRows: 3}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	snapshot := func(slots ...uint) []*s4.SnapshotRow {
+		rows := make([]*s4.SnapshotRow, len(slots))
+		for i, slot := range slots {
+			rows[i] = &s4.SnapshotRow{SlotId: slot, Version: uint64(10 - slot), Expiration: 1}
+		}
+		return rows
+	}
+	type listResponse struct {
+		Success bool `json:"success"`
+		Rows    []struct {
+			SlotID uint `json:"slot_id"`
+		} `json:"rows"`
+		Truncated    bool   `json:"truncated"`
+		NextCursor   string `json:"next_cursor"`
+		ErrorMessage string `json:"error_message"`
+	}
+	list := func(rows []*s4.SnapshotRow, payload string) (response listResponse, slots []uint) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return(rows, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", payload))
+		require.NoError(t, json.Unmarshal([]byte(<-resp), &response))
+		for _, row := range response.Rows {
+			slots = append(slots, row.SlotID)
+		}
+		return
+	}
+
+	t.Run("inserts and deletes between pages", func(t *testing.T) {
+		page, slots := list(snapshot(2, 4, 6, 8, 10), "")
+		require.Equal(t, []uint{2, 4, 6}, slots)
+		require.True(t, page.Truncated)
+
+		// Slot 1 is inserted before the cursor and slot 6, the last one returned, is deleted.
+		page, slots = list(snapshot(1, 2, 4, 7, 8, 10), fmt.Sprintf(`{"cursor":"%s"}`, page.NextCursor))
+		require.Equal(t, []uint{7, 8, 10}, slots)
+		require.False(t, page.Truncated)
+		require.Empty(t, page.NextCursor)
+	})
+
+	t.Run("sorted by version", func(t *testing.T) {
+		page, slots := list(snapshot(1, 2, 3, 4, 5), `{"sort_by":"version","limit":2}`)
+		require.Equal(t, []uint{5, 4}, slots)
+
+		page, slots = list(snapshot(1, 2, 3, 5), fmt.Sprintf(`{"sort_by":"version","limit":2,"cursor":"%s"}`, page.NextCursor))
+		require.Equal(t, []uint{3, 2}, slots)
+		require.True(t, page.Truncated)
+	})
+
+	t.Run("cursor for another order", func(t *testing.T) {
+		page, _ := list(snapshot(1, 2, 3, 4), "")
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", fmt.Sprintf(`{"descending":true,"cursor":"%s"}`, page.NextCursor)))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to list secrets: cursor was issued for a different sort order"}`, <-resp)
+	})
+
+	t.Run("malformed cursor", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"cursor":"???"}`))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to list secrets: malformed cursor"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_VerifyMessageSignature(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	tamperedMessage := func(handles *testhelpers.Handles) *api.Message {
+		msg := handles.NewMessage("secrets_list", "")
+		msg.Body.Method = "secrets_delete"
+		return msg
+	}
+
+	t.Run("strict mode rejects tampered method", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{VerifyMessageSignature: true, TombstoneRetentionSec: 60})
+		handler.HandleGatewayMessage(ctx, "gw1", tamperedMessage(handles))
+		require.Equal(t, `{"success":false,"error_code":"ENVELOPE_UNAUTHENTICATED","error_message":"Message signature doesn't match the sender"}`, handles.Connector.LastResponsePayload())
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{TombstoneRetentionSec: 60})
+		handler.HandleGatewayMessage(ctx, "gw1", tamperedMessage(handles))
+		require.Contains(t, handles.Connector.LastResponsePayload(), "Bad request to delete secret")
+	})
+}
+
+func TestFunctionsConnectorHandler_GatewaySendMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+
+	t.Run("failure and success per gateway", func(t *testing.T) {
+		flakyFailures := promtestutil.ToFloat64(functions.PromGatewaySendFailure.WithLabelValues("gw_metrics_flaky"))
+		flakySuccesses := promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_metrics_flaky"))
+		okSuccesses := promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_metrics_ok"))
+		deps.connector.On("SendToGateway", mock.Anything, "gw_metrics_flaky", mock.Anything).Return(errors.New("connection closed")).Once()
+		deps.connector.On("SendToGateway", mock.Anything, "gw_metrics_ok", mock.Anything).Return(nil).Once()
+		handler.HandleGatewayMessage(ctx, "gw_metrics_flaky", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		handler.HandleGatewayMessage(ctx, "gw_metrics_ok", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+
+		require.Equal(t, float64(1), promtestutil.ToFloat64(functions.PromGatewaySendFailure.WithLabelValues("gw_metrics_flaky"))-flakyFailures)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_metrics_flaky"))-flakySuccesses)
+		require.Equal(t, float64(1), promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_metrics_ok"))-okSuccesses)
+	})
+
+	t.Run("bounded cardinality", func(t *testing.T) {
+		deps.connector.On("SendToGateway", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		otherBefore := promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("other"))
+		unlabeledBefore := promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_metrics_35"))
+		for i := 0; i < 40; i++ {
+			handler.HandleGatewayMessage(ctx, fmt.Sprintf("gw_metrics_%d", i), newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		}
+		// Two labels were taken by the previous subtest.
+		require.Equal(t, float64(10), promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("other"))-otherBefore)
+		require.Equal(t, float64(0), promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_metrics_35"))-unlabeledBefore)
+	})
+}
+
+func TestFunctionsConnectorHandler_MetricsRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	registry1, registry2 := prometheus.NewRegistry(), prometheus.NewRegistry()
+	handler1, handles1 := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{}, functions.WithMetricsRegistry(registry1))
+	handler2, handles2 := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{}, functions.WithMetricsRegistry(registry2))
+
+	handler1.HandleGatewayMessage(ctx, "gw_registry", handles1.NewMessage("status", ""))
+	handler2.HandleGatewayMessage(ctx, "gw_registry", handles2.NewMessage("status", ""))
+	handler2.HandleGatewayMessage(ctx, "gw_registry", handles2.NewMessage("status", ""))
+
+	count := func(registry *prometheus.Registry) float64 {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "functions_connector_handler_gateway_send_success" {
+				require.Len(t, family.GetMetric(), 1)
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+	require.Equal(t, float64(1), count(registry1))
+	require.Equal(t, float64(2), count(registry2))
+	require.Equal(t, float64(0), promtestutil.ToFloat64(functions.PromGatewaySendSuccess.WithLabelValues("gw_registry")))
+
+	t.Run("handlers sharing a registry share metrics", func(t *testing.T) {
+		handler3, handles3 := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{}, functions.WithMetricsRegistry(registry1))
+		handler3.HandleGatewayMessage(ctx, "gw_registry", handles3.NewMessage("status", ""))
+		require.Equal(t, float64(2), count(registry1))
+	})
+}
+
+func TestFunctionsConnectorHandler_MaintenanceMode(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{TombstoneRetentionSec: 60})
+	maintenance, ok := handler.(interface {
+		SetMaintenanceMode(enabled bool)
+		HealthReport() map[string]error
+	})
+	require.True(t, ok)
+
+	expiration := handles.Clock.Now().Add(time.Minute).UnixMilli()
+	key := s4.Key{Address: handles.Address, SlotId: 1, Version: 1}
+	record := s4.Record{Payload: []byte("test"), Expiration: expiration}
+	setPayload := fmt.Sprintf(`{"slot_id":1,"version":1,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, expiration, base64.StdEncoding.EncodeToString(handles.SignRecord(&key, &record)))
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", setPayload))
+	require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+
+	maintenance.SetMaintenanceMode(true)
+	require.Error(t, maintenance.HealthReport()["FunctionsConnectorHandler.Maintenance"])
+
+	t.Run("writes are rejected", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", setPayload))
+		require.Equal(t, `{"success":false,"error_code":"MAINTENANCE_MODE","error_message":"Writes are disabled during maintenance"}`, handles.Connector.LastResponsePayload())
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_delete", `{"slot_id":1}`))
+		require.Equal(t, `{"success":false,"error_code":"MAINTENANCE_MODE","error_message":"Writes are disabled during maintenance"}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("reads are served", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"rows":[{"slot_id":1,"version":1`)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", `{"slot_id":1}`))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"payload":"dGVzdA=="`)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Equal(t, `{"success":true,"maintenance":true,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+	})
+
+	maintenance.SetMaintenanceMode(false)
+	require.NotContains(t, maintenance.HealthReport(), "FunctionsConnectorHandler.Maintenance")
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+	require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+}
+
+func TestFunctionsConnectorHandler_PauseSender(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	pauser, ok := handler.(interface {
+		PauseSender(address ethCommon.Address)
+		ResumeSender(address ethCommon.Address)
+	})
+	require.True(t, ok)
+	paused := `{"success":false,"error_code":"SENDER_PAUSED","error_message":"Requests from this address are paused"}`
+
+	pauser.PauseSender(handles.Address)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Equal(t, paused, handles.Connector.LastResponsePayload())
+
+	t.Run("resumed while others stay paused", func(t *testing.T) {
+		pauser.PauseSender(testutils.NewAddress())
+		pauser.ResumeSender(handles.Address)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("pausing again", func(t *testing.T) {
+		pauser.PauseSender(handles.Address)
+		pauser.PauseSender(handles.Address)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Equal(t, paused, handles.Connector.LastResponsePayload())
+		pauser.ResumeSender(handles.Address)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+	})
+}
+
+func TestFunctionsConnectorHandler_StorageRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	snapshot := []*s4.SnapshotRow{{SlotId: 1, Version: 2, Expiration: 3}}
+
+	t.Run("retryable error succeeds on second attempt", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{StorageRetryAttempts: 2}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		deps.storage.On("List", mock.Anything, deps.addr).Return(nil, errors.New("connection reset by peer")).Once()
+		deps.storage.On("List", mock.Anything, deps.addr).Return(snapshot, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":2,"expiration":3}]}`, <-resp)
+	})
+
+	t.Run("attempts are bounded", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{StorageRetryAttempts: 1}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		deps.storage.On("List", mock.Anything, deps.addr).Return(nil, errors.New("connection reset by peer")).Twice()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":false,"error_message":"Failed to list secrets: connection reset by peer"}`, <-resp)
+	})
+
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{StorageRetryAttempts: 2}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(s4.ErrWrongSignature).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"payload":"dGVzdA=="}`))
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: wrong signature"}`, <-resp)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		deps.storage.On("List", mock.Anything, deps.addr).Return(nil, errors.New("connection reset by peer")).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":false,"error_message":"Failed to list secrets: connection reset by peer"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_ListIncludePayloads(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxInlinePayloadBytes: 8}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{
+		{SlotId: 1, Version: 1, Expiration: 1, PayloadSize: 4},
+		{SlotId: 2, Version: 2, Expiration: 1, PayloadSize: 9},
+		{SlotId: 3, Version: 3, Expiration: 1, PayloadSize: 8},
+	}, nil)
+	deps.storage.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(&s4.Record{Payload: []byte("test"), Expiration: 1}, &s4.Metadata{Version: 1}, nil)
+	// Overwritten since it was listed.
+	deps.storage.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 3}).Return(&s4.Record{Payload: []byte("12345678"), Expiration: 1}, &s4.Metadata{Version: 4}, nil)
+
+	t.Run("small payloads are inlined", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"include_payloads":true}`))
+		require.Equal(t, `{"success":true,"rows":[`+
+			`{"slot_id":1,"version":1,"expiration":1,"payload":"dGVzdA=="},`+
+			`{"slot_id":2,"version":2,"expiration":1,"payload_omitted":true},`+
+			`{"slot_id":3,"version":3,"expiration":1,"payload_omitted":true}]}`, <-resp)
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.NotContains(t, <-resp, "payload")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"include_payloads":true}`))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to list secrets: payload inclusion is disabled"}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_ListModifiedSince(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	lastSync := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	snapshot := []*s4.SnapshotRow{
+		{SlotId: 1, Version: 1, Expiration: 1, UpdatedAt: lastSync.Add(-time.Hour)},
+		{SlotId: 2, Version: 1, Expiration: 1, UpdatedAt: lastSync},
+		{SlotId: 3, Version: 4, Expiration: 1, UpdatedAt: lastSync.Add(time.Second)},
+	}
+	deps.storage.On("List", mock.Anything, deps.addr).Return(snapshot, nil)
+
+	t.Run("only rows updated after the timestamp", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", fmt.Sprintf(`{"modified_since":%d}`, lastSync.UnixMilli())))
+		require.Equal(t, fmt.Sprintf(`{"success":true,"rows":[{"slot_id":3,"version":4,"expiration":1,"updated_at":%d}]}`, lastSync.Add(time.Second).UnixMilli()), <-resp)
+	})
+
+	t.Run("nothing modified", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", fmt.Sprintf(`{"modified_since":%d}`, lastSync.Add(time.Hour).UnixMilli())))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("full listing by default", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Contains(t, <-resp, `"slot_id":1`)
+	})
+}
+
+func TestFunctionsConnectorHandler_OnSecretsChanged(t *testing.T) {
+	t.Parallel()
+
+	type change struct {
+		address ethCommon.Address
+		slotId  uint
+		version uint64
+		action  string
+	}
+	ctx := testutils.Context(t)
+	changes := make(chan change, 10)
+	callback := func(_ context.Context, address ethCommon.Address, slotId uint, version uint64, action string) error {
+		changes <- change{address, slotId, version, action}
+		return errors.New("errors are only logged")
+	}
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{TombstoneRetentionSec: 3600}, functions.WithOnSecretsChanged(callback))
+	// The in-memory ORM filters snapshots by the wall clock.
+	expiration := time.Now().Add(30 * time.Minute).UnixMilli()
+	write := func(method string, version uint64, payload []byte) string {
+		key := s4.Key{Address: handles.Address, SlotId: 2, Version: version}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: payload, Expiration: expiration})
+		request := fmt.Sprintf(`{"slot_id":2,"version":%d,"expiration":%d,"payload":"%s","signature":"%s"}`,
+			version, expiration, base64.StdEncoding.EncodeToString(payload), base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage(method, request))
+		return handles.Connector.LastResponsePayload()
+	}
+
+	require.Equal(t, `{"success":true}`, write("secrets_set", 1, []byte("test")))
+	require.Equal(t, change{handles.Address, 2, 1, functions.SecretsActionSet}, <-changes)
+
+	t.Run("copy", func(t *testing.T) {
+		key := s4.Key{Address: handles.Address, SlotId: 3, Version: 1}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration})
+		request := fmt.Sprintf(`{"slot_id":2,"version":1,"dest_slot_id":3,"dest_version":1,"signature":"%s"}`, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_copy", request))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+		require.Equal(t, change{handles.Address, 3, 1, functions.SecretsActionSet}, <-changes)
+	})
+
+	t.Run("bulk touch", func(t *testing.T) {
+		key := s4.Key{Address: handles.Address, SlotId: 3, Version: 2}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration + 1000})
+		request := fmt.Sprintf(`{"slot_ids":[3],"extend_by_ms":1000,"signatures":{"3":"%s"}}`, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_bulk_touch", request))
+		require.Equal(t, `{"success":true,"updated":1}`, handles.Connector.LastResponsePayload())
+		require.Equal(t, change{handles.Address, 3, 2, functions.SecretsActionSet}, <-changes)
+	})
+
+	require.Equal(t, `{"success":true}`, write("secrets_delete", 2, []byte{}))
+	require.Equal(t, change{handles.Address, 2, 2, functions.SecretsActionDelete}, <-changes)
+
+	// Failed and read-only requests don't fire the callback.
+	require.Contains(t, write("secrets_set", 1, []byte("test")), `"success":false`)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Never(t, func() bool { return len(changes) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestFunctionsConnectorHandler_SecretsUsage(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{TombstoneRetentionSec: 3600}, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("Constraints").Return(s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5})
+	now := clock.Now()
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{
+		{SlotId: 0, Version: 1, Expiration: now.Add(time.Hour).UnixMilli(), PayloadSize: 100},
+		{SlotId: 1, Version: 1, Expiration: now.Add(48 * time.Hour).UnixMilli(), PayloadSize: 200},
+		{SlotId: 2, Version: 3, Expiration: now.Add(time.Hour).UnixMilli(), PayloadSize: 0},
+	}, nil)
+
+	t.Run("default window", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_usage", ""))
+		require.Equal(t, `{"success":true,"slots_used":3,"bytes_used":300,"max_slots":5,"max_payload_bytes":1024,"expiring_soon":1}`, <-resp)
+	})
+
+	t.Run("custom window", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_usage", `{"expiring_within_sec":259200}`))
+		require.Equal(t, `{"success":true,"slots_used":3,"bytes_used":300,"max_slots":5,"max_payload_bytes":1024,"expiring_soon":2}`, <-resp)
+	})
+}
+
+// testQuotaResolver grants custom daily quotas to the listed senders.
+type testQuotaResolver map[ethCommon.Address]uint32
+
+func (r testQuotaResolver) DailyQuota(sender ethCommon.Address) (uint32, bool) {
+	limit, ok := r[sender]
+	return limit, ok
+}
+
+func (r testQuotaResolver) SlotQuota(ethCommon.Address) (uint, bool) {
+	return 0, false
+}
+
+// testSlotQuotaResolver grants custom slot quotas to the listed senders.
+type testSlotQuotaResolver map[ethCommon.Address]uint
+
+func (r testSlotQuotaResolver) DailyQuota(ethCommon.Address) (uint32, bool) {
+	return 0, false
+}
+
+func (r testSlotQuotaResolver) SlotQuota(sender ethCommon.Address) (uint, bool) {
+	slots, ok := r[sender]
+	return slots, ok
+}
+
+func TestFunctionsConnectorHandler_SlotQuota(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	// The in-memory ORM filters snapshots by the wall clock.
+	expiration := time.Now().Add(time.Hour).UnixMilli()
+	setSlot := func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles, slotID uint) string {
+		payload := []byte("test")
+		key := s4.Key{Address: handles.Address, SlotId: slotID, Version: 1}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: payload, Expiration: expiration})
+		request := fmt.Sprintf(`{"slot_id":%d,"version":1,"expiration":%d,"payload":"%s","signature":"%s"}`,
+			slotID, expiration, base64.StdEncoding.EncodeToString(payload), base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", request))
+		return handles.Connector.LastResponsePayload()
+	}
+	handlerConfig := config.ConnectorHandlerConfig{MaxSlotsPerSender: 2, QuotaWarningThresholdPercent: 50}
+
+	t.Run("default quota", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, handlerConfig)
+		require.Equal(t, `{"success":false,"error_message":"Bad request to set secret: slot id is too big: the sender may use 2 slots"}`, setSlot(handler, handles, 3))
+		require.Equal(t, `{"success":true,"warning":"Approaching storage quota: 1 of 2 slots used"}`, setSlot(handler, handles, 1))
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_usage", ""))
+		require.Equal(t, `{"success":true,"slots_used":1,"bytes_used":4,"max_slots":2,"max_payload_bytes":1024,"expiring_soon":1}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("raised quota", func(t *testing.T) {
+		resolver := testSlotQuotaResolver{}
+		handler, handles := testhelpers.NewTestHandler(t, handlerConfig, functions.WithQuotaResolver(resolver))
+		resolver[handles.Address] = 4
+		require.Equal(t, `{"success":true}`, setSlot(handler, handles, 3))
+		require.Equal(t, `{"success":true,"warning":"Approaching storage quota: 2 of 4 slots used"}`, setSlot(handler, handles, 1))
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_usage", ""))
+		require.Equal(t, `{"success":true,"slots_used":2,"bytes_used":8,"max_slots":4,"max_payload_bytes":1024,"expiring_soon":2}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("capped by storage", func(t *testing.T) {
+		resolver := testSlotQuotaResolver{}
+		handler, handles := testhelpers.NewTestHandler(t, handlerConfig, functions.WithQuotaResolver(resolver))
+		resolver[handles.Address] = 100
+		require.Equal(t, `{"success":false,"error_message":"Bad request to set secret: slot id is too big: the sender may use 5 slots"}`, setSlot(handler, handles, 5))
+	})
+}
+
+// testRoundGate accepts writes during the first half of every round.
+type testRoundGate struct {
+	roundLength time.Duration
+}
+
+func (g testRoundGate) AcceptsWrites(now time.Time) bool {
+	return now.UnixNano()%int64(g.roundLength) < int64(g.roundLength/2)
+}
+
+func TestFunctionsConnectorHandler_RoundGate(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, clock, functions.WithRoundGate(testRoundGate{roundLength: time.Minute}))
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+	setPayload := `{"slot_id":1,"payload":"dGVzdA=="}`
+
+	t.Run("inside window", func(t *testing.T) {
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", setPayload))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	clock.Advance(45 * time.Second)
+
+	t.Run("outside window", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", setPayload))
+		require.Equal(t, `{"success":false,"error_code":"OUTSIDE_ACCEPTANCE_WINDOW","error_message":"Writes are not accepted in the current phase of the DON round"}`, <-resp)
+	})
+
+	t.Run("reads are not gated", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+}
+
+// testEnvelopeEnforcer accepts JSON objects with a ciphertext field.
+type testEnvelopeEnforcer struct{}
+
+func (testEnvelopeEnforcer) CheckPayloadFormat(payload []byte) error {
+	var envelope struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return errors.New("not a JSON envelope")
+	}
+	if len(envelope.Ciphertext) == 0 {
+		return errors.New("missing ciphertext")
+	}
+	return nil
+}
+
+func TestFunctionsConnectorHandler_PayloadFormatEnforcer(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithPayloadFormatEnforcer(testEnvelopeEnforcer{}))
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	set := func(payload string) string {
+		resp := expectResponse(deps.connector, "gw1")
+		setPayload := fmt.Sprintf(`{"slot_id":1,"payload":"%s"}`, base64.StdEncoding.EncodeToString([]byte(payload)))
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", setPayload))
+		return <-resp
+	}
+
+	t.Run("conforming", func(t *testing.T) {
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		require.Equal(t, `{"success":true}`, set(`{"ciphertext":"AQID"}`))
+	})
+
+	t.Run("non-conforming", func(t *testing.T) {
+		require.Equal(t, `{"success":false,"error_code":"PAYLOAD_FORMAT_INVALID","error_message":"Payload format is invalid: not a JSON envelope"}`, set("plaintext"))
+		require.Equal(t, `{"success":false,"error_code":"PAYLOAD_FORMAT_INVALID","error_message":"Payload format is invalid: missing ciphertext"}`, set(`{"iv":"AQID"}`))
+	})
+}
+
+func TestFunctionsConnectorHandler_EncryptedResponses(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	key := s4.Key{Address: handles.Address, SlotId: 1, Version: 1}
+	record := s4.Record{Payload: []byte("test"), Expiration: expiration}
+	require.NoError(t, handles.Storage.Put(ctx, &key, &record, handles.SignRecord(&key, &record)))
+
+	clientKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	getRequest := func(publicKey []byte) string {
+		return fmt.Sprintf(`{"slot_id":1,"encryption_public_key":"%s"}`, base64.StdEncoding.EncodeToString(publicKey))
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", getRequest(crypto.FromECDSAPub(&clientKey.PublicKey))))
+		var response struct {
+			Success          bool   `json:"success"`
+			Payload          []byte `json:"payload"`
+			PayloadEncrypted bool   `json:"payload_encrypted"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(handles.Connector.LastResponsePayload()), &response))
+		require.True(t, response.Success)
+		require.True(t, response.PayloadEncrypted)
+		require.NotEqual(t, record.Payload, response.Payload)
+
+		plaintext, err := ecies.ImportECDSA(clientKey).Decrypt(response.Payload, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, record.Payload, plaintext)
+	})
+
+	t.Run("oversized key", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", getRequest(make([]byte, 100))))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to get secret: encryption public key must be 65 bytes long, got 100"}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", getRequest(make([]byte, 65))))
+		require.Contains(t, handles.Connector.LastResponsePayload(), "Bad request to get secret: invalid encryption public key")
+	})
+
+	t.Run("plaintext by default", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", `{"slot_id":1}`))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"payload":"dGVzdA=="`)
+		require.NotContains(t, handles.Connector.LastResponsePayload(), "payload_encrypted")
+	})
+}
+
+func TestFunctionsConnectorHandler_StorageCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{StorageCircuitBreakerThreshold: 2, StorageCircuitBreakerCooldownSec: 60}, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	health, ok := handler.(interface{ HealthReport() map[string]error })
+	require.True(t, ok)
+	list := func() string {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		return <-resp
+	}
+	unavailable := `{"success":false,"error_code":"STORAGE_UNAVAILABLE","error_message":"Storage is temporarily unavailable"}`
+
+	t.Run("opens after threshold", func(t *testing.T) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return(nil, errors.New("connection refused")).Twice()
+		require.Equal(t, `{"success":false,"error_message":"Failed to list secrets: connection refused"}`, list())
+		require.NotContains(t, health.HealthReport(), "FunctionsConnectorHandler.StorageCircuitBreaker")
+		require.Equal(t, `{"success":false,"error_message":"Failed to list secrets: connection refused"}`, list())
+		require.Error(t, health.HealthReport()["FunctionsConnectorHandler.StorageCircuitBreaker"])
+	})
+
+	t.Run("short-circuits during cooldown", func(t *testing.T) {
+		clock.Advance(30 * time.Second)
+		require.Equal(t, unavailable, list())
+	})
+
+	t.Run("failed probe re-opens", func(t *testing.T) {
+		clock.Advance(30 * time.Second)
+		deps.storage.On("List", mock.Anything, deps.addr).Return(nil, errors.New("connection refused")).Once()
+		require.Equal(t, `{"success":false,"error_message":"Failed to list secrets: connection refused"}`, list())
+		require.Equal(t, unavailable, list())
+	})
+
+	t.Run("closes on recovery", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Twice()
+		require.Equal(t, `{"success":true}`, list())
+		require.NotContains(t, health.HealthReport(), "FunctionsConnectorHandler.StorageCircuitBreaker")
+		require.Equal(t, `{"success":true}`, list())
+	})
+}
+
+func TestFunctionsConnectorHandler_SigAlg(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{IncludeSigAlg: true, MaxRequestTagLength: 8})
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", `{"request_tag":"abc"}`))
+	response := handles.Connector.Responses()[0]
+	require.Equal(t, `{"success":true,"request_tag":"abc","sig_alg":"`+functions.SigAlgEcdsaSecp256k1+`"}`, string(response.Body.Payload))
+
+	// The advertised algorithm verifies the response against the node address.
+	signer, err := response.ExtractSigner()
+	require.NoError(t, err)
+	require.Equal(t, handles.Address, ethCommon.BytesToAddress(signer))
+}
+
+func TestFunctionsConnectorHandler_ResponseCompression(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	snapshot := make([]*s4.SnapshotRow, 50)
+	for i := range snapshot {
+		snapshot[i] = &s4.SnapshotRow{SlotId: uint(i), Version: 1, Expiration: 1}
+	}
+	deps.storage.On("List", mock.Anything, deps.addr).Return(snapshot, nil).Times(2)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+	list := func(payload string) string {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", payload))
+		return <-resp
+	}
+
+	uncompressed := list("")
+	require.True(t, strings.HasPrefix(uncompressed, `{"success":true,"rows":[`))
+
+	t.Run("compressed round trip", func(t *testing.T) {
+		var response struct {
+			Compression string `json:"compression"`
+			Payload     []byte `json:"payload"`
+		}
+		compressed := list(`{"accept_compression":"gzip"}`)
+		require.NoError(t, json.Unmarshal([]byte(compressed), &response))
+		require.Equal(t, functions.CompressionGzip, response.Compression)
+		require.Less(t, len(compressed), len(uncompressed))
+
+		reader, err := gzip.NewReader(bytes.NewReader(response.Payload))
+		require.NoError(t, err)
+		decompressed, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, uncompressed, string(decompressed))
+	})
+
+	t.Run("small payloads are not compressed", func(t *testing.T) {
+		require.Equal(t, `{"success":true}`, list(`{"accept_compression":"gzip"}`))
+	})
+
+	t.Run("unsupported compression is ignored", func(t *testing.T) {
+		require.Equal(t, `{"success":true}`, list(`{"accept_compression":"brotli"}`))
+	})
+}
+
+func TestFunctionsConnectorHandler_SelfTest(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	operatorKey, operatorAddr := testutils.NewPrivateKeyAndAddress(t)
+	handlerConfig := config.ConnectorHandlerConfig{OperatorAddresses: []string{operatorAddr.Hex()}}
+
+	t.Run("happy path", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", operatorAddr).Return(false)
+		storage := s4.NewStorage(logger.TestLogger(t), s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5}, s4.NewInMemoryORM(), utils.NewRealClock())
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(func(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+			require.Equal(t, deps.addr, key.Address)
+			return storage.Put(ctx, key, record, signature)
+		}).Twice()
+		deps.storage.On("Get", mock.Anything, mock.Anything).Return(func(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metadata, error) {
+			return storage.Get(ctx, key)
+		}).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, operatorKey, "self_test", ""))
+		require.Equal(t, `{"success":true,"steps":[{"name":"sign","success":true},{"name":"store","success":true},{"name":"read","success":true},{"name":"delete","success":true}]}`, <-resp)
+
+		// The test record was overwritten with an empty payload.
+		record, _, err := storage.Get(ctx, &s4.Key{Address: deps.addr})
+		require.NoError(t, err)
+		require.Empty(t, record.Payload)
+	})
+
+	t.Run("storage failure mid-test still cleans up", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", operatorAddr).Return(false)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Twice()
+		deps.storage.On("Get", mock.Anything, mock.Anything).Return(nil, nil, errors.New("connection refused")).Once()
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, operatorKey, "self_test", ""))
+		require.Equal(t, `{"success":false,"steps":[{"name":"sign","success":true},{"name":"store","success":true},{"name":"read","success":false,"error_message":"connection refused"},{"name":"delete","success":true}]}`, <-resp)
+	})
+
+	t.Run("operators only", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "self_test", ""))
+		deps.connector.AssertNotCalled(t, "SendToGateway", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestFunctionsConnectorHandler_UnsignedResponses(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{UnsignedResponseMethods: []string{"status"}})
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	responses := handles.Connector.Responses()
+	require.Len(t, responses, 2)
+	require.Empty(t, responses[0].Signature)
+	require.NoError(t, responses[0].ValidateUnsigned())
+	require.NoError(t, responses[1].Validate())
+	require.Equal(t, handles.Address.Hex(), ethCommon.HexToAddress(responses[1].Body.Sender).Hex())
+
+	t.Run("sensitive methods can't be unsigned", func(t *testing.T) {
+		privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+		_, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, nil, nil, config.ConnectorHandlerConfig{UnsignedResponseMethods: []string{"secrets_get"}}, utils.NewRealClock(), logger.TestLogger(t))
+		require.EqualError(t, err, "responses to secrets_get must be signed")
+	})
+}
+
+func TestFunctionsConnectorHandler_CanonicalResponses(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{CanonicalResponses: true, MaxRequestTagLength: 8})
+	expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	key := s4.Key{Address: handles.Address, SlotId: 1, Version: math.MaxUint64 - 1}
+	record := s4.Record{Payload: []byte("test"), Expiration: expiration}
+	require.NoError(t, handles.Storage.Put(ctx, &key, &record, handles.SignRecord(&key, &record)))
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", `{"request_tag":"abc"}`))
+	payload := handles.Connector.LastResponsePayload()
+	require.True(t, strings.HasPrefix(payload, `{"request_tag":"abc","rows":[{"created_at":`))
+	require.Contains(t, payload, fmt.Sprintf(`"version":%d}],"success":true}`, uint64(math.MaxUint64-1)))
+
+	// Decoding and re-encoding the payload yields identical bytes.
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	var decoded map[string]any
+	require.NoError(t, decoder.Decode(&decoded))
+	reencoded, err := json.Marshal(decoded)
+	require.NoError(t, err)
+	require.Equal(t, payload, string(reencoded))
+}
+
+func TestFunctionsConnectorHandler_QuotaWarning(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{QuotaWarningThresholdPercent: 80}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	// Constraints allow 5 slots of up to 1024 bytes.
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	set := func(snapshot ...*s4.SnapshotRow) string {
+		deps.storage.On("List", mock.Anything, deps.addr).Return(snapshot, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"payload":"dGVzdA=="}`))
+		return <-resp
+	}
+
+	t.Run("below soft threshold", func(t *testing.T) {
+		require.Equal(t, `{"success":true}`, set(&s4.SnapshotRow{SlotId: 0, PayloadSize: 1000}, &s4.SnapshotRow{SlotId: 1, PayloadSize: 1000}, &s4.SnapshotRow{SlotId: 2, PayloadSize: 1000}))
+	})
+
+	t.Run("slots above soft threshold", func(t *testing.T) {
+		require.Equal(t, `{"success":true,"warning":"Approaching storage quota: 4 of 5 slots used"}`, set(&s4.SnapshotRow{SlotId: 0, PayloadSize: 10}, &s4.SnapshotRow{SlotId: 1, PayloadSize: 10}, &s4.SnapshotRow{SlotId: 2, PayloadSize: 10}, &s4.SnapshotRow{SlotId: 3, PayloadSize: 10}))
+	})
+
+	t.Run("bytes above soft threshold", func(t *testing.T) {
+		require.Equal(t, `{"success":true,"warning":"Approaching storage quota: 5 of 5 slots used, 4500 of 5120 bytes used"}`, set(&s4.SnapshotRow{SlotId: 0, PayloadSize: 900}, &s4.SnapshotRow{SlotId: 1, PayloadSize: 900}, &s4.SnapshotRow{SlotId: 2, PayloadSize: 900}, &s4.SnapshotRow{SlotId: 3, PayloadSize: 900}, &s4.SnapshotRow{SlotId: 4, PayloadSize: 900}))
+	})
+}
+
+func TestFunctionsConnectorHandler_EmptyPayloads(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	set := func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles, signer *ecdsa.PrivateKey) string {
+		expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: 1}
+		signature, err := s4.NewEnvelopeFromRecord(&key, &s4.Record{Payload: []byte{}, Expiration: expiration}).Sign(signer)
+		require.NoError(t, err)
+		payload := fmt.Sprintf(`{"slot_id":1,"version":1,"expiration":%d,"payload":"","signature":"%s"}`, expiration, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+		return handles.Connector.LastResponsePayload()
+	}
+
+	t.Run("rejected by default", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+		require.Equal(t, `{"success":false,"error_code":"EMPTY_PAYLOAD","error_message":"Payload must not be empty"}`, set(handler, handles, handles.PrivateKey))
+	})
+
+	t.Run("accepted when allowed", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{AllowEmptyPayloads: true})
+		require.Equal(t, `{"success":true}`, set(handler, handles, handles.PrivateKey))
+		record, _, err := handles.Storage.Get(ctx, &s4.Key{Address: handles.Address, SlotId: 1})
+		require.NoError(t, err)
+		require.Empty(t, record.Payload)
+	})
+
+	t.Run("signature is still verified", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{AllowEmptyPayloads: true})
+		otherKey, _ := testutils.NewPrivateKeyAndAddress(t)
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: wrong signature"}`, set(handler, handles, otherKey))
+	})
+}
+
+func TestFunctionsConnectorHandler_Config(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	operatorKey, operatorAddr := testutils.NewPrivateKeyAndAddress(t)
+	handlerConfig := config.ConnectorHandlerConfig{
+		OperatorAddresses:         []string{operatorAddr.Hex()},
+		MaxDailyRequestsPerSender: 100,
+		MaxListRows:               10,
+		TombstoneRetentionSec:     60,
+	}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", operatorAddr).Return(false)
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	t.Run("effective config", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, operatorKey, "config", ""))
+		payload := <-resp
+		var response struct {
+			Success        bool                          `json:"success"`
+			NodeAddress    string                        `json:"node_address"`
+			Config         config.ConnectorHandlerConfig `json:"config"`
+			Constraints    s4.Constraints                `json:"constraints"`
+			EnabledMethods []string                      `json:"enabled_methods"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(payload), &response))
+		require.True(t, response.Success)
+		require.Equal(t, deps.addr.Hex(), response.NodeAddress)
+		require.Equal(t, handlerConfig, response.Config)
+		require.Equal(t, s4.Constraints{MaxPayloadSizeBytes: 1024, MaxSlotsPerUser: 5}, response.Constraints)
+		require.Equal(t, []string{"config", "public_key", "secrets_bulk_touch", "secrets_copy", "secrets_delete", "secrets_flush", "secrets_get", "secrets_list", "secrets_list_multi", "secrets_manifest", "secrets_set", "secrets_swap", "secrets_usage", "secrets_verify_signature", "self_test", "status"}, response.EnabledMethods)
+
+		privateKeyHex := hex.EncodeToString(crypto.FromECDSA(deps.privateKey))
+		require.NotContains(t, strings.ToLower(payload), privateKeyHex)
+		require.NotContains(t, strings.ToLower(payload), "private")
+	})
+
+	t.Run("operators only", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "config", ""))
+		deps.connector.AssertNumberOfCalls(t, "SendToGateway", 1)
+	})
+}
+
+func TestFunctionsConnectorHandler_ResponseCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60})
+	put := func(slotId uint) {
+		key := s4.Key{Address: handles.Address, SlotId: slotId, Version: 1}
+		record := s4.Record{Payload: []byte("test"), Expiration: handles.Clock.Now().Add(time.Hour).UnixMilli()}
+		require.NoError(t, handles.Storage.Put(ctx, &key, &record, handles.SignRecord(&key, &record)))
+	}
+
+	put(1)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	first := handles.Connector.LastResponsePayload()
+	require.Contains(t, first, `"slot_id":1`)
+
+	t.Run("TTL is required", func(t *testing.T) {
+		_, err := functions.NewFunctionsConnectorHandler(handles.Address.Hex(), handles.PrivateKey, handles.Storage, handles.Allowlist, config.ConnectorHandlerConfig{ResponseCacheSize: 10}, handles.Clock, logger.TestLogger(t))
+		require.EqualError(t, err, "responseCacheTTLSec must be set when responseCacheSize is")
+	})
+
+	t.Run("retry is served from cache", func(t *testing.T) {
+		put(2)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Equal(t, first, handles.Connector.LastResponsePayload())
+		responses := handles.Connector.Responses()
+		require.Equal(t, responses[0].Signature, responses[len(responses)-1].Signature)
+	})
+
+	t.Run("reused message ID is rejected", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", `{"modified_since":1}`))
+		require.Equal(t, `{"success":false,"error_code":"MESSAGE_ID_REUSE","error_message":"Message ID was already used for a different request"}`, handles.Connector.LastResponsePayload())
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Equal(t, first, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("processed again after expiry", func(t *testing.T) {
+		handles.Clock.Advance(time.Minute)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"slot_id":2`)
+	})
+}
+
+func TestFunctionsConnectorHandler_ResponseCacheTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	const okResponse = `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`
+
+	t.Run("retry after retry_after", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60, SenderRateLimitRPS: 1})
+		statusWithId := func(messageId string) *api.Message {
+			msg := handles.NewMessage("status", "")
+			msg.Body.MessageId = messageId
+			require.NoError(t, msg.Sign(handles.PrivateKey))
+			return msg
+		}
+		handler.HandleGatewayMessage(ctx, "gw1", statusWithId("1"))
+		require.Equal(t, okResponse, handles.Connector.LastResponsePayload())
+
+		handler.HandleGatewayMessage(ctx, "gw1", statusWithId("2"))
+		require.Equal(t, `{"success":false,"error_code":"RATE_LIMITED","error_message":"Too many requests, retry later","retry_after_sec":1}`, handles.Connector.LastResponsePayload())
+
+		handles.Clock.Advance(time.Second)
+		handler.HandleGatewayMessage(ctx, "gw1", statusWithId("2"))
+		require.Equal(t, okResponse, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("retry after maintenance", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60})
+		maintenance, ok := handler.(interface{ SetMaintenanceMode(enabled bool) })
+		require.True(t, ok)
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: 1}
+		record := s4.Record{Payload: []byte("test"), Expiration: handles.Clock.Now().Add(time.Hour).UnixMilli()}
+		setPayload := fmt.Sprintf(`{"slot_id":1,"version":1,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, record.Expiration, base64.StdEncoding.EncodeToString(handles.SignRecord(&key, &record)))
+
+		maintenance.SetMaintenanceMode(true)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", setPayload))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"MAINTENANCE_MODE"`)
+
+		maintenance.SetMaintenanceMode(false)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", setPayload))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("retry after daily quota reset", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60, MaxDailyRequestsPerSender: 1})
+		// Start shortly before the quota resets, so that the retry comes before cache entries expire.
+		now := handles.Clock.Now()
+		handles.Clock.Advance(now.UTC().Truncate(24*time.Hour).Add(24*time.Hour).Sub(now) - 30*time.Second)
+		first := handles.NewMessage("secrets_list", "")
+		first.Body.MessageId = "0"
+		require.NoError(t, first.Sign(handles.PrivateKey))
+		handler.HandleGatewayMessage(ctx, "gw1", first)
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"DAILY_QUOTA_EXCEEDED"`)
+
+		handles.Clock.Advance(time.Minute / 2)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		require.Equal(t, okResponse, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("retry after storage failure", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Return(nil, errors.New("connection reset")).Once()
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Once()
+		msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":false,"error_message":"Failed to list secrets: connection reset"}`, <-resp)
+
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_ResponseCacheUnauthenticated(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60, VerifyMessageSignature: true})
+
+	// A forged message claiming the sender's address and MessageId must not poison the cache.
+	forgerKey, _ := testutils.NewPrivateKeyAndAddress(t)
+	forged := handles.NewMessage("status", "")
+	require.NoError(t, forged.Sign(forgerKey))
+	handler.HandleGatewayMessage(ctx, "gw1", forged)
+	require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"ENVELOPE_UNAUTHENTICATED"`)
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+	require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+}
+
+func TestFunctionsConnectorHandler_IdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	newMessage := func(messageId string, payload string) (*api.Message, <-chan *api.Message) {
+		msg := newTestMessage(t, deps.privateKey, "secrets_set", payload)
+		msg.Body.MessageId = messageId
+		require.NoError(t, msg.Sign(deps.privateKey))
+		responses := make(chan *api.Message, 1)
+		deps.connector.On("SendToGateway", mock.Anything, "gw1", mock.MatchedBy(func(response *api.Message) bool {
+			return response.Body.MessageId == messageId
+		})).Run(func(args mock.Arguments) {
+			responses <- args[2].(*api.Message)
+		}).Return(nil).Once()
+		return msg, responses
+	}
+	send := func(messageId string, payload string) *api.Message {
+		msg, responses := newMessage(messageId, payload)
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		return <-responses
+	}
+	setPayload := `{"slot_id":1,"version":1,"payload":"dGVzdA==","idempotency_key":"rotate-1"}`
+
+	t.Run("retries with another message ID write once", func(t *testing.T) {
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		first := send("1", setPayload)
+		require.Equal(t, `{"success":true}`, string(first.Body.Payload))
+
+		retry := send("2", setPayload)
+		require.Equal(t, "2", retry.Body.MessageId)
+		require.Equal(t, first.Body.Payload, retry.Body.Payload)
+		signer, err := retry.ExtractSigner()
+		require.NoError(t, err)
+		require.Equal(t, crypto.PubkeyToAddress(deps.privateKey.PublicKey), ethCommon.BytesToAddress(signer))
+		deps.storage.AssertNumberOfCalls(t, "Put", 1)
+	})
+
+	t.Run("reused key is rejected", func(t *testing.T) {
+		response := send("3", `{"slot_id":2,"version":1,"payload":"dGVzdA==","idempotency_key":"rotate-1"}`)
+		require.Equal(t, `{"success":false,"error_code":"IDEMPOTENCY_KEY_REUSE","error_message":"Idempotency key was already used for a different request"}`, string(response.Body.Payload))
+	})
+
+	t.Run("concurrent retry", func(t *testing.T) {
+		putStarted, releasePut := make(chan struct{}), make(chan struct{})
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			close(putStarted)
+			<-releasePut
+		}).Return(nil).Once()
+		payload := `{"slot_id":1,"version":2,"payload":"dGVzdA==","idempotency_key":"rotate-2"}`
+		first, firstResp := newMessage("4", payload)
+		go handler.HandleGatewayMessage(ctx, "gw1", first)
+		<-putStarted
+
+		retry := send("5", payload)
+		require.Equal(t, `{"success":false,"error_code":"REQUEST_IN_PROGRESS","error_message":"A request with this idempotency key is in progress, retry later","retry_after_sec":1}`, string(retry.Body.Payload))
+		close(releasePut)
+		require.Equal(t, `{"success":true}`, string((<-firstResp).Body.Payload))
+
+		// The in-progress response isn't cached, so later retries get the stored result.
+		retry = send("6", payload)
+		require.Equal(t, `{"success":true}`, string(retry.Body.Payload))
+		deps.storage.AssertNumberOfCalls(t, "Put", 2)
+	})
+}
+
+func TestFunctionsConnectorHandler_SecretsFlush(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, &testClock{now: time.Now()})
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	putStarted, releasePut := make(chan struct{}), make(chan struct{})
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		close(putStarted)
+		<-releasePut
+	}).Return(nil).Once()
+	setResp := expectResponse(deps.connector, "gw1")
+	go handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":1,"payload":"dGVzdA=="}`))
+	<-putStarted
+
+	flushResp := expectResponse(deps.connector, "gw2")
+	flushed := make(chan struct{})
+	go func() {
+		handler.HandleGatewayMessage(ctx, "gw2", newTestMessage(t, deps.privateKey, "secrets_flush", ""))
+		close(flushed)
+	}()
+	require.Never(t, func() bool {
+		select {
+		case <-flushed:
+			return true
+		default:
+			return false
+		}
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	close(releasePut)
+	require.Equal(t, `{"success":true}`, <-setResp)
+	require.Equal(t, `{"success":true}`, <-flushResp)
+
+	deps.storage.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(&s4.Record{Payload: []byte("test"), Expiration: time.Now().Add(time.Hour).UnixMilli()}, &s4.Metadata{Version: 1}, nil)
+	getResp := expectResponse(deps.connector, "gw1")
+	handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_get", `{"slot_id":1}`))
+	require.Contains(t, <-getResp, `"payload":"dGVzdA=="`)
+
+	t.Run("returns immediately without writes in flight", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_flush", ""))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("doesn't wait for writes of other senders", func(t *testing.T) {
+		otherKey, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		deps.allowlist.On("Allow", crypto.PubkeyToAddress(otherKey.PublicKey)).Return(true)
+
+		putStarted, releasePut := make(chan struct{}), make(chan struct{})
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			close(putStarted)
+			<-releasePut
+		}).Return(nil).Once()
+		setResp := expectResponse(deps.connector, "gw1")
+		go handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":2,"payload":"dGVzdA=="}`))
+		<-putStarted
+
+		flushResp := expectResponse(deps.connector, "gw2")
+		handler.HandleGatewayMessage(ctx, "gw2", newTestMessage(t, otherKey, "secrets_flush", ""))
+		require.Equal(t, `{"success":true}`, <-flushResp)
+
+		close(releasePut)
+		require.Equal(t, `{"success":true}`, <-setResp)
+	})
+}
+
+func TestFunctionsConnectorHandler_StartupGrace(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Now()}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{StartupGraceSec: 30}, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(false)
+	msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+
+	t.Run("before the allowlist is loaded", func(t *testing.T) {
+		deps.allowlist.On("LastUpdated").Return(time.Time{}).Times(2)
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":false,"error_code":"STARTING_UP","error_message":"Node is starting up, retry later","retry_after_sec":30}`, <-resp)
+
+		clock.Advance(10*time.Second + time.Millisecond)
+		resp = expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Contains(t, <-resp, `"retry_after_sec":20}`)
+	})
+
+	t.Run("after the allowlist is loaded", func(t *testing.T) {
+		deps.allowlist.On("LastUpdated").Return(clock.Now()).Once()
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		deps.connector.AssertNumberOfCalls(t, "SendToGateway", 2)
+	})
+
+	t.Run("after the grace period", func(t *testing.T) {
+		deps.allowlist.On("LastUpdated").Return(time.Time{}).Once()
+		clock.Advance(20 * time.Second)
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		deps.connector.AssertNumberOfCalls(t, "SendToGateway", 2)
+	})
+}
+
+func TestFunctionsConnectorHandler_SenderResolver(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	ownerKey, ownerAddr := testutils.NewPrivateKeyAndAddress(t)
+	resolver := testSenderResolver{}
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{}, functions.WithSenderResolver(resolver))
+	resolver[handles.Address] = ownerAddr
+	handles.Allowlist.Remove(handles.Address)
+	handles.Allowlist.Add(ownerAddr)
+
+	t.Run("alias writes and reads the owner's secrets", func(t *testing.T) {
+		expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+		key := s4.Key{Address: ownerAddr, SlotId: 1, Version: 1}
+		signature, err := s4.NewEnvelopeFromRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration}).Sign(ownerKey)
+		require.NoError(t, err)
+		payload := fmt.Sprintf(`{"slot_id":1,"version":1,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, expiration, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+
+		record, _, err := handles.Storage.Get(ctx, &s4.Key{Address: ownerAddr, SlotId: 1})
+		require.NoError(t, err)
+		require.Equal(t, []byte("test"), record.Payload)
+
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", `{"slot_id":1}`))
+		require.Contains(t, handles.Connector.LastResponsePayload(), `"payload":"dGVzdA=="`)
+	})
+
+	t.Run("unresolved sender gets no response", func(t *testing.T) {
+		delete(resolver, handles.Address)
+		sent := len(handles.Connector.Responses())
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Len(t, handles.Connector.Responses(), sent)
+	})
+}
+
+func TestFunctionsConnectorHandler_IdempotencyKeySender(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	ownerKey, ownerAddr := testutils.NewPrivateKeyAndAddress(t)
+	resolver := testSenderResolver{ownerAddr: ownerAddr}
+	handlerConfig := config.ConnectorHandlerConfig{ResponseCacheSize: 10, ResponseCacheTTLSec: 60, VerifyMessageSignature: true}
+	handler, handles := testhelpers.NewTestHandler(t, handlerConfig, functions.WithSenderResolver(resolver))
+	resolver[handles.Address] = ownerAddr
+	handles.Allowlist.Add(ownerAddr)
+	const payload = `{"idempotency_key":"list-1"}`
+	newMessage := func(key *ecdsa.PrivateKey, sender ethCommon.Address, messageId string) *api.Message {
+		msg := handles.NewMessage("secrets_list", payload)
+		msg.Body.Sender = sender.Hex()
+		msg.Body.MessageId = messageId
+		require.NoError(t, msg.Sign(key))
+		return msg
+	}
+
+	// A forged request claiming the alias doesn't take the idempotency key.
+	forgerKey, _ := testutils.NewPrivateKeyAndAddress(t)
+	handler.HandleGatewayMessage(ctx, "gw1", newMessage(forgerKey, handles.Address, "1"))
+	require.Contains(t, handles.Connector.LastResponsePayload(), `"error_code":"ENVELOPE_UNAUTHENTICATED"`)
+
+	handler.HandleGatewayMessage(ctx, "gw1", newMessage(handles.PrivateKey, handles.Address, "2"))
+	require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+
+	// The key belongs to the resolved owner, so the owner's retry is served from cache despite the new record.
+	key := s4.Key{Address: ownerAddr, SlotId: 1, Version: 1}
+	record := s4.Record{Payload: []byte("test"), Expiration: handles.Clock.Now().Add(time.Hour).UnixMilli()}
+	signature, err := s4.NewEnvelopeFromRecord(&key, &record).Sign(ownerKey)
+	require.NoError(t, err)
+	require.NoError(t, handles.Storage.Put(ctx, &key, &record, signature))
+	handler.HandleGatewayMessage(ctx, "gw1", newMessage(ownerKey, ownerAddr, "3"))
+	require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+}
+
+// testSenderResolver maps aliases to owner addresses. Unknown senders can't be resolved.
+type testSenderResolver map[ethCommon.Address]ethCommon.Address
+
+func (r testSenderResolver) ResolveSender(_ context.Context, sender ethCommon.Address) (ethCommon.Address, error) {
+	owner, ok := r[sender]
+	if !ok {
+		return ethCommon.Address{}, fmt.Errorf("unknown sender %s", sender)
+	}
+	return owner, nil
+}
+
+func TestFunctionsConnectorHandler_Ack(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+
+	t.Run("ack precedes the response", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", `{"ack":true}`))
+		responses := handles.Connector.Responses()
+		require.Len(t, responses, 2)
+		require.Equal(t, `{"ack":true}`, string(responses[0].Body.Payload))
+		require.Equal(t, `{"success":true}`, string(responses[1].Body.Payload))
+		require.Equal(t, responses[1].Body.MessageId, responses[0].Body.MessageId)
+		signer, err := responses[0].ExtractSigner()
+		require.NoError(t, err)
+		require.Equal(t, handles.Address.Bytes(), signer)
+	})
+
+	t.Run("no ack unless requested", func(t *testing.T) {
+		sent := len(handles.Connector.Responses())
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+		require.Len(t, handles.Connector.Responses(), sent+1)
+	})
+
+	t.Run("no ack for rejected requests", func(t *testing.T) {
+		sent := len(handles.Connector.Responses())
+		handles.Allowlist.Remove(handles.Address)
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", `{"ack":true}`))
+		require.Len(t, handles.Connector.Responses(), sent)
+	})
+}
+
+func TestFunctionsConnectorHandler_BadBase64(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	send := func(method string, payload string) string {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage(method, payload))
+		return handles.Connector.LastResponsePayload()
+	}
+
+	require.Equal(t, `{"success":false,"error_code":"BAD_BASE64","error_message":"Field payload is not valid base64"}`,
+		send("secrets_set", `{"slot_id":1,"version":1,"payload":"not base64!","signature":"dGVzdA=="}`))
+	require.Equal(t, `{"success":false,"error_code":"BAD_BASE64","error_message":"Field signature is not valid base64"}`,
+		send("secrets_set", `{"slot_id":1,"version":1,"payload":"dGVzdA==","signature":"dGVzdA"}`))
+	require.Equal(t, `{"success":false,"error_code":"BAD_BASE64","error_message":"Field encryption_public_key is not valid base64"}`,
+		send("secrets_get", `{"slot_id":1,"encryption_public_key":"???"}`))
+	require.Equal(t, `{"success":false,"error_code":"BAD_BASE64","error_message":"Field signatures[2] is not valid base64"}`,
+		send("secrets_bulk_touch", `{"slot_ids":[1,2],"extend_by_ms":1000,"signatures":{"1":"dGVzdA==","2":"dGVzdA"}}`))
+
+	// Other decoding errors are reported as before.
+	require.Contains(t, send("secrets_set", `{"slot_id":"one","payload":"dGVzdA=="}`), `"error_message":"Bad request to set secret: `)
+}
+
+func TestFunctionsConnectorHandler_SecretsManifest(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	for _, slotId := range []uint{2, 0} {
+		key := s4.Key{Address: handles.Address, SlotId: slotId, Version: uint64(slotId + 1)}
+		record := s4.Record{Payload: []byte("secret"), Expiration: expiration}
+		require.NoError(t, handles.Storage.Put(ctx, &key, &record, handles.SignRecord(&key, &record)))
+	}
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_manifest", ""))
+	payload := handles.Connector.LastResponsePayload()
+	require.NotContains(t, payload, base64.StdEncoding.EncodeToString([]byte("secret")))
+	var response struct {
+		Success           bool               `json:"success"`
+		Manifest          functions.Manifest `json:"manifest"`
+		ManifestSignature []byte             `json:"manifest_signature"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(payload), &response))
+	require.True(t, response.Success)
+
+	manifest := response.Manifest
+	require.Equal(t, handles.Address, manifest.Address)
+	require.Equal(t, handles.Clock.Now().UnixMilli(), manifest.GeneratedAt)
+	require.Len(t, manifest.Records, 2)
+	for i, slotId := range []uint{0, 2} {
+		_, metadata, err := handles.Storage.Get(ctx, &s4.Key{Address: handles.Address, SlotId: slotId})
+		require.NoError(t, err)
+		require.Equal(t, functions.ManifestRecord{
+			SlotID:      slotId,
+			Version:     metadata.Version,
+			Expiration:  expiration,
+			PayloadSize: uint64(len("secret")),
+			UpdatedAt:   metadata.UpdatedAt.UnixMilli(),
+		}, manifest.Records[i])
+	}
+
+	signer, err := manifest.GetSignerAddress(response.ManifestSignature)
+	require.NoError(t, err)
+	require.Equal(t, handles.Address, signer)
+}
+
+func TestFunctionsConnectorHandler_MaxExpiration(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{MaxExpirationSec: 3600})
+	horizon := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	set := func(version uint64, expiration int64) string {
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: version}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration})
+		payload := fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, version, expiration, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+		return handles.Connector.LastResponsePayload()
+	}
+	rejection := fmt.Sprintf(`{"success":false,"error_code":"EXPIRATION_EXCEEDS_RETENTION","error_message":"Expiration must not be later than %d (unix ms)"}`, horizon)
+
+	require.Equal(t, rejection, set(1, horizon+1))
+	require.Equal(t, `{"success":true}`, set(1, horizon))
+
+	t.Run("bulk touch", func(t *testing.T) {
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: 2}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: horizon + 1})
+		payload := fmt.Sprintf(`{"slot_ids":[1],"extend_by_ms":1,"signatures":{"1":"%s"}}`, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_bulk_touch", payload))
+		require.Equal(t, rejection, handles.Connector.LastResponsePayload())
+	})
+}
+
+func TestFunctionsConnectorHandler_MaxVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{MaxVersion: 100})
+	expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	set := func(slotId uint, version uint64) string {
+		key := s4.Key{Address: handles.Address, SlotId: slotId, Version: version}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration})
+		payload := fmt.Sprintf(`{"slot_id":%d,"version":%d,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, slotId, version, expiration, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+		return handles.Connector.LastResponsePayload()
+	}
+	rejection := `{"success":false,"error_code":"VERSION_OUT_OF_RANGE","error_message":"Version must not be greater than 100"}`
+
+	require.Equal(t, rejection, set(1, 101))
+	require.Equal(t, rejection, set(1, math.MaxUint64))
+	require.Equal(t, `{"success":true}`, set(1, 100))
+
+	t.Run("copy", func(t *testing.T) {
+		key := s4.Key{Address: handles.Address, SlotId: 2, Version: 101}
+		signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration})
+		payload := fmt.Sprintf(`{"slot_id":1,"version":100,"dest_slot_id":2,"dest_version":101,"signature":"%s"}`, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_copy", payload))
+		require.Equal(t, rejection, handles.Connector.LastResponsePayload())
+	})
+}
+
+func TestFunctionsConnectorHandler_ExpirationRegression(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	newSetter := func(t *testing.T, handlerConfig config.ConnectorHandlerConfig) (func(version uint64, expiration time.Duration) string, *testhelpers.Handles) {
+		handler, handles := testhelpers.NewTestHandler(t, handlerConfig)
+		return func(version uint64, expiration time.Duration) string {
+			expirationMs := handles.Clock.Now().Add(expiration).UnixMilli()
+			key := s4.Key{Address: handles.Address, SlotId: 1, Version: version}
+			signature := handles.SignRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expirationMs})
+			payload := fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, version, expirationMs, base64.StdEncoding.EncodeToString(signature))
+			handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+			return handles.Connector.LastResponsePayload()
+		}, handles
+	}
+
+	t.Run("shortening is rejected", func(t *testing.T) {
+		set, handles := newSetter(t, config.ConnectorHandlerConfig{RejectExpirationRegression: true})
+		require.Equal(t, `{"success":true}`, set(1, 2*time.Hour))
+		current := handles.Clock.Now().Add(2 * time.Hour).UnixMilli()
+		require.Equal(t, fmt.Sprintf(`{"success":false,"error_code":"EXPIRATION_REGRESSION","error_message":"Expiration must not be earlier than the current expiration %d (unix ms)"}`, current), set(2, time.Hour))
+		require.Equal(t, `{"success":true}`, set(2, 3*time.Hour))
+	})
+
+	t.Run("expired secrets may be replaced", func(t *testing.T) {
+		set, handles := newSetter(t, config.ConnectorHandlerConfig{RejectExpirationRegression: true})
+		require.Equal(t, `{"success":true}`, set(1, 2*time.Hour))
+		handles.Clock.Advance(3 * time.Hour)
+		require.Equal(t, `{"success":true}`, set(2, time.Hour))
+	})
+
+	t.Run("opt-in", func(t *testing.T) {
+		set, _ := newSetter(t, config.ConnectorHandlerConfig{})
+		require.Equal(t, `{"success":true}`, set(1, 2*time.Hour))
+		require.Equal(t, `{"success":true}`, set(2, time.Hour))
+	})
+}
+
+func TestFunctionsConnectorHandler_SerializeSlotWrites(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handlerConfig := config.ConnectorHandlerConfig{SerializeSlotWrites: true, RejectExpirationRegression: true}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.connector.On("SendToGateway", mock.Anything, "gw1", mock.Anything).Return(nil)
+
+	// The fake storage fails the test if writes to the slot overlap, or if a write shortens the expiration
+	// that was checked before it.
+	var mu sync.Mutex
+	var current *s4.Record
+	var currentVersion uint64
+	var writing atomic.Bool
+	get := func(context.Context, *s4.Key) (*s4.Record, *s4.Metadata, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if current == nil {
+			return nil, nil, s4.ErrNotFound
+		}
+		return current, &s4.Metadata{Version: currentVersion}, nil
+	}
+	deps.storage.On("Get", mock.Anything, mock.Anything).Return(get, nil, nil)
+	deps.storage.On("GetIncludingExpired", mock.Anything, mock.Anything).Return(get, nil, nil).Maybe()
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(func(_ context.Context, key *s4.Key, record *s4.Record, _ []byte) error {
+		assert.False(t, writing.Swap(true), "concurrent writes to the same slot")
+		defer writing.Store(false)
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if current != nil && key.Version <= currentVersion {
+			return s4.ErrVersionTooLow
+		}
+		if current != nil {
+			assert.GreaterOrEqual(t, record.Expiration, current.Expiration, "expiration regression")
+		}
+		current, currentVersion = record, key.Version
+		return nil
+	})
+
+	const writers = 20
+	expiration := time.Now().Add(time.Hour).UnixMilli()
+	var wg sync.WaitGroup
+	for i := 1; i <= writers; i++ {
+		wg.Add(1)
+		go func(version int) {
+			defer wg.Done()
+			// Later versions alternately extend and shorten the expiration.
+			payload := fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"dGVzdA==","signature":"c2ln"}`, version, expiration+int64(version%2*version))
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", payload))
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotNil(t, current)
+	for _, call := range deps.connector.Calls {
+		payload := string(call.Arguments[2].(*api.Message).Body.Payload)
+		require.True(t, strings.Contains(payload, `"success":true`) || strings.Contains(payload, "STALE_VERSION") || strings.Contains(payload, "EXPIRATION_REGRESSION"), payload)
+	}
+}
+
+func TestFunctionsConnectorHandler_SerializeSlotWritesAllMethods(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{SerializeSlotWrites: true}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.connector.On("SendToGateway", mock.Anything, "gw1", mock.Anything).Return(nil)
+
+	// Slots 1 and 2 always hold the same record at version 1, so that every request below is valid.
+	// The fake storage fails the test if writes to a slot overlap.
+	expiration := time.Now().Add(time.Hour).UnixMilli()
+	stored := s4.Record{Payload: []byte("test"), Expiration: expiration}
+	deps.storage.On("Get", mock.Anything, mock.Anything).Return(&stored, &s4.Metadata{Version: 1}, nil)
+	writing := map[uint]*atomic.Bool{1: {}, 2: {}}
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(func(_ context.Context, key *s4.Key, _ *s4.Record, _ []byte) error {
+		assert.False(t, writing[key.SlotId].Swap(true), "concurrent writes to slot %d", key.SlotId)
+		defer writing[key.SlotId].Store(false)
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+
+	signature := func(slotID uint) string {
+		signature, err := s4.NewEnvelopeFromRecord(&s4.Key{Address: deps.addr, SlotId: slotID, Version: 2}, &stored).Sign(deps.privateKey)
+		require.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+	requests := map[string]string{
+		"secrets_set":        fmt.Sprintf(`{"slot_id":1,"version":2,"expiration":%d,"payload":"dGVzdA==","signature":"c2ln"}`, expiration),
+		"secrets_copy":       fmt.Sprintf(`{"slot_id":2,"version":1,"dest_slot_id":1,"dest_version":2,"signature":"%s"}`, signature(1)),
+		"secrets_bulk_touch": fmt.Sprintf(`{"slot_ids":[1,2],"expiration":%d,"signatures":{"1":"%s","2":"%s"}}`, expiration, signature(1), signature(2)),
+		// Swaps listing the slots in both orders must not deadlock.
+		"secrets_swap": fmt.Sprintf(`{"slots":[{"slot_id":1,"version":1,"new_version":2,"signature":"%s"},{"slot_id":2,"version":1,"new_version":2,"signature":"%s"}]}`, signature(1), signature(2)),
+	}
+	reversedSwap := fmt.Sprintf(`{"slots":[{"slot_id":2,"version":1,"new_version":2,"signature":"%s"},{"slot_id":1,"version":1,"new_version":2,"signature":"%s"}]}`, signature(2), signature(1))
+
+	var wg sync.WaitGroup
+	send := func(method string, payload string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, method, payload))
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		for method, payload := range requests {
+			send(method, payload)
+		}
+		send("secrets_swap", reversedSwap)
+	}
+	wg.Wait()
+
+	require.Len(t, deps.connector.Calls, 5*(len(requests)+1))
+	for _, call := range deps.connector.Calls {
+		message := call.Arguments[2].(*api.Message)
+		require.Contains(t, string(message.Body.Payload), `"success":true`, message.Body.Method)
+	}
+}
+
+func TestFunctionsConnectorHandler_SecretsListMulti(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	operatorKey, operatorAddr := testutils.NewPrivateKeyAndAddress(t)
+	handlerConfig := config.ConnectorHandlerConfig{OperatorAddresses: []string{operatorAddr.Hex()}, MaxListMultiAddresses: 2}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", mock.Anything).Return(false)
+	addr1, addr2 := testutils.NewAddress(), testutils.NewAddress()
+	deps.storage.On("List", mock.Anything, addr1).Return([]*s4.SnapshotRow{
+		{SlotId: 2, Version: 3, Expiration: 1000, PayloadSize: 10},
+		{SlotId: 1, Version: 1, Expiration: 2000, PayloadSize: 20},
+	}, nil)
+	deps.storage.On("List", mock.Anything, addr2).Return([]*s4.SnapshotRow{}, nil)
+	send := func(key *ecdsa.PrivateKey, addresses ...ethCommon.Address) string {
+		resp := expectResponse(deps.connector, "gw1")
+		payload, err := json.Marshal(map[string]any{"addresses": addresses})
+		require.NoError(t, err)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, key, "secrets_list_multi", string(payload)))
+		return <-resp
+	}
+
+	t.Run("multiple addresses", func(t *testing.T) {
+		expected := fmt.Sprintf(`{"success":true,"addresses":[`+
+			`{"address":"%s","rows":[{"slot_id":1,"version":1,"expiration":2000,"payload_size":20},{"slot_id":2,"version":3,"expiration":1000,"payload_size":10}]},`+
+			`{"address":"%s","rows":[]}]}`, strings.ToLower(addr1.Hex()), strings.ToLower(addr2.Hex()))
+		require.Equal(t, expected, send(operatorKey, addr1, addr2))
+	})
+
+	t.Run("address count cap", func(t *testing.T) {
+		require.Equal(t, `{"success":false,"error_message":"Bad request to list secrets: at most 2 addresses are allowed, got 3"}`, send(operatorKey, addr1, addr2, testutils.NewAddress()))
+	})
+
+	t.Run("operators only", func(t *testing.T) {
+		calls := len(deps.connector.Calls)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list_multi", fmt.Sprintf(`{"addresses":["%s"]}`, addr1.Hex())))
+		require.Len(t, deps.connector.Calls, calls)
+	})
+}
+
+func TestFunctionsConnectorHandler_SenderCooldown(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Now()}
+	handlerConfig := config.ConnectorHandlerConfig{SenderTimeoutThreshold: 2, SenderCooldownSec: 60}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+	send := func(method string, payload string) string {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, method, payload))
+		return <-resp
+	}
+	setPayload := `{"slot_id":1,"payload":"dGVzdA=="}`
+
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(context.DeadlineExceeded).Twice()
+	for i := 0; i < 2; i++ {
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: context deadline exceeded"}`, send("secrets_set", setPayload))
+	}
+
+	require.Equal(t, `{"success":false,"error_code":"COOLDOWN","error_message":"Too many storage timeouts, writes are paused for 1m0s"}`, send("secrets_set", setPayload))
+	require.Equal(t, `{"success":true}`, send("secrets_list", ""), "reads are not affected")
+
+	clock.Advance(time.Minute)
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+	require.Equal(t, `{"success":true}`, send("secrets_set", setPayload))
+}
+
+func TestFunctionsConnectorHandler_PublicKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	handles.Allowlist.Remove(handles.Address)
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("public_key", ""))
+	var response struct {
+		Success     bool   `json:"success"`
+		NodeAddress string `json:"node_address"`
+		PublicKey   []byte `json:"public_key"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(handles.Connector.LastResponsePayload()), &response))
+	require.True(t, response.Success)
+	require.Equal(t, handles.Address.Hex(), response.NodeAddress)
+	require.Equal(t, crypto.FromECDSAPub(&handles.PrivateKey.PublicKey), response.PublicKey)
+
+	publicKey, err := crypto.UnmarshalPubkey(response.PublicKey)
+	require.NoError(t, err)
+	require.Equal(t, handles.Address, crypto.PubkeyToAddress(*publicKey))
+}
+
+func TestFunctionsConnectorHandler_StaleVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(s4.ErrVersionTooLow)
+	set := func() string {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", `{"slot_id":1,"version":3,"payload":"dGVzdA=="}`))
+		return <-resp
+	}
+
+	t.Run("current version is returned", func(t *testing.T) {
+		deps.storage.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(&s4.Record{}, &s4.Metadata{Version: 7}, nil).Once()
+		require.Equal(t, `{"success":false,"error_code":"STALE_VERSION","error_message":"Version must be greater than the current version 7","current_version":7}`, set())
+	})
+
+	t.Run("generic error if the current version can't be read", func(t *testing.T) {
+		deps.storage.On("GetIncludingExpired", mock.Anything, &s4.Key{Address: deps.addr, SlotId: 1}).Return(nil, nil, errors.New("connection refused")).Once()
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: version too low"}`, set())
+	})
+}
+
+func TestFunctionsConnectorHandler_SignerMismatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	otherKey, _ := testutils.NewPrivateKeyAndAddress(t)
+	set := func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles, signer *ecdsa.PrivateKey, version uint64) string {
+		expiration := handles.Clock.Now().Add(time.Hour).UnixMilli()
+		key := s4.Key{Address: handles.Address, SlotId: 1, Version: version}
+		signature, err := s4.NewEnvelopeFromRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: expiration}).Sign(signer)
+		require.NoError(t, err)
+		payload := fmt.Sprintf(`{"slot_id":1,"version":%d,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, version, expiration, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+		return handles.Connector.LastResponsePayload()
+	}
+
+	t.Run("enforced", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{RejectSignerMismatch: true})
+		require.Equal(t, `{"success":false,"error_code":"SIGNER_MISMATCH","error_message":"Payload is not signed by the sender"}`, set(handler, handles, otherKey, 1))
+		_, _, err := handles.Storage.Get(ctx, &s4.Key{Address: handles.Address, SlotId: 1})
+		require.ErrorIs(t, err, s4.ErrNotFound)
+
+		require.Equal(t, `{"success":true}`, set(handler, handles, handles.PrivateKey, 1))
+	})
+
+	t.Run("left to storage by default", func(t *testing.T) {
+		handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: wrong signature"}`, set(handler, handles, otherKey, 1))
+	})
+}
+
+func TestFunctionsConnectorHandler_DebugLogging(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	operatorKey, operatorAddr := testutils.NewPrivateKeyAndAddress(t)
+	privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+	clientKey, _ := testutils.NewPrivateKeyAndAddress(t)
+	lggr, logs := logger.TestLoggerObserved(t, zap.InfoLevel)
+	allowlist := gfmocks.NewOnchainAllowlist(t)
+	allowlist.On("Start", mock.Anything).Return(nil)
+	allowlist.On("Close", mock.Anything).Return(nil)
+	allowlist.On("Allow", mock.Anything).Return(true)
+	connector := gcmocks.NewGatewayConnector(t)
+	handlerConfig := config.ConnectorHandlerConfig{OperatorAddresses: []string{operatorAddr.Hex()}}
+	handler, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, s4mocks.NewStorage(t), allowlist, handlerConfig, utils.NewRealClock(), lggr)
+	require.NoError(t, err)
+	handler.SetConnector(connector)
+	require.NoError(t, handler.Start(ctx))
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+
+	t.Run("ignored for clients", func(t *testing.T) {
+		resp := expectResponse(connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, clientKey, "status", `{"debug":true}`))
+		<-resp
+		require.Zero(t, logs.FilterMessage("debug request received").Len())
+		require.Zero(t, logs.FilterMessage("handling gateway request").Len())
+	})
+
+	t.Run("elevated for operators", func(t *testing.T) {
+		resp := expectResponse(connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, operatorKey, "status", `{"debug":true}`))
+		<-resp
+		require.Equal(t, 1, logs.FilterMessage("debug request received").Len())
+		require.Equal(t, 1, logs.FilterMessage("handling gateway request").Len())
+		require.Equal(t, 1, logs.FilterMessage("sent to gateway").Len())
+		require.Equal(t, 1, logs.FilterMessage("debug request handled").Len())
+	})
+
+	t.Run("only for the debug request", func(t *testing.T) {
+		resp := expectResponse(connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, operatorKey, "status", ""))
+		<-resp
+		require.Equal(t, 1, logs.FilterMessage("handling gateway request").Len())
+	})
+}
+
+func TestFunctionsConnectorHandler_EmergencyToken(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	opsKey, _ := testutils.NewPrivateKeyAndAddress(t)
+	handlerConfig := config.ConnectorHandlerConfig{EmergencyPublicKey: hex.EncodeToString(crypto.FromECDSAPub(&opsKey.PublicKey))}
+	handler, handles := testhelpers.NewTestHandler(t, handlerConfig)
+	handles.Allowlist.Remove(handles.Address)
+	expiresAt := handles.Clock.Now().Add(time.Hour).UnixMilli()
+	send := func(key *ecdsa.PrivateKey, token functions.EmergencyToken) int {
+		signature, err := token.Sign(func(data ...[]byte) ([]byte, error) {
+			return common.SignData(key, data...)
+		})
+		require.NoError(t, err)
+		payload, err := json.Marshal(map[string]any{"emergency_token": map[string]any{
+			"id": token.ID, "sender": token.Sender, "expires_at": token.ExpiresAt, "signature": signature,
+		}})
+		require.NoError(t, err)
+		before := len(handles.Connector.Responses())
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", string(payload)))
+		return len(handles.Connector.Responses()) - before
+	}
+
+	t.Run("accepted once", func(t *testing.T) {
+		token := functions.EmergencyToken{ID: "incident-1", Sender: handles.Address, ExpiresAt: expiresAt}
+		require.Equal(t, 1, send(opsKey, token))
+		require.Equal(t, `{"success":true,"maintenance":false,"storage_backend":"in_memory","storage_version":"1"}`, handles.Connector.LastResponsePayload())
+		require.Equal(t, 0, send(opsKey, token))
+	})
+
+	t.Run("not signed by the ops key", func(t *testing.T) {
+		otherKey, _ := testutils.NewPrivateKeyAndAddress(t)
+		require.Equal(t, 0, send(otherKey, functions.EmergencyToken{ID: "incident-2", Sender: handles.Address, ExpiresAt: expiresAt}))
+	})
+
+	t.Run("issued for another sender", func(t *testing.T) {
+		require.Equal(t, 0, send(opsKey, functions.EmergencyToken{ID: "incident-3", Sender: testutils.NewAddress(), ExpiresAt: expiresAt}))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		require.Equal(t, 0, send(opsKey, functions.EmergencyToken{ID: "incident-4", Sender: handles.Address, ExpiresAt: handles.Clock.Now().UnixMilli()}))
+	})
+}
+
+func TestFunctionsConnectorHandler_VerifySignature(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+	otherKey, otherAddr := testutils.NewPrivateKeyAndAddress(t)
+	key := s4.Key{Address: handles.Address, SlotId: 1, Version: 2}
+	record := s4.Record{Payload: []byte("test"), Expiration: 3}
+	verify := func(signer *ecdsa.PrivateKey) string {
+		signature, err := s4.NewEnvelopeFromRecord(&key, &record).Sign(signer)
+		require.NoError(t, err)
+		payload := fmt.Sprintf(`{"slot_id":1,"version":2,"expiration":3,"payload":"dGVzdA==","signature":"%s"}`, base64.StdEncoding.EncodeToString(signature))
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_verify_signature", payload))
+		return handles.Connector.LastResponsePayload()
+	}
+
+	require.Equal(t, fmt.Sprintf(`{"success":true,"valid":true,"signer":"%s"}`, strings.ToLower(handles.Address.Hex())), verify(handles.PrivateKey))
+	require.Equal(t, fmt.Sprintf(`{"success":true,"valid":false,"signer":"%s"}`, strings.ToLower(otherAddr.Hex())), verify(otherKey))
+
+	t.Run("malformed signature", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_verify_signature", `{"slot_id":1,"payload":"dGVzdA==","signature":"AAAA"}`))
+		require.Equal(t, `{"success":true,"valid":false}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("nothing is stored", func(t *testing.T) {
+		_, _, err := handles.Storage.Get(ctx, &s4.Key{Address: handles.Address, SlotId: 1})
+		require.ErrorIs(t, err, s4.ErrNotFound)
+	})
+}
+
+func TestFunctionsConnectorHandler_DonIdentity(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	donKey, donAddr := testutils.NewPrivateKeyAndAddress(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{}, functions.WithDonIdentity("other_don", donKey))
+	nodeAddr := crypto.PubkeyToAddress(handles.PrivateKey.PublicKey)
+	send := func(donId string, method string) *api.Message {
+		msg := handles.NewMessage(method, "")
+		msg.Body.DonId = donId
+		require.NoError(t, msg.Sign(handles.PrivateKey))
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		responses := handles.Connector.Responses()
+		return responses[len(responses)-1]
+	}
+	requireSender := func(t *testing.T, expected ethCommon.Address, response *api.Message) {
+		require.Equal(t, expected.Hex(), response.Body.Sender)
+		signer, err := response.ExtractSigner()
+		require.NoError(t, err)
+		require.Equal(t, expected, ethCommon.BytesToAddress(signer))
+	}
+
+	t.Run("configured DON", func(t *testing.T) {
+		requireSender(t, donAddr, send("other_don", "status"))
+		response := send("other_don", "public_key")
+		requireSender(t, donAddr, response)
+		require.Contains(t, string(response.Body.Payload), donAddr.Hex())
+	})
+
+	t.Run("manifest verifies against the DON's public key", func(t *testing.T) {
+		var publicKeyResponse struct {
+			PublicKey []byte `json:"public_key"`
+		}
+		require.NoError(t, json.Unmarshal(send("other_don", "public_key").Body.Payload, &publicKeyResponse))
+		publicKey, err := crypto.UnmarshalPubkey(publicKeyResponse.PublicKey)
+		require.NoError(t, err)
+
+		var manifestResponse struct {
+			Manifest          functions.Manifest `json:"manifest"`
+			ManifestSignature []byte             `json:"manifest_signature"`
+		}
+		require.NoError(t, json.Unmarshal(send("other_don", "secrets_manifest").Body.Payload, &manifestResponse))
+		signer, err := manifestResponse.Manifest.GetSignerAddress(manifestResponse.ManifestSignature)
+		require.NoError(t, err)
+		require.Equal(t, crypto.PubkeyToAddress(*publicKey), signer)
+		require.Equal(t, donAddr, signer)
+	})
+
+	t.Run("node identity for other DONs", func(t *testing.T) {
+		requireSender(t, nodeAddr, send(testhelpers.TestDonId, "status"))
+	})
+
+	t.Run("nil key", func(t *testing.T) {
+		privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+		_, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, s4mocks.NewStorage(t), gfmocks.NewOnchainAllowlist(t), config.ConnectorHandlerConfig{}, utils.NewRealClock(), logger.TestLogger(t), functions.WithDonIdentity("other_don", nil))
+		require.Error(t, err)
+	})
+}
+
+func TestFunctionsConnectorHandler_RequestSchemas(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	getSchema := json.RawMessage(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"slot_id": {"type": "integer", "minimum": 0, "maximum": 4},
+			"encryption_public_key": {"type": "string", "maxLength": 200}
+		},
+		"required": ["slot_id"],
+		"additionalProperties": false
+	}`)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{RequestSchemas: map[string]json.RawMessage{"secrets_get": getSchema}})
+
+	for _, tc := range []struct {
+		name     string
+		payload  string
+		response string
+	}{
+		{"valid", `{"slot_id":1}`, `{"success":false,"error_message":"Failed to get secret: not found"}`},
+		{"missing property", ``, `{"success":false,"error_code":"SCHEMA_VALIDATION_FAILED","error_message":"Payload doesn't match the schema at /: missing required property \"slot_id\""}`},
+		{"wrong type", `{"slot_id":"1"}`, `{"success":false,"error_code":"SCHEMA_VALIDATION_FAILED","error_message":"Payload doesn't match the schema at /slot_id: expected integer"}`},
+		{"out of range", `{"slot_id":5}`, `{"success":false,"error_code":"SCHEMA_VALIDATION_FAILED","error_message":"Payload doesn't match the schema at /slot_id: greater than 4"}`},
+		{"unknown property", `{"slot_id":1,"slotId":1}`, `{"success":false,"error_code":"SCHEMA_VALIDATION_FAILED","error_message":"Payload doesn't match the schema at /slotId: property is not allowed"}`},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_get", tc.payload))
+			require.Equal(t, tc.response, handles.Connector.LastResponsePayload())
+		})
+	}
+
+	t.Run("other methods aren't validated", func(t *testing.T) {
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", `{"unknown":true}`))
+		require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+	})
+
+	t.Run("unsupported schema", func(t *testing.T) {
+		privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+		handlerConfig := config.ConnectorHandlerConfig{RequestSchemas: map[string]json.RawMessage{"secrets_get": json.RawMessage(`{"type":"object","patternProperties":{}}`)}}
+		_, err := functions.NewFunctionsConnectorHandler(addr.Hex(), privateKey, s4mocks.NewStorage(t), gfmocks.NewOnchainAllowlist(t), handlerConfig, utils.NewRealClock(), logger.TestLogger(t))
+		require.ErrorContains(t, err, "invalid request schema for secrets_get")
+	})
+}
+
+func TestFunctionsConnectorHandler_ListCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Now()}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{ListCacheTTLSec: 5, TombstoneRetentionSec: 60}, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	list := func() string {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		return <-resp
+	}
+
+	// the second listing is served from cache
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1, Version: 1, Expiration: 1, PayloadSize: 4}}, nil).Once()
+	require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":1,"expiration":1}]}`, list())
+	require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":1,"expiration":1}]}`, list())
+
+	t.Run("invalidated by writes", func(t *testing.T) {
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_delete", `{"slot_id":1,"version":2,"expiration":1}`))
+		require.Equal(t, `{"success":true}`, <-resp)
+
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1, Version: 2, Expiration: 1}}, nil).Once()
+		require.Contains(t, list(), `"version":2,"expiration":1,"deleted":true`)
+		require.Contains(t, list(), `"version":2,"expiration":1,"deleted":true`)
+	})
+
+	t.Run("expires after the TTL", func(t *testing.T) {
+		clock.Advance(5 * time.Second)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Once()
+		require.Equal(t, `{"success":true}`, list())
+		require.Equal(t, `{"success":true}`, list())
+	})
+}
+
+func TestFunctionsConnectorHandler_WhoAmI(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	whoAmI := func(handlerConfig config.ConnectorHandlerConfig, prepare func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles)) string {
+		handler, handles := testhelpers.NewTestHandler(t, handlerConfig)
+		if prepare != nil {
+			prepare(handler, handles)
+		}
+		handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("whoami", ""))
+		return strings.ReplaceAll(handles.Connector.LastResponsePayload(), handles.Address.Hex(), "ADDR")
+	}
+
+	t.Run("allowlisted", func(t *testing.T) {
+		require.Equal(t, `{"success":true,"sender":"ADDR","address":"ADDR","allowed":true,"max_slots":5,"max_payload_size_bytes":1024}`, whoAmI(config.ConnectorHandlerConfig{AllowWhoAmI: true}, nil))
+	})
+
+	t.Run("not allowlisted", func(t *testing.T) {
+		response := whoAmI(config.ConnectorHandlerConfig{AllowWhoAmI: true}, func(_ connector.GatewayConnectorHandler, handles *testhelpers.Handles) {
+			handles.Allowlist.Remove(handles.Address)
+		})
+		require.Equal(t, `{"success":true,"sender":"ADDR","address":"ADDR","allowed":false,"max_slots":5,"max_payload_size_bytes":1024}`, response)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		handlerConfig := config.ConnectorHandlerConfig{AllowWhoAmI: true, MaxDailyRequestsPerSender: 10, SenderRateLimitRPS: 0.5, SenderRateLimitBurst: 2}
+		response := whoAmI(handlerConfig, func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles) {
+			handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("status", ""))
+		})
+		require.Equal(t, `{"success":true,"sender":"ADDR","address":"ADDR","allowed":true,"daily_request_limit":10,"daily_requests_used":1,"rate_limit_rps":0.5,"rate_limit_burst":2,"max_slots":5,"max_payload_size_bytes":1024}`, response)
+	})
+
+	t.Run("sender rate limited", func(t *testing.T) {
+		response := whoAmI(config.ConnectorHandlerConfig{AllowWhoAmI: true, SenderRateLimitRPS: 0.5}, func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles) {
+			handles.Allowlist.Remove(handles.Address)
+			handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("whoami", ""))
+		})
+		require.Contains(t, response, `"error_code":"RATE_LIMITED"`)
+	})
+
+	t.Run("DON rate limited", func(t *testing.T) {
+		response := whoAmI(config.ConnectorHandlerConfig{AllowWhoAmI: true, DonRateLimitRPS: 0.5}, func(handler connector.GatewayConnectorHandler, handles *testhelpers.Handles) {
+			handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("whoami", ""))
+		})
+		require.Contains(t, response, `"error_code":"DON_RATE_LIMITED"`)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		require.Empty(t, whoAmI(config.ConnectorHandlerConfig{}, func(_ connector.GatewayConnectorHandler, handles *testhelpers.Handles) {
+			handles.Allowlist.Remove(handles.Address)
+		}))
+	})
+}
+
+func TestFunctionsConnectorHandler_AllowlistCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	clock := &testClock{now: time.Now()}
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{AllowlistCacheTTLSec: 3600}, clock)
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+	msg := newTestMessage(t, deps.privateKey, "secrets_list", "")
+
+	// the first decision is served by the allowlist, the second one from cache
+	deps.allowlist.On("Version").Return(uint64(1)).Twice()
+	deps.allowlist.On("Allow", deps.addr).Return(true).Once()
+	for i := 0; i < 2; i++ {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", msg)
+		require.Equal(t, `{"success":true}`, <-resp)
+	}
+
+	// revocation is picked up after the next sync despite the long TTL
+	deps.allowlist.On("Version").Return(uint64(2))
+	deps.allowlist.On("Allow", deps.addr).Return(false)
+	handler.HandleGatewayMessage(ctx, "gw1", msg)
+	deps.connector.AssertNumberOfCalls(t, "SendToGateway", 2)
+}
+
+func TestFunctionsConnectorHandler_AllowlistCacheRevocation(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{AllowlistCacheTTLSec: 3600})
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Len(t, handles.Connector.Responses(), 1)
+
+	// Other members changing don't drop the cached decision.
+	handles.Allowlist.Add(testutils.NewAddress())
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Len(t, handles.Connector.Responses(), 2)
+
+	handles.Allowlist.Remove(handles.Address)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Len(t, handles.Connector.Responses(), 2)
+}
+
+func TestFunctionsConnectorHandler_PartialSigner(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	signer := fmocks.NewPartialSigner(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock(), functions.WithPartialSigner(signer))
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+
+	signer.On("PartialSign", []byte(`{"success":true}`)).Return([]byte{1, 2, 3}, uint32(4), nil).Once()
+	resp := expectResponse(deps.connector, "gw1")
+	handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+	require.Equal(t, `{"payload":{"success":true},"partial_signature":"AQID","signer_index":4}`, <-resp)
+
+	t.Run("signing error", func(t *testing.T) {
+		signer.On("PartialSign", mock.Anything).Return(nil, uint32(0), errors.New("boom")).Once()
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", ""))
+		deps.connector.AssertNumberOfCalls(t, "SendToGateway", 1)
+	})
+}
+
+func TestFunctionsConnectorHandler_RequestTag(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{MaxRequestTagLength: 8}, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+	deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{{SlotId: 1, Version: 2, Expiration: 3}}, nil)
+
+	t.Run("round trip", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"request_tag":"waiter-1"}`))
+		require.Equal(t, `{"success":true,"rows":[{"slot_id":1,"version":2,"expiration":3}],"request_tag":"waiter-1"}`, <-resp)
+	})
+
+	t.Run("error response", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"request_tag":"waiter-2","sort_by":"foo"}`))
+		require.Equal(t, `{"success":false,"error_message":"Bad request to list secrets: unsupported sort_by: \"foo\"","request_tag":"waiter-2"}`, <-resp)
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"request_tag":"waiter-10"}`))
+		require.Equal(t, `{"success":false,"error_code":"REQUEST_TAG_TOO_LONG","error_message":"Request tag is longer than 8 bytes"}`, <-resp)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		handler, deps := newTestConnectorHandler(t, config.ConnectorHandlerConfig{}, utils.NewRealClock())
+		t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+		deps.allowlist.On("Allow", deps.addr).Return(true)
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil)
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"request_tag":"waiter-1"}`))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+}
+
+func TestFunctionsConnectorHandler_PayloadSizePerMethod(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handlerConfig := config.ConnectorHandlerConfig{
+		MaxPayloadBytesPerMethod: map[string]uint32{
+			"secrets_list": 20,
+			"secrets_set":  40,
+		},
+	}
+	handler, deps := newTestConnectorHandler(t, handlerConfig, utils.NewRealClock())
+	t.Cleanup(func() { assert.NoError(t, handler.Close()) })
+	deps.allowlist.On("Allow", deps.addr).Return(true)
+
+	t.Run("secrets_list at limit", func(t *testing.T) {
+		deps.storage.On("List", mock.Anything, deps.addr).Return([]*s4.SnapshotRow{}, nil).Once()
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"sort_by": "slot" }`))
+		require.Equal(t, `{"success":true}`, <-resp)
+	})
+
+	t.Run("secrets_list above limit", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_list", `{"sort_by":"version"}`))
+		require.Equal(t, `{"success":false,"error_code":"PAYLOAD_TOO_LARGE","error_message":"Payload of 21 bytes exceeds the 20 bytes limit for secrets_list"}`, <-resp)
+	})
+
+	t.Run("secrets_set at limit", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		payload := `{"slot_id":1,"payload":"YQ==","x":"` + strings.Repeat("a", 3) + `"}`
+		require.Len(t, payload, 40)
+		deps.storage.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(s4.ErrWrongSignature).Once()
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", payload))
+		require.Equal(t, `{"success":false,"error_message":"Failed to set secret: wrong signature"}`, <-resp)
+	})
+
+	t.Run("secrets_set above limit", func(t *testing.T) {
+		resp := expectResponse(deps.connector, "gw1")
+		payload := `{"slot_id":1,"x":"` + strings.Repeat("a", 21) + `"}`
+		handler.HandleGatewayMessage(ctx, "gw1", newTestMessage(t, deps.privateKey, "secrets_set", payload))
+		require.Equal(t, `{"success":false,"error_code":"PAYLOAD_TOO_LARGE","error_message":"Payload of 41 bytes exceeds the 40 bytes limit for secrets_set"}`, <-resp)
+	})
+}
@@ -0,0 +1,152 @@
+package functions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+const secondsPerDay = int64(24 * time.Hour / time.Second)
+
+// DailyQuotaSnapshot is a serializable state of per-sender daily request counters, along with the other
+// limiter state that must survive restarts: per-sender rate limit buckets and the response cache,
+// which rejects replayed message IDs.
+type DailyQuotaSnapshot struct {
+	// Day is the number of days (shifted by the reset offset) since the unix epoch.
+	Day    int64                     `json:"day"`
+	Counts map[common.Address]uint32 `json:"counts"`
+	// RateLimitTokens are the tokens left in per-sender rate limit buckets that weren't full
+	// at RateLimitTokensAt (unix time in milliseconds).
+	RateLimitTokens   map[common.Address]float64 `json:"rate_limit_tokens,omitempty"`
+	RateLimitTokensAt int64                      `json:"rate_limit_tokens_at,omitempty"`
+	// Responses are the response cache entries, least recently used first.
+	Responses []CachedResponse `json:"responses,omitempty"`
+}
+
+// CachedResponse is a serializable response cache entry.
+type CachedResponse struct {
+	Sender common.Address `json:"sender"`
+	// Id is the idempotency key of the request if Idempotent is set, its MessageId otherwise.
+	Id          string       `json:"id"`
+	Idempotent  bool         `json:"idempotent"`
+	RequestHash common.Hash  `json:"request_hash"`
+	Response    *api.Message `json:"response"`
+	// ExpiresAt is unix time in milliseconds.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// DailyQuotaStore persists daily quota counters and other limiter state so that node restarts don't reset
+// sender budgets or replay protection.
+//
+//go:generate mockery --quiet --name DailyQuotaStore --output ./mocks/ --case=underscore
+type DailyQuotaStore interface {
+	// Load returns the last saved snapshot or nil if there is none.
+	Load(ctx context.Context) (*DailyQuotaSnapshot, error)
+	Save(ctx context.Context, snapshot *DailyQuotaSnapshot) error
+}
+
+// QuotaResolver assigns custom quotas to individual senders, e.g. higher limits for partners.
+type QuotaResolver interface {
+	// DailyQuota returns the sender's daily request limit. If ok is false, MaxDailyRequestsPerSender applies.
+	DailyQuota(sender common.Address) (limit uint32, ok bool)
+	// SlotQuota returns the number of S4 slots the sender may use. If ok is false, MaxSlotsPerSender applies.
+	// Quotas above the S4 MaxSlotsPerUser are capped by it.
+	SlotQuota(sender common.Address) (slots uint, ok bool)
+}
+
+// dailyQuota counts requests per sender and resets all counters at the day boundary.
+// All methods are thread-safe.
+type dailyQuota struct {
+	limit       uint32
+	resolver    QuotaResolver
+	resetOffset time.Duration
+	clock       utils.Clock
+	mu          sync.Mutex
+	day         int64
+	counts      map[common.Address]uint32
+}
+
+func newDailyQuota(limit uint32, resetOffset time.Duration, clock utils.Clock) *dailyQuota {
+	q := &dailyQuota{
+		limit:       limit,
+		resetOffset: resetOffset,
+		clock:       clock,
+		counts:      make(map[common.Address]uint32),
+	}
+	q.day = q.currentDay()
+	return q
+}
+
+// Allow consumes weight units from the sender's budget, unless that would exceed the limit.
+func (q *dailyQuota) Allow(sender common.Address, weight uint32) bool {
+	limit := q.senderLimit(sender)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	if uint64(q.counts[sender])+uint64(weight) > uint64(limit) {
+		return false
+	}
+	q.counts[sender] += weight
+	return true
+}
+
+// Usage returns the units the sender consumed today and its daily limit.
+func (q *dailyQuota) Usage(sender common.Address) (used uint32, limit uint32) {
+	limit = q.senderLimit(sender)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return q.counts[sender], limit
+}
+
+func (q *dailyQuota) senderLimit(sender common.Address) uint32 {
+	if q.resolver != nil {
+		if limit, ok := q.resolver.DailyQuota(sender); ok {
+			return limit
+		}
+	}
+	return q.limit
+}
+
+func (q *dailyQuota) Snapshot() *DailyQuotaSnapshot {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	snapshot := &DailyQuotaSnapshot{
+		Day:    q.day,
+		Counts: make(map[common.Address]uint32, len(q.counts)),
+	}
+	for sender, count := range q.counts {
+		snapshot.Counts[sender] = count
+	}
+	return snapshot
+}
+
+// Restore loads counters from a snapshot. Snapshots taken on a different day are ignored.
+func (q *dailyQuota) Restore(snapshot *DailyQuotaSnapshot) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	if snapshot == nil || snapshot.Day != q.day {
+		return
+	}
+	for sender, count := range snapshot.Counts {
+		q.counts[sender] = count
+	}
+}
+
+func (q *dailyQuota) currentDay() int64 {
+	return q.clock.Now().Add(-q.resetOffset).Unix() / secondsPerDay
+}
+
+func (q *dailyQuota) rollover() {
+	if day := q.currentDay(); day != q.day {
+		q.day = day
+		q.counts = make(map[common.Address]uint32)
+	}
+}
@@ -0,0 +1,60 @@
+package functions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/smartcontractkit/sqlx"
+
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/pg"
+)
+
+// dailyQuotaORM is a DailyQuotaStore keeping snapshots in the functions_limiter_state table.
+type dailyQuotaORM struct {
+	q   pg.Q
+	key string
+}
+
+var _ DailyQuotaStore = (*dailyQuotaORM)(nil)
+
+// NewDailyQuotaORM returns a DailyQuotaStore backed by the database. Handlers sharing a database must use
+// different keys, e.g. their job IDs.
+func NewDailyQuotaORM(db *sqlx.DB, lggr logger.Logger, cfg pg.QConfig, key string) DailyQuotaStore {
+	return &dailyQuotaORM{
+		q:   pg.NewQ(db, lggr, cfg),
+		key: key,
+	}
+}
+
+func (o *dailyQuotaORM) Load(ctx context.Context) (*DailyQuotaSnapshot, error) {
+	var state []byte
+	stmt := `SELECT state FROM functions_limiter_state WHERE state_key=$1;`
+	if err := o.q.WithOpts(pg.WithParentCtx(ctx)).Get(&state, stmt, o.key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshot DailyQuotaSnapshot
+	if err := json.Unmarshal(state, &snapshot); err != nil {
+		return nil, errors.Wrap(err, "failed to decode limiter state")
+	}
+	return &snapshot, nil
+}
+
+func (o *dailyQuotaORM) Save(ctx context.Context, snapshot *DailyQuotaSnapshot) error {
+	state, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	stmt := `
+		INSERT INTO functions_limiter_state (state_key, state, updated_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (state_key) DO UPDATE SET state = EXCLUDED.state, updated_at = EXCLUDED.updated_at;
+	`
+	_, err = o.q.WithOpts(pg.WithParentCtx(ctx)).Exec(stmt, o.key, state)
+	return err
+}
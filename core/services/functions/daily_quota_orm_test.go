@@ -0,0 +1,57 @@
+package functions_test
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils/pgtest"
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
+)
+
+func TestDailyQuotaORM(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	db := pgtest.NewSqlxDB(t)
+	lggr := logger.TestLogger(t)
+	store := functions.NewDailyQuotaORM(db, lggr, pgtest.NewQConfig(true), "job1")
+
+	snapshot, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+
+	sender := testutils.NewAddress()
+	saved := &functions.DailyQuotaSnapshot{
+		Day:               19509,
+		Counts:            map[common.Address]uint32{sender: 3},
+		RateLimitTokens:   map[common.Address]float64{sender: 0.5},
+		RateLimitTokensAt: 1685620800000,
+		Responses: []functions.CachedResponse{{
+			Sender:    sender,
+			Id:        "1",
+			Response:  &api.Message{Body: api.MessageBody{MessageId: "1", Method: "secrets_list"}},
+			ExpiresAt: 1685620860000,
+		}},
+	}
+	require.NoError(t, store.Save(ctx, saved))
+	snapshot, err = store.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, saved, snapshot)
+
+	saved.Counts[sender] = 4
+	require.NoError(t, store.Save(ctx, saved))
+	snapshot, err = store.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), snapshot.Counts[sender])
+
+	// other keys don't see the snapshot
+	other := functions.NewDailyQuotaORM(db, lggr, pgtest.NewQConfig(true), "job2")
+	snapshot, err = other.Load(ctx)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+}
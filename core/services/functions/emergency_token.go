@@ -0,0 +1,86 @@
+package functions
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	gwcommon "github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+// EmergencyToken is a break-glass authorization, signed by the ops key (EmergencyPublicKey), that lets
+// a single request from Sender bypass the allowlist. Each token is accepted only once.
+type EmergencyToken struct {
+	ID     string         `json:"id"`
+	Sender common.Address `json:"sender"`
+	// ExpiresAt is a unix timestamp in milliseconds.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func (t EmergencyToken) Sign(signer func(data ...[]byte) ([]byte, error)) ([]byte, error) {
+	return signer(t.signedData()...)
+}
+
+// GetSignerAddress returns the address of the key that signed the token.
+func (t EmergencyToken) GetSignerAddress(signature []byte) (common.Address, error) {
+	signer, err := gwcommon.ExtractSigner(signature, t.signedData()...)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return common.BytesToAddress(signer), nil
+}
+
+func (t EmergencyToken) signedData() [][]byte {
+	expiresAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiresAt, uint64(t.ExpiresAt))
+	return [][]byte{[]byte("emergency_token"), []byte(t.ID), t.Sender.Bytes(), expiresAt}
+}
+
+// emergencyTokens verifies emergency tokens and remembers redeemed ones until they expire.
+// All methods are thread-safe.
+type emergencyTokens struct {
+	signer common.Address
+	clock  utils.Clock
+	mu     sync.Mutex
+	// redeemed maps IDs of redeemed tokens to their expiration.
+	redeemed map[string]int64
+}
+
+func newEmergencyTokens(signer common.Address, clock utils.Clock) *emergencyTokens {
+	return &emergencyTokens{
+		signer:   signer,
+		clock:    clock,
+		redeemed: make(map[string]int64),
+	}
+}
+
+// Redeem accepts a valid token for sender and invalidates it.
+func (e *emergencyTokens) Redeem(token EmergencyToken, signature []byte, sender common.Address) error {
+	if token.Sender != sender {
+		return errors.New("token was issued for another sender")
+	}
+	now := e.clock.Now().UnixMilli()
+	if token.ExpiresAt <= now {
+		return errors.New("token has expired")
+	}
+	signer, err := token.GetSignerAddress(signature)
+	if err != nil || signer != e.signer {
+		return errors.New("token is not signed by the ops key")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, expiresAt := range e.redeemed {
+		if expiresAt <= now {
+			delete(e.redeemed, id)
+		}
+	}
+	if _, ok := e.redeemed[token.ID]; ok {
+		return errors.New("token was already used")
+	}
+	e.redeemed[token.ID] = token.ExpiresAt
+	return nil
+}
@@ -0,0 +1,31 @@
+package functions_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+)
+
+func TestEmergencyToken_SignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	privateKey, address := testutils.NewPrivateKeyAndAddress(t)
+	token := functions.EmergencyToken{ID: "incident-1", Sender: testutils.NewAddress(), ExpiresAt: 1000}
+	signature, err := token.Sign(func(data ...[]byte) ([]byte, error) {
+		return common.SignData(privateKey, data...)
+	})
+	require.NoError(t, err)
+
+	signer, err := token.GetSignerAddress(signature)
+	require.NoError(t, err)
+	require.Equal(t, address, signer)
+
+	token.Sender = testutils.NewAddress()
+	signer, err = token.GetSignerAddress(signature)
+	require.NoError(t, err)
+	require.NotEqual(t, address, signer)
+}
@@ -0,0 +1,66 @@
+package functions
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handlerMetrics are the metrics updated by a handler. By default, they are the package-level metrics
+// registered in the global registry.
+type handlerMetrics struct {
+	panics              prometheus.Counter
+	gatewaySendSuccess  *prometheus.CounterVec
+	gatewaySendFailure  *prometheus.CounterVec
+	mirrorWriteFailures prometheus.Counter
+}
+
+func defaultHandlerMetrics() *handlerMetrics {
+	return &handlerMetrics{
+		panics:              promHandlerPanics,
+		gatewaySendSuccess:  PromGatewaySendSuccess,
+		gatewaySendFailure:  PromGatewaySendFailure,
+		mirrorWriteFailures: promMirrorWriteFailures,
+	}
+}
+
+// newHandlerMetrics creates the handler metrics and registers them in registerer. Metrics already registered
+// there (e.g. by another handler sharing the registry) are reused.
+func newHandlerMetrics(registerer prometheus.Registerer) (*handlerMetrics, error) {
+	panics, err := registerMetric(registerer, prometheus.NewCounter(promHandlerPanicsOpts))
+	if err != nil {
+		return nil, err
+	}
+	sendSuccess, err := registerMetric(registerer, prometheus.NewCounterVec(promGatewaySendSuccessOpts, promGatewayLabels))
+	if err != nil {
+		return nil, err
+	}
+	sendFailure, err := registerMetric(registerer, prometheus.NewCounterVec(promGatewaySendFailureOpts, promGatewayLabels))
+	if err != nil {
+		return nil, err
+	}
+	mirrorWriteFailures, err := registerMetric(registerer, prometheus.NewCounter(promMirrorWriteFailuresOpts))
+	if err != nil {
+		return nil, err
+	}
+	return &handlerMetrics{
+		panics:              panics,
+		gatewaySendSuccess:  sendSuccess,
+		gatewaySendFailure:  sendFailure,
+		mirrorWriteFailures: mirrorWriteFailures,
+	}, nil
+}
+
+// registerMetric registers collector, or returns the equal collector registered before.
+func registerMetric[C prometheus.Collector](registerer prometheus.Registerer, collector C) (C, error) {
+	if err := registerer.Register(collector); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+		return collector, err
+	}
+	return collector, nil
+}
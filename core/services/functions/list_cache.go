@@ -0,0 +1,103 @@
+package functions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+type listCacheEntry struct {
+	rows      []*s4.SnapshotRow
+	expiresAt time.Time
+}
+
+// listCachingStorage caches List results by address for up to ttl. Snapshots hold metadata only, payloads
+// are never cached. Writes through the cache invalidate the address, writes by other nodes show up once
+// the entry expires.
+// All methods are thread-safe.
+type listCachingStorage struct {
+	s4.Storage
+	ttl   time.Duration
+	clock utils.Clock
+
+	mu      sync.Mutex
+	entries map[common.Address]listCacheEntry
+	// generations counts invalidations of addresses with a List in flight, so that a List racing
+	// with a write doesn't cache the snapshot from before the write.
+	generations map[common.Address]uint64
+	inFlight    map[common.Address]int
+}
+
+var _ s4.Storage = &listCachingStorage{}
+
+func newListCachingStorage(storage s4.Storage, ttl time.Duration, clock utils.Clock) *listCachingStorage {
+	return &listCachingStorage{
+		Storage:     storage,
+		ttl:         ttl,
+		clock:       clock,
+		entries:     make(map[common.Address]listCacheEntry),
+		generations: make(map[common.Address]uint64),
+		inFlight:    make(map[common.Address]int),
+	}
+}
+
+func (s *listCachingStorage) List(ctx context.Context, address common.Address) ([]*s4.SnapshotRow, error) {
+	s.mu.Lock()
+	now := s.clock.Now()
+	if entry, ok := s.entries[address]; ok && now.Before(entry.expiresAt) {
+		s.mu.Unlock()
+		return copySnapshot(entry.rows), nil
+	}
+	generation := s.generations[address]
+	s.inFlight[address]++
+	s.mu.Unlock()
+
+	rows, err := s.Storage.List(ctx, address)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil && s.generations[address] == generation {
+		for cached, entry := range s.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(s.entries, cached)
+			}
+		}
+		s.entries[address] = listCacheEntry{rows: copySnapshot(rows), expiresAt: now.Add(s.ttl)}
+	}
+	s.inFlight[address]--
+	if s.inFlight[address] == 0 {
+		delete(s.inFlight, address)
+		delete(s.generations, address)
+	}
+	return rows, err
+}
+
+func (s *listCachingStorage) Put(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+	// Invalidate even if the write fails, it may have been applied before the error.
+	defer s.invalidate(key.Address)
+	return s.Storage.Put(ctx, key, record, signature)
+}
+
+func (s *listCachingStorage) invalidate(address common.Address) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, address)
+	if s.inFlight[address] > 0 {
+		s.generations[address]++
+	}
+}
+
+// copySnapshot copies rows, so that callers can't modify cached ones.
+func copySnapshot(rows []*s4.SnapshotRow) []*s4.SnapshotRow {
+	copied := make([]*s4.SnapshotRow, len(rows))
+	for i, row := range rows {
+		rowCopy := *row
+		copied[i] = &rowCopy
+	}
+	return copied
+}
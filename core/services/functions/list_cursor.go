@@ -0,0 +1,71 @@
+package functions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+)
+
+// listCursor is the position of the last row of a secrets_list page. Clients get it base64-encoded
+// (next_cursor) and must treat it as opaque.
+// Since the cursor holds a key rather than an offset, slots inserted or deleted between pages
+// neither shift the next page nor cause rows to be skipped or repeated.
+type listCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d"`
+	SlotID     uint   `json:"i"`
+	Version    uint64 `json:"v"`
+	Expiration int64  `json:"e"`
+}
+
+func newListCursor(sortBy string, descending bool, last *s4.SnapshotRow) listCursor {
+	if sortBy == "" {
+		sortBy = listSortBySlot
+	}
+	return listCursor{
+		SortBy:     sortBy,
+		Descending: descending,
+		SlotID:     last.SlotId,
+		Version:    last.Version,
+		Expiration: last.Expiration,
+	}
+}
+
+func (c listCursor) Encode() string {
+	// Marshaling can't fail, the cursor has only plain fields.
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListCursor parses a cursor and checks that it was issued for the same order.
+func decodeListCursor(encoded string, sortBy string, descending bool) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var cursor listCursor
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	if sortBy == "" {
+		sortBy = listSortBySlot
+	}
+	if cursor.SortBy != sortBy || cursor.Descending != descending {
+		return nil, errors.New("cursor was issued for a different sort order")
+	}
+	return &cursor, nil
+}
+
+// rowsAfter returns the rows that follow the cursor. rows must be sorted by the cursor's order.
+func (c *listCursor) rowsAfter(rows []*s4.SnapshotRow) []*s4.SnapshotRow {
+	less := listOrder(c.SortBy, c.Descending)
+	last := &s4.SnapshotRow{SlotId: c.SlotID, Version: c.Version, Expiration: c.Expiration}
+	for i, row := range rows {
+		if less(last, row) {
+			return rows[i:]
+		}
+	}
+	return nil
+}
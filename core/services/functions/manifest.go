@@ -0,0 +1,55 @@
+package functions
+
+import (
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	gwcommon "github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+)
+
+// Manifest enumerates the records an address has stored in S4, without their payloads.
+// Nodes sign manifests, so that auditors can archive them and later verify where they came from.
+type Manifest struct {
+	Address common.Address `json:"address"`
+	// GeneratedAt is a unix timestamp in milliseconds.
+	GeneratedAt int64            `json:"generated_at"`
+	Records     []ManifestRecord `json:"records"`
+}
+
+type ManifestRecord struct {
+	SlotID      uint   `json:"slot_id"`
+	Version     uint64 `json:"version"`
+	Expiration  int64  `json:"expiration"`
+	PayloadSize uint64 `json:"payload_size"`
+	UpdatedAt   int64  `json:"updated_at,omitempty"`
+}
+
+func (m Manifest) Sign(signer func(data ...[]byte) ([]byte, error)) ([]byte, error) {
+	data, err := m.signedData()
+	if err != nil {
+		return nil, err
+	}
+	return signer(data...)
+}
+
+// GetSignerAddress returns the address of the node that signed the manifest.
+func (m Manifest) GetSignerAddress(signature []byte) (common.Address, error) {
+	data, err := m.signedData()
+	if err != nil {
+		return common.Address{}, err
+	}
+	signer, err := gwcommon.ExtractSigner(signature, data...)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return common.BytesToAddress(signer), nil
+}
+
+func (m Manifest) signedData() ([][]byte, error) {
+	manifestJson, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{[]byte("manifest"), manifestJson}, nil
+}
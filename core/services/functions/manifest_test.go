@@ -0,0 +1,35 @@
+package functions_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+)
+
+func TestManifest_SignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	privateKey, address := testutils.NewPrivateKeyAndAddress(t)
+	manifest := functions.Manifest{
+		Address:     testutils.NewAddress(),
+		GeneratedAt: 1000,
+		Records:     []functions.ManifestRecord{{SlotID: 1, Version: 2, Expiration: 3000, PayloadSize: 10}},
+	}
+	signature, err := manifest.Sign(func(data ...[]byte) ([]byte, error) {
+		return common.SignData(privateKey, data...)
+	})
+	require.NoError(t, err)
+
+	signer, err := manifest.GetSignerAddress(signature)
+	require.NoError(t, err)
+	require.Equal(t, address, signer)
+
+	manifest.Records[0].Version++
+	signer, err = manifest.GetSignerAddress(signature)
+	require.NoError(t, err)
+	require.NotEqual(t, address, signer)
+}
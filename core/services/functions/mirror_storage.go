@@ -0,0 +1,144 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+var promMirrorWriteFailuresOpts = prometheus.CounterOpts{
+	Name: "functions_connector_handler_mirror_write_failure",
+	Help: "Metric to track writes that failed to be mirrored to the secondary storage",
+}
+
+var promMirrorWriteFailures = promauto.NewCounter(promMirrorWriteFailuresOpts)
+
+// maxPendingMirrorWrites bounds the mirror writes running in the background.
+const maxPendingMirrorWrites = 32
+
+// mirroringStorage copies successful writes to a secondary storage in the background. Mirror failures are
+// logged and metered, but never fail the write. Writes arriving while maxPendingMirrorWrites are pending,
+// or after Close, are not mirrored and count as failures. With fallbackReads, reads failing on the primary
+// storage (other than with ErrNotFound) are served by the mirror.
+type mirroringStorage struct {
+	s4.Storage
+	mirror        s4.Storage
+	fallbackReads bool
+	writeFailures prometheus.Counter
+	lggr          logger.Logger
+	pending       chan struct{}
+	mu            sync.Mutex
+	closed        bool
+	wg            sync.WaitGroup
+	stopCh        utils.StopChan
+}
+
+var _ s4.Storage = &mirroringStorage{}
+
+func newMirroringStorage(storage s4.Storage, mirror s4.Storage, fallbackReads bool, writeFailures prometheus.Counter, lggr logger.Logger) *mirroringStorage {
+	return &mirroringStorage{
+		Storage:       storage,
+		mirror:        mirror,
+		fallbackReads: fallbackReads,
+		writeFailures: writeFailures,
+		lggr:          lggr,
+		pending:       make(chan struct{}, maxPendingMirrorWrites),
+		stopCh:        make(utils.StopChan),
+	}
+}
+
+func (s *mirroringStorage) Put(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+	if err := s.Storage.Put(ctx, key, record, signature); err != nil {
+		return err
+	}
+	if err := s.startMirrorWrite(); err != nil {
+		s.writeFailures.Inc()
+		s.lggr.Errorw("failed to mirror write", "address", key.Address, "slotId", key.SlotId, "version", key.Version, "err", err)
+		return nil
+	}
+	mirrorKey, mirrorRecord := *key, *record
+	go func() {
+		defer s.finishMirrorWrite()
+		ctx, cancel := s.stopCh.NewCtx()
+		defer cancel()
+		if err := s.mirror.Put(ctx, &mirrorKey, &mirrorRecord, signature); err != nil {
+			s.writeFailures.Inc()
+			s.lggr.Errorw("failed to mirror write", "address", mirrorKey.Address, "slotId", mirrorKey.SlotId, "version", mirrorKey.Version, "err", err)
+		}
+	}()
+	return nil
+}
+
+// startMirrorWrite reserves a pending write. The caller must call finishMirrorWrite once it's done.
+func (s *mirroringStorage) startMirrorWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("mirror storage is closed")
+	}
+	select {
+	case s.pending <- struct{}{}:
+	default:
+		return errors.New("too many pending mirror writes")
+	}
+	s.wg.Add(1)
+	return nil
+}
+
+func (s *mirroringStorage) finishMirrorWrite() {
+	<-s.pending
+	s.wg.Done()
+}
+
+func (s *mirroringStorage) Get(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metadata, error) {
+	record, metadata, err := s.Storage.Get(ctx, key)
+	if s.fallBack("Get", err) {
+		return s.mirror.Get(ctx, key)
+	}
+	return record, metadata, err
+}
+
+func (s *mirroringStorage) GetIncludingExpired(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metadata, error) {
+	record, metadata, err := s.Storage.GetIncludingExpired(ctx, key)
+	if s.fallBack("GetIncludingExpired", err) {
+		return s.mirror.GetIncludingExpired(ctx, key)
+	}
+	return record, metadata, err
+}
+
+func (s *mirroringStorage) List(ctx context.Context, address common.Address) ([]*s4.SnapshotRow, error) {
+	rows, err := s.Storage.List(ctx, address)
+	if s.fallBack("List", err) {
+		return s.mirror.List(ctx, address)
+	}
+	return rows, err
+}
+
+func (s *mirroringStorage) fallBack(op string, err error) bool {
+	if !s.fallbackReads || err == nil || errors.Is(err, s4.ErrNotFound) {
+		return false
+	}
+	s.lggr.Warnw("reading from mirror storage", "op", op, "err", err)
+	return true
+}
+
+// Close cancels and waits for pending mirror writes. Later writes are not mirrored.
+func (s *mirroringStorage) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stopCh)
+	s.wg.Wait()
+}
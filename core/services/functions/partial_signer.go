@@ -0,0 +1,57 @@
+package functions
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+)
+
+// PartialSigner produces a node's share of a threshold (multi-node) signature over response payloads.
+//
+// When a PartialSigner is configured, response payloads are wrapped into a partiallySignedPayload
+// object. To obtain a verifiable multi-node response, a client collects responses sharing the same
+// MessageId from at least a threshold of nodes, checks that their "payload" fields are byte-identical
+// and combines the partial signatures, keyed by "signer_index", using the scheme's aggregation
+// function (e.g. Lagrange interpolation of the shares). The aggregated signature is verified
+// against the DON's public key over the raw "payload" bytes.
+//
+//go:generate mockery --quiet --name PartialSigner --output ./mocks/ --case=underscore
+type PartialSigner interface {
+	// PartialSign returns a signature share over data and the index of this node in the scheme.
+	PartialSign(data []byte) (signature []byte, index uint32, err error)
+}
+
+type partiallySignedPayload struct {
+	Payload          json.RawMessage `json:"payload"`
+	PartialSignature []byte          `json:"partial_signature"`
+	SignerIndex      uint32          `json:"signer_index"`
+}
+
+func partiallySign(signer PartialSigner, payload json.RawMessage) (json.RawMessage, error) {
+	signature, index, err := signer.PartialSign(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(partiallySignedPayload{
+		Payload:          payload,
+		PartialSignature: signature,
+		SignerIndex:      index,
+	})
+}
+
+// NewMultiSigSigner returns a PartialSigner for a k-of-n multi-signature, where each node signs payloads with its
+// own key (see common.SignData). Clients aggregate by collecting valid signatures of at least k distinct indexes.
+func NewMultiSigSigner(signerKey *ecdsa.PrivateKey, index uint32) PartialSigner {
+	return &multiSigSigner{signerKey: signerKey, index: index}
+}
+
+type multiSigSigner struct {
+	signerKey *ecdsa.PrivateKey
+	index     uint32
+}
+
+func (s *multiSigSigner) PartialSign(data []byte) ([]byte, uint32, error) {
+	signature, err := common.SignData(s.signerKey, data)
+	return signature, s.index, err
+}
@@ -0,0 +1,230 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// requestSchema is the subset of JSON Schema supported for request payload validation (see RequestSchemas).
+// Schemas using other keywords are rejected, so that they are never silently ignored.
+type requestSchema struct {
+	// Type is one of "object", "array", "string", "number", "integer", "boolean" or "null".
+	Type                 string                    `json:"type"`
+	Properties           map[string]*requestSchema `json:"properties"`
+	Required             []string                  `json:"required"`
+	AdditionalProperties *bool                     `json:"additionalProperties"`
+	Items                *requestSchema            `json:"items"`
+	MaxItems             *int                      `json:"maxItems"`
+	MinLength            *int                      `json:"minLength"`
+	MaxLength            *int                      `json:"maxLength"`
+	Minimum              *float64                  `json:"minimum"`
+	Maximum              *float64                  `json:"maximum"`
+	Enum                 []any                     `json:"enum"`
+
+	// Annotations, ignored by validation.
+	Schema      string `json:"$schema"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func parseRequestSchema(raw json.RawMessage) (*requestSchema, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	var schema requestSchema
+	if err := decoder.Decode(&schema); err != nil {
+		return nil, err
+	}
+	if err := schema.check(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func (s *requestSchema) check() error {
+	switch s.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return fmt.Errorf("unsupported type %q", s.Type)
+	}
+	for _, property := range s.Properties {
+		if err := property.check(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check()
+	}
+	return nil
+}
+
+// schemaViolation describes the first part of a payload that doesn't match the schema.
+type schemaViolation struct {
+	// Path is a JSON pointer to the violating value.
+	Path    string
+	Message string
+}
+
+func (v *schemaViolation) Error() string {
+	return fmt.Sprintf("%s: %s", v.Path, v.Message)
+}
+
+// Validate checks a request payload against the schema. An empty payload is validated as an empty object.
+func (s *requestSchema) Validate(payload json.RawMessage) error {
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return &schemaViolation{Path: "/", Message: "payload is not valid JSON"}
+	}
+	return s.validate("", value)
+}
+
+func (s *requestSchema) validate(path string, value any) error {
+	violation := func(format string, args ...any) error {
+		if path == "" {
+			path = "/"
+		}
+		return &schemaViolation{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+	if s.Type != "" && !hasSchemaType(value, s.Type) {
+		return violation("expected %s", s.Type)
+	}
+	if len(s.Enum) > 0 && !inSchemaEnum(value, s.Enum) {
+		return violation("value is not one of the allowed values")
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return violation("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propertyPath := path + "/" + escapeJSONPointer(name)
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return &schemaViolation{Path: propertyPath, Message: "property is not allowed"}
+				}
+				continue
+			}
+			if err := property.validate(propertyPath, v[name]); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return violation("more than %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(path+"/"+strconv.Itoa(i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			return violation("shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return violation("longer than %d characters", *s.MaxLength)
+		}
+	case json.Number:
+		number, err := v.Float64()
+		if err != nil {
+			return violation("invalid number")
+		}
+		if s.Minimum != nil && number < *s.Minimum {
+			return violation("less than %v", *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			return violation("greater than %v", *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func hasSchemaType(value any, schemaType string) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		return schemaType == "object"
+	case []any:
+		return schemaType == "array"
+	case string:
+		return schemaType == "string"
+	case bool:
+		return schemaType == "boolean"
+	case nil:
+		return schemaType == "null"
+	case json.Number:
+		if schemaType == "number" {
+			return true
+		}
+		if schemaType != "integer" {
+			return false
+		}
+		if _, err := v.Int64(); err == nil {
+			return true
+		}
+		number, err := v.Float64()
+		return err == nil && number == math.Trunc(number)
+	}
+	return false
+}
+
+func inSchemaEnum(value any, enum []any) bool {
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range enum {
+		if allowedJson, err := json.Marshal(allowed); err == nil && bytes.Equal(valueJson, allowedJson) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeJSONPointer escapes a property name for use in a JSON pointer (RFC 6901).
+func escapeJSONPointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// NewSchemaPayloadFormatEnforcer returns a PayloadFormatEnforcer accepting JSON payloads that match schema,
+// which supports the same subset of JSON Schema as request schemas.
+func NewSchemaPayloadFormatEnforcer(schema json.RawMessage) (PayloadFormatEnforcer, error) {
+	parsed, err := parseRequestSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &schemaPayloadFormatEnforcer{schema: parsed}, nil
+}
+
+type schemaPayloadFormatEnforcer struct {
+	schema *requestSchema
+}
+
+func (e *schemaPayloadFormatEnforcer) CheckPayloadFormat(payload []byte) error {
+	if !json.Valid(payload) {
+		return errors.New("payload is not valid JSON")
+	}
+	return e.schema.Validate(payload)
+}
@@ -0,0 +1,161 @@
+package functions
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+// responseCache remembers responses by (sender, MessageId), so that retried requests are answered
+// without being processed again. Requests carrying an idempotency key are remembered by (sender, key)
+// instead, so that retries with a new MessageId (e.g. after a reconnect) are deduplicated too.
+// A MessageId or key reused for a different request is detected by comparing request hashes.
+// Entries are evicted in LRU order and expire after a short TTL.
+// All methods are thread-safe.
+type responseCache struct {
+	maxEntries int
+	ttl        time.Duration
+	clock      utils.Clock
+	mu         sync.Mutex
+	lru        *list.List
+	entries    map[responseCacheKey]*list.Element
+}
+
+type responseCacheKey struct {
+	sender common.Address
+	// id is the idempotency key of the request if it has one, its MessageId otherwise.
+	id         string
+	idempotent bool
+}
+
+type responseCacheEntry struct {
+	key         responseCacheKey
+	requestHash common.Hash
+	response    *api.Message
+	expiresAt   time.Time
+}
+
+func newResponseCache(maxEntries int, ttl time.Duration, clock utils.Clock) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		clock:      clock,
+		lru:        list.New(),
+		entries:    make(map[responseCacheKey]*list.Element),
+	}
+}
+
+// Get returns the cached response to an earlier request with the same sender and MessageId (or idempotency key), if any.
+// The sender must be verified, as opposed to the claimed request.Sender. The response carries the MessageId
+// of the earlier request. reused is set when that earlier request had a different method or payload.
+func (c *responseCache) Get(sender common.Address, request *api.MessageBody) (response *api.Message, reused bool) {
+	key := responseCacheKeyOf(sender, request)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*responseCacheEntry)
+	if !c.clock.Now().Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	if entry.requestHash != requestHash(request) {
+		return nil, true
+	}
+	c.lru.MoveToFront(elem)
+	return entry.response, false
+}
+
+// Put caches the response to a request. The first response to a (sender, MessageId) or (sender, key) pair
+// is kept until it expires, so that rejections of reused IDs don't replace it.
+func (c *responseCache) Put(sender common.Address, request *api.MessageBody, response *api.Message) {
+	key := responseCacheKeyOf(sender, request)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		if c.clock.Now().Before(elem.Value.(*responseCacheEntry).expiresAt) {
+			return
+		}
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&responseCacheEntry{
+		key:         key,
+		requestHash: requestHash(request),
+		response:    response,
+		expiresAt:   c.clock.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+// Snapshot returns the entries that haven't expired, least recently used first.
+func (c *responseCache) Snapshot() []CachedResponse {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]CachedResponse, 0, c.lru.Len())
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*responseCacheEntry)
+		if !now.Before(entry.expiresAt) {
+			continue
+		}
+		entries = append(entries, CachedResponse{
+			Sender:      entry.key.sender,
+			Id:          entry.key.id,
+			Idempotent:  entry.key.idempotent,
+			RequestHash: entry.requestHash,
+			Response:    entry.response,
+			ExpiresAt:   entry.expiresAt.UnixMilli(),
+		})
+	}
+	return entries
+}
+
+// Restore adds entries from a snapshot that haven't expired yet. Entries already in the cache are kept.
+func (c *responseCache) Restore(entries []CachedResponse) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cached := range entries {
+		expiresAt := time.UnixMilli(cached.ExpiresAt)
+		key := responseCacheKey{sender: cached.Sender, id: cached.Id, idempotent: cached.Idempotent}
+		if _, ok := c.entries[key]; ok || !now.Before(expiresAt) || cached.Response == nil {
+			continue
+		}
+		c.entries[key] = c.lru.PushFront(&responseCacheEntry{
+			key:         key,
+			requestHash: cached.RequestHash,
+			response:    cached.Response,
+			expiresAt:   expiresAt,
+		})
+	}
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+func responseCacheKeyOf(sender common.Address, request *api.MessageBody) responseCacheKey {
+	key := responseCacheKey{sender: sender, id: request.MessageId}
+	if idempotencyKey := requestIdempotencyKey(request.Payload); idempotencyKey != "" {
+		key.id, key.idempotent = idempotencyKey, true
+	}
+	return key
+}
+
+func requestHash(request *api.MessageBody) common.Hash {
+	return crypto.Keccak256Hash([]byte(request.Method), []byte{0}, []byte(request.DonId), []byte{0}, request.Payload)
+}
@@ -0,0 +1,100 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+)
+
+// retryingStorage retries storage calls failing with retryable errors (see isRetryableStorageError)
+// up to maxRetries times, waiting delay between attempts.
+type retryingStorage struct {
+	s4.Storage
+	maxRetries uint32
+	delay      time.Duration
+	lggr       logger.Logger
+}
+
+var _ s4.Storage = &retryingStorage{}
+
+func newRetryingStorage(storage s4.Storage, maxRetries uint32, delay time.Duration, lggr logger.Logger) *retryingStorage {
+	return &retryingStorage{
+		Storage:    storage,
+		maxRetries: maxRetries,
+		delay:      delay,
+		lggr:       lggr,
+	}
+}
+
+func (s *retryingStorage) Get(ctx context.Context, key *s4.Key) (record *s4.Record, metadata *s4.Metadata, err error) {
+	err = s.retry(ctx, "Get", func() error {
+		record, metadata, err = s.Storage.Get(ctx, key)
+		return err
+	})
+	return
+}
+
+func (s *retryingStorage) GetIncludingExpired(ctx context.Context, key *s4.Key) (record *s4.Record, metadata *s4.Metadata, err error) {
+	err = s.retry(ctx, "GetIncludingExpired", func() error {
+		record, metadata, err = s.Storage.GetIncludingExpired(ctx, key)
+		return err
+	})
+	return
+}
+
+// Put retries are not idempotent: if a failed attempt was in fact persisted, the retry fails with ErrVersionTooLow.
+func (s *retryingStorage) Put(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+	return s.retry(ctx, "Put", func() error {
+		return s.Storage.Put(ctx, key, record, signature)
+	})
+}
+
+func (s *retryingStorage) List(ctx context.Context, address common.Address) (rows []*s4.SnapshotRow, err error) {
+	err = s.retry(ctx, "List", func() error {
+		rows, err = s.Storage.List(ctx, address)
+		return err
+	})
+	return
+}
+
+func (s *retryingStorage) retry(ctx context.Context, op string, call func() error) error {
+	err := call()
+	for attempt := uint32(1); attempt <= s.maxRetries && isRetryableStorageError(err); attempt++ {
+		s.lggr.Debugw("retrying storage call", "op", op, "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(s.delay):
+		}
+		err = call()
+	}
+	return err
+}
+
+// isRetryableStorageError reports whether err may be caused by a transient backend issue.
+// S4 validation errors and cancellations are permanent, anything else (e.g. a dropped database connection) is not.
+func isRetryableStorageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, permanent := range []error{
+		s4.ErrNotFound,
+		s4.ErrWrongSignature,
+		s4.ErrSlotIdTooBig,
+		s4.ErrPayloadTooBig,
+		s4.ErrPastExpiration,
+		s4.ErrVersionTooLow,
+		context.Canceled,
+		context.DeadlineExceeded,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
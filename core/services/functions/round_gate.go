@@ -0,0 +1,19 @@
+package functions
+
+import "time"
+
+// NewPeriodicRoundGate returns a RoundGate for DONs working in rounds of period, starting at multiples of period
+// since the unix epoch. Writes within guard of a round boundary are rejected.
+func NewPeriodicRoundGate(period time.Duration, guard time.Duration) RoundGate {
+	return &periodicRoundGate{period: period, guard: guard}
+}
+
+type periodicRoundGate struct {
+	period time.Duration
+	guard  time.Duration
+}
+
+func (g *periodicRoundGate) AcceptsWrites(now time.Time) bool {
+	sinceRoundStart := time.Duration(now.UnixNano() % int64(g.period))
+	return sinceRoundStart >= g.guard && sinceRoundStart < g.period-g.guard
+}
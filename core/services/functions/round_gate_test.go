@@ -0,0 +1,22 @@
+package functions_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+)
+
+func TestPeriodicRoundGate(t *testing.T) {
+	t.Parallel()
+
+	gate := functions.NewPeriodicRoundGate(time.Minute, 5*time.Second)
+	roundStart := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.False(t, gate.AcceptsWrites(roundStart))
+	require.False(t, gate.AcceptsWrites(roundStart.Add(5*time.Second-time.Nanosecond)))
+	require.True(t, gate.AcceptsWrites(roundStart.Add(5*time.Second)))
+	require.True(t, gate.AcceptsWrites(roundStart.Add(55*time.Second-time.Nanosecond)))
+	require.False(t, gate.AcceptsWrites(roundStart.Add(55*time.Second)))
+}
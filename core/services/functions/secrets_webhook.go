@@ -0,0 +1,43 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+)
+
+type secretsChangedNotification struct {
+	Address string `json:"address"`
+	SlotID  uint   `json:"slot_id"`
+	Version uint64 `json:"version"`
+	Action  string `json:"action"`
+}
+
+// NewSecretsChangedWebhook returns a SecretsChangedCallback posting each change as JSON to url.
+// Responses with a non-2xx status are reported as errors.
+func NewSecretsChangedWebhook(url string, client *http.Client) SecretsChangedCallback {
+	return func(ctx context.Context, address ethCommon.Address, slotId uint, version uint64, action string) error {
+		body, err := json.Marshal(secretsChangedNotification{Address: address.Hex(), SlotID: slotId, Version: version, Action: action})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,28 @@
+package functions_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+)
+
+func TestSecretsChangedWebhook(t *testing.T) {
+	t.Parallel()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	webhook := functions.NewSecretsChangedWebhook(server.URL, server.Client())
+
+	ctx := testutils.Context(t)
+	require.NoError(t, webhook(ctx, testutils.NewAddress(), 1, 2, functions.SecretsActionSet))
+	status = http.StatusServiceUnavailable
+	require.EqualError(t, webhook(ctx, testutils.NewAddress(), 1, 2, functions.SecretsActionSet), "webhook responded with status 503")
+}
@@ -0,0 +1,95 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+// cooldownStorage counts consecutive timed out writes per owner address.
+// Once an owner reaches threshold timeouts, CooldownRemaining reports a cooldown for them,
+// during which the handler rejects their writes. A successful write resets the count.
+// All methods are thread-safe.
+type cooldownStorage struct {
+	s4.Storage
+	threshold uint32
+	cooldown  time.Duration
+	clock     utils.Clock
+	lggr      logger.Logger
+
+	mu      sync.Mutex
+	senders map[common.Address]*senderTimeouts
+}
+
+type senderTimeouts struct {
+	count         uint32
+	cooldownUntil time.Time
+}
+
+var _ s4.Storage = &cooldownStorage{}
+
+func newCooldownStorage(storage s4.Storage, threshold uint32, cooldown time.Duration, clock utils.Clock, lggr logger.Logger) *cooldownStorage {
+	return &cooldownStorage{
+		Storage:   storage,
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clock,
+		lggr:      lggr,
+		senders:   make(map[common.Address]*senderTimeouts),
+	}
+}
+
+// CooldownRemaining returns how long writes of the given address are still rejected, or zero.
+func (s *cooldownStorage) CooldownRemaining(address common.Address) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.senders[address]
+	if !ok {
+		return 0
+	}
+	remaining := state.cooldownUntil.Sub(s.clock.Now())
+	if remaining <= 0 {
+		if state.count == 0 {
+			delete(s.senders, address)
+		}
+		return 0
+	}
+	return remaining
+}
+
+func (s *cooldownStorage) Put(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+	err := s.Storage.Put(ctx, key, record, signature)
+	s.record(key.Address, err)
+	return err
+}
+
+func (s *cooldownStorage) record(address common.Address, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		if err == nil {
+			if state, ok := s.senders[address]; ok {
+				state.count = 0
+			}
+		}
+		return
+	}
+	state, ok := s.senders[address]
+	if !ok {
+		state = &senderTimeouts{}
+		s.senders[address] = state
+	}
+	state.count++
+	if state.count >= s.threshold {
+		state.count = 0
+		state.cooldownUntil = s.clock.Now().Add(s.cooldown)
+		s.lggr.Warnw("too many storage timeouts, cooling down sender", "address", address, "cooldown", s.cooldown)
+	}
+}
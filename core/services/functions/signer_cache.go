@@ -0,0 +1,89 @@
+package functions
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+// SignerCache remembers signers recovered from recently verified (envelope, signature) pairs,
+// so that identical retries skip the expensive signature recovery.
+// Entries are evicted in LRU order and expire after a short TTL.
+// All methods are thread-safe.
+type SignerCache struct {
+	maxEntries int
+	ttl        time.Duration
+	clock      utils.Clock
+	mu         sync.Mutex
+	lru        *list.List
+	entries    map[common.Hash]*list.Element
+	hits       atomic.Uint64
+}
+
+type signerCacheEntry struct {
+	key       common.Hash
+	signer    common.Address
+	expiresAt time.Time
+}
+
+func NewSignerCache(maxEntries int, ttl time.Duration, clock utils.Clock) *SignerCache {
+	return &SignerCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		clock:      clock,
+		lru:        list.New(),
+		entries:    make(map[common.Hash]*list.Element),
+	}
+}
+
+// GetSignerAddress works like s4.Envelope.GetSignerAddress. Failed verifications are never cached.
+func (c *SignerCache) GetSignerAddress(envelope *s4.Envelope, signature []byte) (common.Address, error) {
+	js, err := envelope.ToJson()
+	if err != nil {
+		return common.Address{}, err
+	}
+	key := crypto.Keccak256Hash(js, signature)
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*signerCacheEntry)
+		if c.clock.Now().Before(entry.expiresAt) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return entry.signer, nil
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	signer, err := envelope.GetSignerAddress(signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&signerCacheEntry{key: key, signer: signer, expiresAt: c.clock.Now().Add(c.ttl)})
+		for c.lru.Len() > c.maxEntries {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*signerCacheEntry).key)
+		}
+	}
+	return signer, nil
+}
+
+// Hits returns the number of signature recoveries served from cache.
+func (c *SignerCache) Hits() uint64 {
+	return c.hits.Load()
+}
@@ -0,0 +1,78 @@
+package functions_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+)
+
+func TestSignerCache(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	cache := functions.NewSignerCache(2, time.Minute, clock)
+	privateKey, addr := testutils.NewPrivateKeyAndAddress(t)
+	key := s4.Key{Address: addr, SlotId: 1, Version: 1}
+	envelope := s4.NewEnvelopeFromRecord(&key, &s4.Record{Payload: []byte("test"), Expiration: 1000})
+	signature, err := envelope.Sign(privateKey)
+	require.NoError(t, err)
+
+	t.Run("repeated signature is served from cache", func(t *testing.T) {
+		signer, err := cache.GetSignerAddress(envelope, signature)
+		require.NoError(t, err)
+		require.Equal(t, addr, signer)
+		require.Equal(t, uint64(0), cache.Hits())
+
+		signer, err = cache.GetSignerAddress(envelope, signature)
+		require.NoError(t, err)
+		require.Equal(t, addr, signer)
+		require.Equal(t, uint64(1), cache.Hits())
+	})
+
+	t.Run("tampered payload with cached signature", func(t *testing.T) {
+		tampered := *envelope
+		tampered.Payload = []byte("evil")
+		signer, err := cache.GetSignerAddress(&tampered, signature)
+		if err == nil {
+			require.NotEqual(t, addr, signer)
+		}
+		require.Equal(t, uint64(1), cache.Hits())
+	})
+
+	t.Run("entries expire", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		signer, err := cache.GetSignerAddress(envelope, signature)
+		require.NoError(t, err)
+		require.Equal(t, addr, signer)
+		require.Equal(t, uint64(1), cache.Hits())
+	})
+
+	t.Run("least recently used entry is evicted", func(t *testing.T) {
+		cache := functions.NewSignerCache(1, time.Minute, clock)
+		other := s4.NewEnvelopeFromRecord(&s4.Key{Address: addr, SlotId: 2}, &s4.Record{Payload: []byte("test"), Expiration: 1000})
+		otherSignature, err := other.Sign(privateKey)
+		require.NoError(t, err)
+
+		_, err = cache.GetSignerAddress(envelope, signature)
+		require.NoError(t, err)
+		_, err = cache.GetSignerAddress(other, otherSignature)
+		require.NoError(t, err)
+		_, err = cache.GetSignerAddress(envelope, signature)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), cache.Hits())
+	})
+
+	t.Run("invalid signature is not cached", func(t *testing.T) {
+		cache := functions.NewSignerCache(1, time.Minute, clock)
+		for i := 0; i < 2; i++ {
+			_, err := cache.GetSignerAddress(envelope, []byte{1, 2, 3})
+			require.Error(t, err)
+		}
+		require.Equal(t, uint64(0), cache.Hits())
+	})
+}
@@ -0,0 +1,53 @@
+package functions
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type slotLockKey struct {
+	address common.Address
+	slotID  uint
+}
+
+type slotLock struct {
+	sync.Mutex
+	// refs counts writes holding or waiting for the lock, guarded by slotLocks.mu.
+	refs int
+}
+
+// slotLocks serializes writes to the same slot of a sender. A lock is dropped as soon as no write
+// holds or waits for it, so the map only grows with the number of concurrently written slots.
+type slotLocks struct {
+	mu    sync.Mutex
+	locks map[slotLockKey]*slotLock
+}
+
+func newSlotLocks() *slotLocks {
+	return &slotLocks{locks: make(map[slotLockKey]*slotLock)}
+}
+
+// Lock blocks until the slot is free and returns the function releasing it.
+func (l *slotLocks) Lock(address common.Address, slotID uint) (unlock func()) {
+	key := slotLockKey{address: address, slotID: slotID}
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &slotLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
+)
+
+var errStorageUnavailable = errors.New("storage is unavailable")
+
+// circuitBreakerStorage stops calling a persistently failing storage backend.
+// After threshold consecutive retryable failures (see isRetryableStorageError) the breaker opens
+// and calls fail fast with errStorageUnavailable. Once cooldown has passed, calls are let through
+// again to probe the backend: a success closes the breaker, a failure re-opens it for another cooldown.
+// All methods are thread-safe.
+type circuitBreakerStorage struct {
+	s4.Storage
+	threshold uint32
+	cooldown  time.Duration
+	clock     utils.Clock
+	lggr      logger.Logger
+
+	mu       sync.Mutex
+	failures uint32
+	openedAt time.Time
+}
+
+var _ s4.Storage = &circuitBreakerStorage{}
+
+func newCircuitBreakerStorage(storage s4.Storage, threshold uint32, cooldown time.Duration, clock utils.Clock, lggr logger.Logger) *circuitBreakerStorage {
+	return &circuitBreakerStorage{
+		Storage:   storage,
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     clock,
+		lggr:      lggr,
+	}
+}
+
+// IsOpen reports whether calls currently fail fast.
+func (s *circuitBreakerStorage) IsOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isOpen()
+}
+
+func (s *circuitBreakerStorage) isOpen() bool {
+	return s.failures >= s.threshold && s.clock.Now().Before(s.openedAt.Add(s.cooldown))
+}
+
+func (s *circuitBreakerStorage) Get(ctx context.Context, key *s4.Key) (record *s4.Record, metadata *s4.Metadata, err error) {
+	err = s.call(func() error {
+		record, metadata, err = s.Storage.Get(ctx, key)
+		return err
+	})
+	return
+}
+
+func (s *circuitBreakerStorage) GetIncludingExpired(ctx context.Context, key *s4.Key) (record *s4.Record, metadata *s4.Metadata, err error) {
+	err = s.call(func() error {
+		record, metadata, err = s.Storage.GetIncludingExpired(ctx, key)
+		return err
+	})
+	return
+}
+
+func (s *circuitBreakerStorage) Put(ctx context.Context, key *s4.Key, record *s4.Record, signature []byte) error {
+	return s.call(func() error {
+		return s.Storage.Put(ctx, key, record, signature)
+	})
+}
+
+func (s *circuitBreakerStorage) List(ctx context.Context, address common.Address) (rows []*s4.SnapshotRow, err error) {
+	err = s.call(func() error {
+		rows, err = s.Storage.List(ctx, address)
+		return err
+	})
+	return
+}
+
+func (s *circuitBreakerStorage) call(call func() error) error {
+	if s.IsOpen() {
+		return errStorageUnavailable
+	}
+	err := call()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !isRetryableStorageError(err) {
+		if s.failures >= s.threshold {
+			s.lggr.Infow("storage recovered, closing circuit breaker")
+		}
+		s.failures = 0
+		return err
+	}
+	s.failures++
+	if s.failures >= s.threshold {
+		if s.failures == s.threshold {
+			s.lggr.Errorw("storage keeps failing, opening circuit breaker", "failures", s.failures, "cooldown", s.cooldown, "err", err)
+		}
+		s.openedAt = s.clock.Now()
+	}
+	return err
+}
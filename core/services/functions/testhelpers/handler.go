@@ -0,0 +1,232 @@
+package testhelpers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/connector"
+	gwfunctions "github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions/config"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+)
+
+const TestDonId = "fun_test"
+
+var TestConstraints = s4.Constraints{
+	MaxPayloadSizeBytes: 1024,
+	MaxSlotsPerUser:     5,
+}
+
+// Handles give tests access to in-memory dependencies of a handler created with NewTestHandler.
+type Handles struct {
+	t          *testing.T
+	PrivateKey *ecdsa.PrivateKey
+	// Address is the node address. It is also allowlisted and used as the sender of NewMessage.
+	Address   common.Address
+	Connector *FakeConnector
+	Storage   s4.Storage
+	// ORM backs Storage, e.g. to simulate S4 garbage collection.
+	ORM       s4.ORM
+	Allowlist *FakeAllowlist
+	Clock     *FakeClock
+}
+
+// NewTestHandler starts a connector handler wired to in-memory stubs.
+// The handler is closed when the test finishes.
+func NewTestHandler(t *testing.T, handlerConfig config.ConnectorHandlerConfig, opts ...functions.ConnectorHandlerOpt) (connector.GatewayConnectorHandler, *Handles) {
+	t.Helper()
+	privateKey, address := testutils.NewPrivateKeyAndAddress(t)
+	clock := NewFakeClock(time.Now())
+	orm := s4.NewInMemoryORM()
+	handles := &Handles{
+		t:          t,
+		PrivateKey: privateKey,
+		Address:    address,
+		Connector:  &FakeConnector{},
+		Storage:    s4.NewStorage(logger.TestLogger(t), TestConstraints, orm, clock),
+		ORM:        orm,
+		Allowlist:  NewFakeAllowlist(address),
+		Clock:      clock,
+	}
+	handler, err := functions.NewFunctionsConnectorHandler(address.Hex(), privateKey, handles.Storage, handles.Allowlist, handlerConfig, clock, logger.TestLogger(t), opts...)
+	require.NoError(t, err)
+	handler.SetConnector(handles.Connector)
+	require.NoError(t, handler.Start(testutils.Context(t)))
+	t.Cleanup(func() { require.NoError(t, handler.Close()) })
+	return handler, handles
+}
+
+// NewMessage returns a request from Address, signed with PrivateKey.
+func (h *Handles) NewMessage(method string, payload string) *api.Message {
+	msg := &api.Message{
+		Body: api.MessageBody{
+			MessageId: "1",
+			DonId:     TestDonId,
+			Method:    method,
+			Sender:    h.Address.Hex(),
+		},
+	}
+	if payload != "" {
+		msg.Body.Payload = json.RawMessage(payload)
+	}
+	require.NoError(h.t, msg.Sign(h.PrivateKey))
+	return msg
+}
+
+// SignRecord returns the owner's signature over a record, as expected by secrets_set.
+func (h *Handles) SignRecord(key *s4.Key, record *s4.Record) []byte {
+	signature, err := s4.NewEnvelopeFromRecord(key, record).Sign(h.PrivateKey)
+	require.NoError(h.t, err)
+	return signature
+}
+
+// FakeConnector collects messages sent to gateways. It reports all gateways as connected
+// over a secure transport unless marked with SetInsecure.
+type FakeConnector struct {
+	mu       sync.Mutex
+	sent     []*api.Message
+	insecure map[string]struct{}
+}
+
+var (
+	_ connector.GatewayConnector          = &FakeConnector{}
+	_ connector.TransportSecurityReporter = &FakeConnector{}
+)
+
+func (c *FakeConnector) Start(context.Context) error { return nil }
+
+func (c *FakeConnector) Close() error { return nil }
+
+func (c *FakeConnector) NewAuthHeader(*url.URL) ([]byte, error) { return nil, nil }
+
+func (c *FakeConnector) ChallengeResponse([]byte) ([]byte, error) { return nil, nil }
+
+func (c *FakeConnector) SendToGateway(_ context.Context, _ string, msg *api.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+// SetInsecure makes the connector report the gateway as connected over an insecure transport.
+func (c *FakeConnector) SetInsecure(gatewayId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.insecure == nil {
+		c.insecure = make(map[string]struct{})
+	}
+	c.insecure[gatewayId] = struct{}{}
+}
+
+func (c *FakeConnector) IsSecureTransport(gatewayId string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, insecure := c.insecure[gatewayId]
+	return !insecure
+}
+
+// Responses returns all messages sent so far.
+func (c *FakeConnector) Responses() []*api.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*api.Message(nil), c.sent...)
+}
+
+// LastResponsePayload returns the payload of the most recent response, or an empty string if nothing was sent.
+func (c *FakeConnector) LastResponsePayload() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sent) == 0 {
+		return ""
+	}
+	return string(c.sent[len(c.sent)-1].Body.Payload)
+}
+
+// FakeAllowlist allows a mutable set of addresses. Every change bumps the version.
+type FakeAllowlist struct {
+	mu      sync.Mutex
+	allowed map[common.Address]struct{}
+	version uint64
+}
+
+var _ gwfunctions.OnchainAllowlist = &FakeAllowlist{}
+
+func NewFakeAllowlist(addresses ...common.Address) *FakeAllowlist {
+	a := &FakeAllowlist{allowed: make(map[common.Address]struct{})}
+	for _, address := range addresses {
+		a.allowed[address] = struct{}{}
+	}
+	return a
+}
+
+func (a *FakeAllowlist) Start(context.Context) error { return nil }
+
+func (a *FakeAllowlist) Close() error { return nil }
+
+func (a *FakeAllowlist) UpdateFromContract(context.Context) error { return nil }
+
+func (a *FakeAllowlist) Allow(address common.Address) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.allowed[address]
+	return ok
+}
+
+func (a *FakeAllowlist) Version() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.version
+}
+
+// LastUpdated returns a fixed time, the fake allowlist is always loaded.
+func (a *FakeAllowlist) LastUpdated() time.Time {
+	return time.Unix(1, 0)
+}
+
+func (a *FakeAllowlist) Add(address common.Address) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowed[address] = struct{}{}
+	a.version++
+}
+
+func (a *FakeAllowlist) Remove(address common.Address) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allowed, address)
+	a.version++
+}
+
+// FakeClock only moves when advanced.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,67 @@
+package testhelpers_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions/testhelpers"
+	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions/config"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
+)
+
+func TestNewTestHandler_SetAndList(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+
+	key := s4.Key{Address: handles.Address, SlotId: 1, Version: 1}
+	record := s4.Record{Payload: []byte("test"), Expiration: handles.Clock.Now().Add(time.Hour).UnixMilli()}
+	signature := handles.SignRecord(&key, &record)
+	payload := fmt.Sprintf(`{"slot_id":1,"version":1,"expiration":%d,"payload":"dGVzdA==","signature":"%s"}`, record.Expiration, base64.StdEncoding.EncodeToString(signature))
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_set", payload))
+	require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+
+	stored, _, err := handles.Storage.Get(ctx, &key)
+	require.NoError(t, err)
+	require.Equal(t, record.Payload, stored.Payload)
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Contains(t, handles.Connector.LastResponsePayload(), `"rows":[{"slot_id":1,"version":1`)
+	require.Len(t, handles.Connector.Responses(), 2)
+}
+
+func TestNewTestHandler_Allowlist(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{})
+
+	handles.Allowlist.Remove(handles.Address)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Empty(t, handles.Connector.Responses())
+
+	handles.Allowlist.Add(handles.Address)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+}
+
+func TestNewTestHandler_Clock(t *testing.T) {
+	t.Parallel()
+
+	ctx := testutils.Context(t)
+	handler, handles := testhelpers.NewTestHandler(t, config.ConnectorHandlerConfig{MaxDailyRequestsPerSender: 1})
+
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Contains(t, handles.Connector.LastResponsePayload(), "DAILY_QUOTA_EXCEEDED")
+
+	handles.Clock.Advance(24 * time.Hour)
+	handler.HandleGatewayMessage(ctx, "gw1", handles.NewMessage("secrets_list", ""))
+	require.Equal(t, `{"success":true}`, handles.Connector.LastResponsePayload())
+}
@@ -0,0 +1,45 @@
+package functions
+
+import (
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	gwcommon "github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+)
+
+// Tombstone proves that a secret was intentionally deleted by its owner.
+//
+// A deleted secret is stored in S4 as a record with an empty payload (signed by the owner, like any
+// other record), so deletions replicate across the DON and are garbage-collected by S4 once the
+// record expires. Nodes attach their own signature over the Tombstone fields to list responses.
+type Tombstone struct {
+	Address common.Address
+	SlotID  uint
+	Version uint64
+	// DeletedAt is a unix timestamp in milliseconds.
+	DeletedAt int64
+}
+
+func (t Tombstone) Sign(signer func(data ...[]byte) ([]byte, error)) ([]byte, error) {
+	return signer(t.signedData()...)
+}
+
+// GetSignerAddress returns the address of the node that signed the tombstone.
+func (t Tombstone) GetSignerAddress(signature []byte) (common.Address, error) {
+	signer, err := gwcommon.ExtractSigner(signature, t.signedData()...)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return common.BytesToAddress(signer), nil
+}
+
+func (t Tombstone) signedData() [][]byte {
+	slotID := make([]byte, 8)
+	binary.BigEndian.PutUint64(slotID, uint64(t.SlotID))
+	version := make([]byte, 8)
+	binary.BigEndian.PutUint64(version, t.Version)
+	deletedAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(deletedAt, uint64(t.DeletedAt))
+	return [][]byte{[]byte("tombstone"), t.Address.Bytes(), slotID, version, deletedAt}
+}
@@ -0,0 +1,31 @@
+package functions_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
+)
+
+func TestTombstone_SignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	privateKey, address := testutils.NewPrivateKeyAndAddress(t)
+	tombstone := functions.Tombstone{Address: testutils.NewAddress(), SlotID: 2, Version: 3, DeletedAt: 1000}
+	signature, err := tombstone.Sign(func(data ...[]byte) ([]byte, error) {
+		return common.SignData(privateKey, data...)
+	})
+	require.NoError(t, err)
+
+	signer, err := tombstone.GetSignerAddress(signature)
+	require.NoError(t, err)
+	require.Equal(t, address, signer)
+
+	tombstone.DeletedAt++
+	signer, err = tombstone.GetSignerAddress(signature)
+	require.NoError(t, err)
+	require.NotEqual(t, address, signer)
+}
@@ -0,0 +1,63 @@
+package functions
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type writeBarrier struct {
+	sync.RWMutex
+	// refs counts writes and flushes holding or waiting for the barrier, guarded by writeBarriers.mu.
+	refs int
+}
+
+// writeBarriers lets a flush wait for the writes of its sender that are in flight, without waiting
+// for other senders. A barrier is dropped as soon as nobody holds or waits for it.
+type writeBarriers struct {
+	mu       sync.Mutex
+	barriers map[common.Address]*writeBarrier
+}
+
+func newWriteBarriers() *writeBarriers {
+	return &writeBarriers{barriers: make(map[common.Address]*writeBarrier)}
+}
+
+// Enter registers a write of the address and returns the function marking it as done.
+func (b *writeBarriers) Enter(address common.Address) (done func()) {
+	barrier := b.acquire(address)
+	barrier.RLock()
+	return func() {
+		barrier.RUnlock()
+		b.release(address, barrier)
+	}
+}
+
+// Wait blocks until all writes of the address registered before the call are done.
+func (b *writeBarriers) Wait(address common.Address) {
+	barrier := b.acquire(address)
+	barrier.Lock()
+	barrier.Unlock() //nolint:staticcheck // the empty critical section is the barrier
+	b.release(address, barrier)
+}
+
+func (b *writeBarriers) acquire(address common.Address) *writeBarrier {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	barrier, ok := b.barriers[address]
+	if !ok {
+		barrier = &writeBarrier{}
+		b.barriers[address] = barrier
+	}
+	barrier.refs++
+	return barrier
+}
+
+func (b *writeBarriers) release(address common.Address, barrier *writeBarrier) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	barrier.refs--
+	if barrier.refs == 0 {
+		delete(b.barriers, address)
+	}
+}
@@ -43,12 +43,26 @@ type MessageBody struct {
 }
 
 func (m *Message) Validate() error {
-	if m == nil {
-		return errors.New("nil message")
+	if err := m.ValidateUnsigned(); err != nil {
+		return err
 	}
 	if len(m.Signature) != MessageSignatureHexEncodedLen {
 		return errors.New("invalid hex-encoded signature length")
 	}
+	signerBytes, err := m.ExtractSigner()
+	if err != nil {
+		return err
+	}
+	m.Body.Sender = utils.StringToHex(string(signerBytes))
+	return nil
+}
+
+// ValidateUnsigned checks all fields except the signature. Sender is left unset,
+// so the caller must attribute the message by other means (e.g. an authenticated connection).
+func (m *Message) ValidateUnsigned() error {
+	if m == nil {
+		return errors.New("nil message")
+	}
 	if len(m.Body.MessageId) == 0 || len(m.Body.MessageId) > MessageIdMaxLen {
 		return errors.New("invalid message ID length")
 	}
@@ -61,11 +75,31 @@ func (m *Message) Validate() error {
 	if len(m.Body.Receiver) != 0 && len(m.Body.Receiver) != MessageReceiverLen {
 		return errors.New("invalid Receiver length")
 	}
-	signerBytes, err := m.ExtractSigner()
-	if err != nil {
+	return nil
+}
+
+// unsignedResponseMethods are read-only methods returning no sender-specific data, whose responses nodes
+// may send without a signature.
+var unsignedResponseMethods = map[string]struct{}{
+	"status": {},
+}
+
+// IsUnsignedResponseMethod reports whether nodes may send unsigned responses to the method.
+func IsUnsignedResponseMethod(method string) bool {
+	_, ok := unsignedResponseMethods[method]
+	return ok
+}
+
+// ValidateFromNode validates a message received over an authenticated node connection. Unsigned responses
+// to methods allowed by IsUnsignedResponseMethod are attributed to nodeAddress, all others must be signed.
+func (m *Message) ValidateFromNode(nodeAddress string) error {
+	if m == nil || m.Signature != "" || !IsUnsignedResponseMethod(m.Body.Method) {
+		return m.Validate()
+	}
+	if err := m.ValidateUnsigned(); err != nil {
 		return err
 	}
-	m.Body.Sender = utils.StringToHex(string(signerBytes))
+	m.Body.Sender = nodeAddress
 	return nil
 }
 
@@ -2,6 +2,7 @@ package api_test
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/crypto"
@@ -53,6 +54,59 @@ func TestMessage_Validate(t *testing.T) {
 	require.Error(t, msg.Validate())
 }
 
+func TestMessage_ValidateUnsigned(t *testing.T) {
+	t.Parallel()
+
+	msg := &api.Message{
+		Body: api.MessageBody{
+			MessageId: "abcd",
+			Method:    "status",
+			DonId:     "donA",
+			Payload:   []byte("datadata"),
+		},
+	}
+
+	// valid without a signature
+	require.NoError(t, msg.ValidateUnsigned())
+	require.Empty(t, msg.Body.Sender)
+	require.Error(t, msg.Validate())
+
+	// fields are still checked
+	msg.Body.DonId = ""
+	require.Error(t, msg.ValidateUnsigned())
+}
+
+func TestMessage_ValidateFromNode(t *testing.T) {
+	t.Parallel()
+
+	nodeAddress := "0x68902d681c28119f9b2531473a417088bf008e59"
+	newMessage := func(method string) *api.Message {
+		return &api.Message{
+			Body: api.MessageBody{
+				MessageId: "abcd",
+				Method:    method,
+				DonId:     "donA",
+				Payload:   []byte("datadata"),
+			},
+		}
+	}
+
+	// unsigned responses to public methods are attributed to the node
+	msg := newMessage("status")
+	require.NoError(t, msg.ValidateFromNode(nodeAddress))
+	require.Equal(t, nodeAddress, msg.Body.Sender)
+
+	// other methods must be signed
+	msg = newMessage("secrets_get")
+	require.Error(t, msg.ValidateFromNode(nodeAddress))
+
+	privateKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, msg.Sign(privateKey))
+	require.NoError(t, msg.ValidateFromNode(nodeAddress))
+	require.Equal(t, strings.ToLower(crypto.PubkeyToAddress(privateKey.PublicKey).Hex()), msg.Body.Sender)
+}
+
 func TestMessage_MessageSignAndValidateSignature(t *testing.T) {
 	t.Parallel()
 
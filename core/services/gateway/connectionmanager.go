@@ -259,7 +259,9 @@ func (m *donConnectionManager) readLoop(nodeAddress string, nodeState *nodeState
 				m.lggr.Errorw("parse error when reading from node", "nodeAddress", nodeAddress, "err", err)
 				break
 			}
-			if err = msg.Validate(); err != nil {
+			// Node connections are authenticated during the handshake, so unsigned responses
+			// to public methods are attributed to the connected node.
+			if err = msg.ValidateFromNode(nodeAddress); err != nil {
 				m.lggr.Errorw("message validation error when reading from node", "nodeAddress", nodeAddress, "err", err)
 				break
 			}
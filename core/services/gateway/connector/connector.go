@@ -36,6 +36,12 @@ type Signer interface {
 	Sign(data ...[]byte) ([]byte, error)
 }
 
+// TransportSecurityReporter is optionally implemented by a GatewayConnector to tell handlers whether
+// the link to a Gateway is secure (e.g. TLS), so that they can refuse to serve sensitive requests otherwise.
+type TransportSecurityReporter interface {
+	IsSecureTransport(gatewayId string) bool
+}
+
 // GatewayConnector user (node) implements application logic in the Handler interface.
 type GatewayConnectorHandler interface {
 	job.ServiceCtx
@@ -108,6 +114,14 @@ func NewGatewayConnector(config *ConnectorConfig, signer Signer, handler Gateway
 	return connector, nil
 }
 
+var _ TransportSecurityReporter = &gatewayConnector{}
+
+// IsSecureTransport reports whether the Gateway is connected to over TLS (a wss:// URL).
+func (c *gatewayConnector) IsSecureTransport(gatewayId string) bool {
+	gateway, ok := c.gateways[gatewayId]
+	return ok && gateway.url.Scheme == "wss"
+}
+
 func (c *gatewayConnector) SendToGateway(ctx context.Context, gatewayId string, msg *api.Message) error {
 	data, err := c.codec.EncodeResponse(msg)
 	if err != nil {
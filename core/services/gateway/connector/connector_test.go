@@ -98,6 +98,17 @@ URL = "ws://localhost:8081/node"
 	}
 }
 
+func TestGatewayConnector_IsSecureTransport(t *testing.T) {
+	t.Parallel()
+
+	gc, _, _ := newTestConnector(t, parseTOMLConfig(t, defaultConfig))
+	reporter, ok := gc.(connector.TransportSecurityReporter)
+	require.True(t, ok)
+	require.False(t, reporter.IsSecureTransport("example_gateway"))
+	require.True(t, reporter.IsSecureTransport("another_one"))
+	require.False(t, reporter.IsSecureTransport("unknown"))
+}
+
 func TestGatewayConnector_NewAuthHeader_SignerError(t *testing.T) {
 	t.Parallel()
 
@@ -26,6 +26,9 @@ type OnchainAllowlistConfig struct {
 	// UpdateFrequencySec can be zero to disable periodic updates
 	UpdateFrequencySec uint `json:"allowlistUpdateFrequencySec"`
 	UpdateTimeoutSec   uint `json:"allowlistUpdateTimeoutSec"`
+	// ContractVersion, if set, must match the contract's typeAndVersion() (e.g. "FunctionsOracle 0.0.0").
+	// Start fails otherwise, rather than decoding the allowlist with a mismatched ABI.
+	ContractVersion string `json:"allowlistContractVersion"`
 }
 
 // OnchainAllowlist maintains an allowlist of addresses fetched from the blockchain (EVM-only).
@@ -38,6 +41,11 @@ type OnchainAllowlist interface {
 
 	Allow(common.Address) bool
 	UpdateFromContract(ctx context.Context) error
+	// Version is incremented every time the set of allowed addresses changes.
+	Version() uint64
+	// LastUpdated is the time of the last successful update, zero until the allowlist was loaded
+	// (even if it was loaded empty).
+	LastUpdated() time.Time
 }
 
 type onchainAllowlist struct {
@@ -45,6 +53,8 @@ type onchainAllowlist struct {
 
 	config             OnchainAllowlistConfig
 	allowlist          atomic.Pointer[map[common.Address]struct{}]
+	version            atomic.Uint64
+	lastUpdated        atomic.Int64
 	client             evmclient.Client
 	contract           *ocr2dr_oracle.OCR2DROracle
 	blockConfirmations *big.Int
@@ -80,6 +90,11 @@ func NewOnchainAllowlist(client evmclient.Client, config OnchainAllowlistConfig,
 func (a *onchainAllowlist) Start(ctx context.Context) error {
 	return a.StartOnce("OnchainAllowlist", func() error {
 		a.lggr.Info("starting onchain allowlist")
+		if a.config.ContractVersion != "" {
+			if err := a.checkContractVersion(ctx); err != nil {
+				return err
+			}
+		}
 		if a.config.UpdateFrequencySec == 0 || a.config.UpdateTimeoutSec == 0 {
 			a.lggr.Info("OnchainAllowlist periodic updates are disabled")
 			return nil
@@ -106,6 +121,20 @@ func (a *onchainAllowlist) Start(ctx context.Context) error {
 	})
 }
 
+func (a *onchainAllowlist) checkContractVersion(ctx context.Context) error {
+	typeAndVersion, err := a.contract.TypeAndVersion(&bind.CallOpts{
+		Pending: false,
+		Context: ctx,
+	})
+	if err != nil {
+		return errors.Wrap(err, "error calling TypeAndVersion")
+	}
+	if typeAndVersion != a.config.ContractVersion {
+		return fmt.Errorf("allowlist contract %s is %q, expected %q", a.config.ContractAddress, typeAndVersion, a.config.ContractVersion)
+	}
+	return nil
+}
+
 func (a *onchainAllowlist) Close() error {
 	return a.StopOnce("OnchainAllowlist", func() (err error) {
 		a.lggr.Info("closing onchain allowlist")
@@ -121,6 +150,18 @@ func (a *onchainAllowlist) Allow(address common.Address) bool {
 	return ok
 }
 
+func (a *onchainAllowlist) Version() uint64 {
+	return a.version.Load()
+}
+
+func (a *onchainAllowlist) LastUpdated() time.Time {
+	updatedAt := a.lastUpdated.Load()
+	if updatedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, updatedAt)
+}
+
 func (a *onchainAllowlist) UpdateFromContract(ctx context.Context) error {
 	latestBlockHeight, err := a.client.LatestBlockHeight(ctx)
 	if err != nil {
@@ -142,7 +183,23 @@ func (a *onchainAllowlist) UpdateFromContract(ctx context.Context) error {
 	for _, addr := range addrList {
 		newAllowlist[addr] = struct{}{}
 	}
-	a.allowlist.Store(&newAllowlist)
+	oldAllowlist := a.allowlist.Swap(&newAllowlist)
+	if !sameMembers(*oldAllowlist, newAllowlist) {
+		a.version.Add(1)
+	}
+	a.lastUpdated.Store(time.Now().UnixNano())
 	a.lggr.Infow("allowlist updated successfully", "len", len(addrList), "blockNumber", blockNum)
 	return nil
 }
+
+func sameMembers(a, b map[common.Address]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for addr := range a {
+		if _, ok := b[addr]; !ok {
+			return false
+		}
+	}
+	return true
+}
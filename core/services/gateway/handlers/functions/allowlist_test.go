@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/onsi/gomega"
 	"github.com/stretchr/testify/assert"
@@ -62,6 +63,52 @@ func TestAllowlist_UpdateAndCheck(t *testing.T) {
 	require.False(t, allowlist.Allow(common.HexToAddress(addr3)))
 }
 
+func TestAllowlist_Version(t *testing.T) {
+	t.Parallel()
+
+	client := mocks.NewClient(t)
+	client.On("LatestBlockHeight", mock.Anything).Return(big.NewInt(42), nil)
+	client.On("CallContract", mock.Anything, mock.Anything, mock.Anything).Return(sampleEncodedAllowlist(t), nil)
+	config := functions.OnchainAllowlistConfig{
+		ContractAddress:    common.Address{},
+		BlockConfirmations: 1,
+	}
+	allowlist, err := functions.NewOnchainAllowlist(client, config, logger.TestLogger(t))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), allowlist.Version())
+
+	require.NoError(t, allowlist.UpdateFromContract(testutils.Context(t)))
+	require.Equal(t, uint64(1), allowlist.Version())
+
+	// same members, no change
+	require.NoError(t, allowlist.UpdateFromContract(testutils.Context(t)))
+	require.Equal(t, uint64(1), allowlist.Version())
+}
+
+func TestAllowlist_LastUpdated(t *testing.T) {
+	t.Parallel()
+
+	emptyAllowlist, err := hex.DecodeString(
+		"0000000000000000000000000000000000000000000000000000000000000020" +
+			"0000000000000000000000000000000000000000000000000000000000000000")
+	require.NoError(t, err)
+	client := mocks.NewClient(t)
+	client.On("LatestBlockHeight", mock.Anything).Return(big.NewInt(42), nil)
+	client.On("CallContract", mock.Anything, mock.Anything, mock.Anything).Return(emptyAllowlist, nil)
+	config := functions.OnchainAllowlistConfig{
+		ContractAddress:    common.Address{},
+		BlockConfirmations: 1,
+	}
+	allowlist, err := functions.NewOnchainAllowlist(client, config, logger.TestLogger(t))
+	require.NoError(t, err)
+	require.True(t, allowlist.LastUpdated().IsZero())
+
+	// An empty allowlist doesn't change the version, but it was loaded.
+	require.NoError(t, allowlist.UpdateFromContract(testutils.Context(t)))
+	require.Equal(t, uint64(0), allowlist.Version())
+	require.False(t, allowlist.LastUpdated().IsZero())
+}
+
 func TestAllowlist_UpdatePeriodically(t *testing.T) {
 	t.Parallel()
 
@@ -90,3 +137,34 @@ func TestAllowlist_UpdatePeriodically(t *testing.T) {
 		return allowlist.Allow(common.HexToAddress(addr1)) && !allowlist.Allow(common.HexToAddress(addr3))
 	}, testutils.WaitTimeout(t), time.Second).Should(gomega.BeTrue())
 }
+
+func TestAllowlist_ContractVersion(t *testing.T) {
+	t.Parallel()
+
+	stringType, err := abi.NewType("string", "", nil)
+	require.NoError(t, err)
+	encodedVersion, err := abi.Arguments{{Type: stringType}}.Pack("FunctionsOracle 0.0.0")
+	require.NoError(t, err)
+
+	t.Run("matching version", func(t *testing.T) {
+		client := mocks.NewClient(t)
+		client.On("CallContract", mock.Anything, mock.Anything, mock.Anything).Return(encodedVersion, nil).Once()
+		config := functions.OnchainAllowlistConfig{ContractVersion: "FunctionsOracle 0.0.0"}
+		allowlist, err := functions.NewOnchainAllowlist(client, config, logger.TestLogger(t))
+		require.NoError(t, err)
+
+		require.NoError(t, allowlist.Start(testutils.Context(t)))
+		require.NoError(t, allowlist.Close())
+	})
+
+	t.Run("mismatched version", func(t *testing.T) {
+		client := mocks.NewClient(t)
+		client.On("CallContract", mock.Anything, mock.Anything, mock.Anything).Return(encodedVersion, nil).Once()
+		config := functions.OnchainAllowlistConfig{ContractVersion: "FunctionsOracle 1.0.0"}
+		allowlist, err := functions.NewOnchainAllowlist(client, config, logger.TestLogger(t))
+		require.NoError(t, err)
+
+		err = allowlist.Start(testutils.Context(t))
+		require.EqualError(t, err, `allowlist contract 0x0000000000000000000000000000000000000000 is "FunctionsOracle 0.0.0", expected "FunctionsOracle 1.0.0"`)
+	})
+}
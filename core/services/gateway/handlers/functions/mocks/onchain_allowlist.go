@@ -8,6 +8,8 @@ import (
 	common "github.com/ethereum/go-ethereum/common"
 
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // OnchainAllowlist is an autogenerated mock type for the OnchainAllowlist type
@@ -43,6 +45,20 @@ func (_m *OnchainAllowlist) Close() error {
 	return r0
 }
 
+// LastUpdated provides a mock function with given fields:
+func (_m *OnchainAllowlist) LastUpdated() time.Time {
+	ret := _m.Called()
+
+	var r0 time.Time
+	if rf, ok := ret.Get(0).(func() time.Time); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(time.Time)
+	}
+
+	return r0
+}
+
 // Start provides a mock function with given fields: _a0
 func (_m *OnchainAllowlist) Start(_a0 context.Context) error {
 	ret := _m.Called(_a0)
@@ -71,6 +87,20 @@ func (_m *OnchainAllowlist) UpdateFromContract(ctx context.Context) error {
 	return r0
 }
 
+// Version provides a mock function with given fields:
+func (_m *OnchainAllowlist) Version() uint64 {
+	ret := _m.Called()
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func() uint64); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
 type mockConstructorTestingTNewOnchainAllowlist interface {
 	mock.TestingT
 	Cleanup(func())
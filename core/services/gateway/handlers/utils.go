@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"math"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
+
+	"github.com/smartcontractkit/chainlink/v2/core/utils"
 )
 
 type RateLimiter struct {
@@ -11,30 +15,97 @@ type RateLimiter struct {
 	perUser      map[string]*rate.Limiter
 	perUserRPS   rate.Limit
 	perUserBurst int
+	clock        utils.Clock
 	mu           sync.Mutex
 }
 
 func NewRateLimiter(globalRPS float64, globalBurst int, perUserRPS float64, perUserBurst int) *RateLimiter {
+	return NewRateLimiterWithClock(globalRPS, globalBurst, perUserRPS, perUserBurst, utils.NewRealClock())
+}
+
+// NewRateLimiterWithClock is like NewRateLimiter, but buckets refill according to clock.
+func NewRateLimiterWithClock(globalRPS float64, globalBurst int, perUserRPS float64, perUserBurst int, clock utils.Clock) *RateLimiter {
 	return &RateLimiter{
 		global:       rate.NewLimiter(rate.Limit(globalRPS), globalBurst),
 		perUser:      make(map[string]*rate.Limiter),
 		perUserRPS:   rate.Limit(perUserRPS),
 		perUserBurst: perUserBurst,
+		clock:        clock,
 	}
 }
 
 func (rl *RateLimiter) Allow(user string) bool {
-	if !rl.global.Allow() {
+	now := rl.clock.Now()
+	if !rl.global.AllowN(now, 1) {
 		return false
 	}
+	return rl.userLimiter(user).AllowN(now, 1)
+}
+
+// AllowWithRetryAfter is like Allow, but a rejected request also gets the time until the global or the user's
+// bucket has refilled enough to allow it.
+func (rl *RateLimiter) AllowWithRetryAfter(user string) (bool, time.Duration) {
+	return rl.AllowNWithRetryAfter(user, 1)
+}
+
+// AllowNWithRetryAfter is like AllowWithRetryAfter, but the request takes n tokens from both buckets. n is capped
+// at the bucket sizes, so a request heavier than a bucket empties it instead of never being allowed.
+func (rl *RateLimiter) AllowNWithRetryAfter(user string, n int) (bool, time.Duration) {
+	now := rl.clock.Now()
+	if ok, retryAfter := reserve(rl.global, now, n); !ok {
+		return false, retryAfter
+	}
+	return reserve(rl.userLimiter(user), now, n)
+}
 
+// UserTokens returns the tokens left in per-user buckets that aren't full, and the time they were counted at.
+func (rl *RateLimiter) UserTokens() (map[string]float64, time.Time) {
+	now := rl.clock.Now()
 	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	tokens := make(map[string]float64)
+	for user, limiter := range rl.perUser {
+		if left := limiter.TokensAt(now); left < float64(rl.perUserBurst) {
+			tokens[user] = left
+		}
+	}
+	return tokens, now
+}
+
+// RestoreUserTokens empties per-user buckets down to the given tokens as of time at, e.g. to carry rate limits
+// over a restart. Buckets refill from then on.
+func (rl *RateLimiter) RestoreUserTokens(tokens map[string]float64, at time.Time) {
+	for user, left := range tokens {
+		taken := int(math.Ceil(float64(rl.perUserBurst) - left))
+		if taken > rl.perUserBurst {
+			taken = rl.perUserBurst
+		}
+		if taken > 0 {
+			rl.userLimiter(user).ReserveN(at, taken)
+		}
+	}
+}
+
+func (rl *RateLimiter) userLimiter(user string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 	userLimiter, ok := rl.perUser[user]
 	if !ok {
 		userLimiter = rate.NewLimiter(rl.perUserRPS, rl.perUserBurst)
 		rl.perUser[user] = userLimiter
 	}
-	rl.mu.Unlock()
+	return userLimiter
+}
 
-	return userLimiter.Allow()
+// reserve takes n tokens if they are available. Otherwise, it returns the time until they are.
+func reserve(limiter *rate.Limiter, now time.Time, n int) (bool, time.Duration) {
+	if burst := limiter.Burst(); n > burst {
+		n = burst
+	}
+	reservation := limiter.ReserveN(now, n)
+	if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
 }
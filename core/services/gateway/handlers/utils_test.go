@@ -2,12 +2,19 @@ package handlers_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers"
 )
 
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
 func TestRateLimiter_Simple(t *testing.T) {
 	t.Parallel()
 
@@ -18,3 +25,86 @@ func TestRateLimiter_Simple(t *testing.T) {
 	require.False(t, rl.Allow("user1"))
 	require.False(t, rl.Allow("user3"))
 }
+
+func TestRateLimiter_RetryAfter(t *testing.T) {
+	t.Parallel()
+
+	rl := handlers.NewRateLimiter(100.0, 100, 0.5, 2)
+	for i := 0; i < 2; i++ {
+		allowed, retryAfter := rl.AllowWithRetryAfter("user1")
+		require.True(t, allowed)
+		require.Zero(t, retryAfter)
+	}
+	allowed, retryAfter := rl.AllowWithRetryAfter("user1")
+	require.False(t, allowed)
+	require.InDelta(t, 2*time.Second, retryAfter, float64(100*time.Millisecond))
+	// Rejected requests don't consume tokens, so the wait doesn't grow.
+	allowed, retryAfter = rl.AllowWithRetryAfter("user1")
+	require.False(t, allowed)
+	require.InDelta(t, 2*time.Second, retryAfter, float64(100*time.Millisecond))
+
+	allowed, _ = rl.AllowWithRetryAfter("user2")
+	require.True(t, allowed)
+}
+
+func TestRateLimiter_Clock(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	rl := handlers.NewRateLimiterWithClock(100.0, 100, 0.5, 1, clock)
+	require.True(t, rl.Allow("user1"))
+	allowed, retryAfter := rl.AllowWithRetryAfter("user1")
+	require.False(t, allowed)
+	require.Equal(t, 2*time.Second, retryAfter)
+
+	clock.now = clock.now.Add(time.Second)
+	allowed, retryAfter = rl.AllowWithRetryAfter("user1")
+	require.False(t, allowed)
+	require.Equal(t, time.Second, retryAfter)
+
+	clock.now = clock.now.Add(time.Second)
+	require.True(t, rl.Allow("user1"))
+}
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	rl := handlers.NewRateLimiterWithClock(100.0, 100, 1.0, 4, clock)
+	allowed, retryAfter := rl.AllowNWithRetryAfter("user1", 3)
+	require.True(t, allowed)
+	require.Zero(t, retryAfter)
+	allowed, retryAfter = rl.AllowNWithRetryAfter("user1", 3)
+	require.False(t, allowed)
+	require.Equal(t, 2*time.Second, retryAfter)
+	require.True(t, rl.Allow("user1"))
+
+	// A request heavier than the bucket takes all of it.
+	allowed, _ = rl.AllowNWithRetryAfter("user2", 10)
+	require.True(t, allowed)
+	require.False(t, rl.Allow("user2"))
+}
+
+func TestRateLimiter_RestoreUserTokens(t *testing.T) {
+	t.Parallel()
+
+	clock := &testClock{now: time.Now()}
+	rl := handlers.NewRateLimiterWithClock(100.0, 100, 1.0, 3, clock)
+	require.True(t, rl.Allow("user1"))
+	require.True(t, rl.Allow("user1"))
+	require.True(t, rl.Allow("user2"))
+	rl.Allow("user3")
+	clock.now = clock.now.Add(time.Second)
+	tokens, at := rl.UserTokens()
+	require.Equal(t, map[string]float64{"user1": 2}, tokens)
+	require.Equal(t, clock.now, at)
+
+	restored := handlers.NewRateLimiterWithClock(100.0, 100, 1.0, 3, clock)
+	restored.RestoreUserTokens(tokens, at)
+	require.True(t, restored.Allow("user1"))
+	require.True(t, restored.Allow("user1"))
+	allowed, retryAfter := restored.AllowWithRetryAfter("user1")
+	require.False(t, allowed)
+	require.Equal(t, time.Second, retryAfter)
+	require.True(t, restored.Allow("user2"))
+}
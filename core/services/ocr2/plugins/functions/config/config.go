@@ -1,9 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
+	"github.com/ethereum/go-ethereum/common"
 	"google.golang.org/protobuf/proto"
 
 	decryptionPluginConfig "github.com/smartcontractkit/tdh2/go/ocr2/decryptionplugin/config"
@@ -30,6 +32,7 @@ type PluginConfig struct {
 	OnchainAllowlist                *functions.OnchainAllowlistConfig `json:"onchainAllowlist"`
 	S4Constraints                   *s4.Constraints                   `json:"s4Constraints"`
 	GatewayConnectorConfig          *connector.ConnectorConfig        `json:"gatewayConnectorConfig"`
+	ConnectorHandlerConfig          *ConnectorHandlerConfig           `json:"connectorHandlerConfig"`
 	DecryptionQueueConfig           *DecryptionQueueConfig            `json:"decryptionQueueConfig"`
 }
 
@@ -40,6 +43,203 @@ type DecryptionQueueConfig struct {
 	CompletedCacheTimeoutSec uint32 `json:"completedCacheTimeoutSec"`
 }
 
+// DonRateLimit is the request rate limit of a single DON. A zero RPS doesn't limit the DON.
+type DonRateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst uint32  `json:"burst"`
+}
+
+// SenderQuota overrides the default quotas of a sender. Zero values keep the defaults.
+type SenderQuota struct {
+	DailyRequests uint32 `json:"dailyRequests"`
+	Slots         uint   `json:"slots"`
+}
+
+// ConnectorHandlerConfig tunes the handler serving Gateway requests (S4 secrets etc.).
+// Zero values disable the corresponding limits.
+type ConnectorHandlerConfig struct {
+	MaxDailyRequestsPerSender uint32 `json:"maxDailyRequestsPerSender"`
+	// DailyQuotaMethodWeights sets how many quota units and per-sender rate limit tokens a request consumes
+	// by method name, e.g. to make writes more expensive than reads. Methods not listed consume one unit.
+	DailyQuotaMethodWeights map[string]uint32 `json:"dailyQuotaMethodWeights"`
+	// DailyQuotaResetOffsetSec shifts the daily quota boundary away from midnight UTC.
+	DailyQuotaResetOffsetSec uint32 `json:"dailyQuotaResetOffsetSec"`
+	// MaxSlotsPerSender limits the S4 slots of senders without a custom quota (see QuotaResolver) below
+	// the S4 MaxSlotsPerUser, which stays the upper bound for all senders.
+	MaxSlotsPerSender uint `json:"maxSlotsPerSender"`
+	// SenderQuotas overrides MaxDailyRequestsPerSender and MaxSlotsPerSender for the listed sender addresses,
+	// e.g. to give partners higher limits. Daily request quotas only apply when MaxDailyRequestsPerSender is set.
+	SenderQuotas map[string]SenderQuota `json:"senderQuotas"`
+	// SenderRateLimitRPS limits the request rate of each sender with a token bucket refilling at this rate and holding
+	// up to SenderRateLimitBurst requests (at least 1). Limited requests get RATE_LIMITED with a retry_after_sec hint.
+	SenderRateLimitRPS   float64 `json:"senderRateLimitRPS"`
+	SenderRateLimitBurst uint32  `json:"senderRateLimitBurst"`
+	// DonRateLimitRPS caps the total request rate per DON ID (across all senders) with a token bucket holding up to
+	// DonRateLimitBurst requests (at least 1), so that one DON can't starve others sharing the node.
+	// DonRateLimits overrides the default for the listed DON IDs. Limited requests get DON_RATE_LIMITED.
+	DonRateLimitRPS   float64                 `json:"donRateLimitRPS"`
+	DonRateLimitBurst uint32                  `json:"donRateLimitBurst"`
+	DonRateLimits     map[string]DonRateLimit `json:"donRateLimits"`
+	// PersistLimiterState saves daily quota counters, per-sender rate limits and cached responses (which reject
+	// replayed message IDs) to the database, so that node restarts don't reset them. They are in-memory only by default.
+	PersistLimiterState bool `json:"persistLimiterState"`
+	// StateCheckpointFrequencySec periodically saves limiter state to the configured store (zero saves on Close only).
+	StateCheckpointFrequencySec uint32 `json:"stateCheckpointFrequencySec"`
+	// AllowlistCacheTTLSec caches positive allowlist decisions. Revocations still take effect on the next allowlist sync.
+	AllowlistCacheTTLSec uint32 `json:"allowlistCacheTTLSec"`
+	// MaxRequestTagLength enables echoing the client-supplied "request_tag" in responses. Longer tags are rejected.
+	MaxRequestTagLength uint32 `json:"maxRequestTagLength"`
+	// MaxPayloadBytesPerMethod caps request payload sizes by method name. Methods not listed are not capped.
+	MaxPayloadBytesPerMethod map[string]uint32 `json:"maxPayloadBytesPerMethod"`
+	// RequestSchemas validates request payloads by method name against JSON Schemas before they are handled.
+	// Invalid payloads are rejected with SCHEMA_VALIDATION_FAILED and the JSON pointer of the violating value.
+	// A subset of JSON Schema is supported: type, properties, required, additionalProperties (boolean), items,
+	// maxItems, minLength, maxLength, minimum, maximum and enum.
+	RequestSchemas map[string]json.RawMessage `json:"requestSchemas"`
+	// SignerCacheSize enables caching of recently verified client signatures.
+	SignerCacheSize   uint32 `json:"signerCacheSize"`
+	SignerCacheTTLSec uint32 `json:"signerCacheTTLSec"`
+	// ResponseCacheSize enables caching of recent responses by sender and message ID. Retries with the same
+	// message ID get the cached response without being processed again. Only requests that passed authentication
+	// and the allowlist are cached. Errors with a code are cached too, except transient ones such as RATE_LIMITED,
+	// MAINTENANCE_MODE, INTERNAL_ERROR or DAILY_QUOTA_EXCEEDED. Failures without a code (e.g. storage errors) are
+	// never cached. A message ID reused for a different request is rejected with
+	// MESSAGE_ID_REUSE. Requests with an "idempotency_key" are cached by that key instead, so that retries are
+	// deduplicated even across different message IDs. ResponseCacheTTLSec is required with a cache.
+	ResponseCacheSize   uint32 `json:"responseCacheSize"`
+	ResponseCacheTTLSec uint32 `json:"responseCacheTTLSec"`
+	// ListCacheTTLSec caches storage listings (metadata only) per address, e.g. for monitoring tools listing
+	// the same addresses repeatedly. Writes through this node invalidate the cache, writes by other nodes
+	// show up after at most the TTL, so keep it short.
+	ListCacheTTLSec uint32 `json:"listCacheTTLSec"`
+	// StartupGraceSec makes requests from addresses that aren't allowed get a STARTING_UP response with a
+	// retry_after_sec hint until the allowlist is loaded for the first time, but at most StartupGraceSec after
+	// the handler started. Such requests are dropped without a response otherwise.
+	StartupGraceSec uint32 `json:"startupGraceSec"`
+	// VerifyRecordsOnRead checks records read by secrets_get and secrets_list (with inlined payloads) against the
+	// owner's signature, which S4 verifies on write and stores with the record. Records that don't match
+	// (e.g. corrupted by the storage backend) are not served and INTEGRITY_ERROR is returned instead.
+	VerifyRecordsOnRead bool `json:"verifyRecordsOnRead"`
+	// AllowExpiredReads makes secrets_get return expired records flagged as "expired" instead of
+	// rejecting them with EXPIRED, allowing grace reads during rotation.
+	AllowExpiredReads bool `json:"allowExpiredReads"`
+	// ReadGraceSec makes secrets_get return records that expired at most ReadGraceSec ago, flagged as "stale",
+	// so reads racing with a rotation don't fail. Records are only readable until S4 garbage-collects them.
+	ReadGraceSec uint32 `json:"readGraceSec"`
+	// GenerateMissingMessageIds assigns a random ID to messages without one instead of rejecting them with
+	// MISSING_MESSAGE_ID. Rejecting (the default) surfaces client bugs, as such messages can't be deduplicated.
+	GenerateMissingMessageIds bool `json:"generateMissingMessageIds"`
+	// StrictDonIdMatching drops requests addressed to DONs other than the connector's own DON
+	// and AcceptedDonIds (e.g. the previous DON ID during a migration).
+	StrictDonIdMatching bool     `json:"strictDonIdMatching"`
+	AcceptedDonIds      []string `json:"acceptedDonIds"`
+	// TombstoneRetentionSec enables secrets_delete. Deleted secrets are kept as tombstones (records with
+	// an empty payload), which must expire within this period and are then garbage-collected by S4.
+	TombstoneRetentionSec uint32 `json:"tombstoneRetentionSec"`
+	// MaxExpirationSec rejects writes of records expiring more than MaxExpirationSec from now with
+	// EXPIRATION_EXCEEDS_RETENTION, so that clients learn the storage retention limit instead of losing secrets early.
+	MaxExpirationSec uint32 `json:"maxExpirationSec"`
+	// MaxVersion rejects writes with client-supplied versions above it with VERSION_OUT_OF_RANGE, so that
+	// a version close to the uint64 maximum can't block later version increments (e.g. by secrets_bulk_touch).
+	MaxVersion uint64 `json:"maxVersion"`
+	// RejectExpirationRegression makes secrets_set reject updates that would make a stored secret expire earlier
+	// with EXPIRATION_REGRESSION. Deleted and expired secrets may be replaced with any expiration.
+	RejectExpirationRegression bool `json:"rejectExpirationRegression"`
+	// SerializeSlotWrites makes concurrent writes to the same slot of a sender (secrets_set, secrets_delete,
+	// secrets_copy, secrets_swap, secrets_bulk_touch and self_test) run one at a time. Otherwise their checks (e.g. RejectExpirationRegression) and writes may interleave.
+	SerializeSlotWrites bool `json:"serializeSlotWrites"`
+	// RejectSignerMismatch makes secrets_set recover the envelope signer before writing and reject records not
+	// signed by the sender with SIGNER_MISMATCH. S4 rejects them anyway, but with a generic "wrong signature" error.
+	RejectSignerMismatch bool `json:"rejectSignerMismatch"`
+	// AllowEmptyPayloads makes secrets_set store zero-length payloads as valid empty secrets (signed like any other
+	// payload) instead of rejecting them with EMPTY_PAYLOAD. Ignored when tombstones are enabled.
+	AllowEmptyPayloads bool `json:"allowEmptyPayloads"`
+	// AllowWhoAmI enables the whoami method, which tells any caller, allowlisted or not, whether its requests are
+	// accepted and which limits apply to it.
+	AllowWhoAmI bool `json:"allowWhoAmI"`
+	// RetrySafeWrites adds the version and payload digest of the stored record to secrets_set responses and enables
+	// secrets_check_write, which tells whether a write landed. A retried secrets_set finding its record already stored
+	// succeeds with already_written rather than failing with STALE_VERSION.
+	RetrySafeWrites bool `json:"retrySafeWrites"`
+	// SignatureLength makes secrets_set reject signatures of any other length (65 for S4 ECDSA signatures)
+	// before reaching storage.
+	SignatureLength uint32 `json:"signatureLength"`
+	// MaxListRows caps the number of rows in secrets_list responses. Truncated responses are flagged.
+	MaxListRows uint32 `json:"maxListRows"`
+	// MaxListResponseBytes bounds the encoded size of the rows of a secrets_list response (inlined payloads included).
+	// Rows beyond it are left out like rows beyond MaxListRows, so huge listings are returned in several pages.
+	MaxListResponseBytes uint32 `json:"maxListResponseBytes"`
+	// MaxInlinePayloadBytes enables "include_payloads" in secrets_list requests: payloads of at most this size are
+	// inlined into the rows, larger ones are flagged as omitted and have to be fetched with secrets_get.
+	MaxInlinePayloadBytes uint32 `json:"maxInlinePayloadBytes"`
+	// VerifyMessageSignature checks that the whole gateway message (method, DON ID, payload etc.)
+	// is signed by its sender, rather than trusting the gateway to deliver it unaltered.
+	VerifyMessageSignature bool `json:"verifyMessageSignature"`
+	// StorageRetryAttempts retries storage calls failing with transient errors (e.g. a dropped database
+	// connection) up to this many times, StorageRetryDelayMs apart. S4 validation errors are never retried.
+	StorageRetryAttempts uint32 `json:"storageRetryAttempts"`
+	StorageRetryDelayMs  uint32 `json:"storageRetryDelayMs"`
+	// StorageCircuitBreakerThreshold makes requests fail fast with STORAGE_UNAVAILABLE after this many consecutive
+	// transient storage failures. Storage is probed again after StorageCircuitBreakerCooldownSec.
+	StorageCircuitBreakerThreshold   uint32 `json:"storageCircuitBreakerThreshold"`
+	StorageCircuitBreakerCooldownSec uint32 `json:"storageCircuitBreakerCooldownSec"`
+	// SenderTimeoutThreshold enables a per-sender cooldown: after this many consecutive storage timeouts on a
+	// sender's writes, their writes are rejected with COOLDOWN for SenderCooldownSec.
+	SenderTimeoutThreshold uint32 `json:"senderTimeoutThreshold"`
+	SenderCooldownSec      uint32 `json:"senderCooldownSec"`
+	// IncludeSigAlg adds a "sig_alg" field to response payloads, identifying the response signature algorithm.
+	IncludeSigAlg bool `json:"includeSigAlg"`
+	// EmergencyPublicKey (hex-encoded, uncompressed secp256k1) enables break-glass requests: a request carrying an
+	// "emergency_token" signed by this key bypasses the allowlist. Each token is accepted once and every use is logged
+	// at critical level. Redeemed tokens are only remembered in memory, so tokens should be short-lived.
+	EmergencyPublicKey string `json:"emergencyPublicKey"`
+	// OperatorAddresses may call operator-only methods, such as self_test.
+	OperatorAddresses []string `json:"operatorAddresses"`
+	// MaxListMultiAddresses bounds the number of addresses in a secrets_list_multi request (20 if zero).
+	MaxListMultiAddresses uint32 `json:"maxListMultiAddresses"`
+	// SecureTransportMethods rejects requests for the listed methods with INSECURE_TRANSPORT unless the connector
+	// reports the link to the delivering gateway as secure (see connector.TransportSecurityReporter).
+	// Gateways of connectors that can't report it are considered insecure. By default, any transport is accepted.
+	SecureTransportMethods []string `json:"secureTransportMethods"`
+	// UnsignedResponseMethods skips signing responses to the listed public methods (currently only "status")
+	// to save CPU. Responses to all other methods are always signed.
+	UnsignedResponseMethods []string `json:"unsignedResponseMethods"`
+	// CanonicalResponses encodes signed response payloads as canonical JSON (object keys sorted, no whitespace),
+	// so that verifiers re-encoding a decoded payload get the same bytes. By default, fields are in declaration order.
+	CanonicalResponses bool `json:"canonicalResponses"`
+	// QuotaWarningThresholdPercent adds a warning to successful secrets_set responses once the sender uses this
+	// share of their slot quota or bytes (slot quota * MaxPayloadSizeBytes).
+	QuotaWarningThresholdPercent uint32 `json:"quotaWarningThresholdPercent"`
+	// RethrowPanics re-panics after a recovered panic was logged and answered (for debug builds).
+	RethrowPanics bool `json:"rethrowPanics"`
+	// SenderAliases maps alias sender addresses to the addresses owning their secrets (see functions.SenderResolver).
+	// Other senders own their secrets themselves.
+	SenderAliases map[string]string `json:"senderAliases"`
+	// DonNodeAddresses answers requests for the listed DON IDs under a separate identity, the address of an enabled
+	// key in the node's keystore. Other DONs get the connector's NodeAddress.
+	DonNodeAddresses map[string]string `json:"donNodeAddresses"`
+	// MirrorS4Namespace mirrors successful writes into this S4 namespace of the node's database, as a warm standby.
+	// With MirrorFallbackReads, reads failing on the primary storage are served by the mirror. With ReadFromMirror,
+	// secrets_list and secrets_get read from the mirror, falling back to the primary storage while the mirror lags.
+	MirrorS4Namespace   string `json:"mirrorS4Namespace"`
+	MirrorFallbackReads bool   `json:"mirrorFallbackReads"`
+	ReadFromMirror      bool   `json:"readFromMirror"`
+	// PartialSignatureIndex embeds the node's signature over each response payload together with this index,
+	// for clients aggregating a multi-signature from several nodes of the DON (see functions.PartialSigner).
+	PartialSignatureIndex *uint32 `json:"partialSignatureIndex"`
+	// RoundPeriodSec enables a round gate for DONs working in rounds of this length, starting at multiples of
+	// the period since the unix epoch: writes within RoundBoundaryGuardSec of a round boundary are rejected with
+	// OUTSIDE_ACCEPTANCE_WINDOW.
+	RoundPeriodSec        uint32 `json:"roundPeriodSec"`
+	RoundBoundaryGuardSec uint32 `json:"roundBoundaryGuardSec"`
+	// PayloadSchema rejects secrets_set payloads that aren't JSON matching this schema with PAYLOAD_FORMAT_INVALID,
+	// e.g. to enforce an encrypted envelope structure. The same subset of JSON Schema as in RequestSchemas is supported.
+	PayloadSchema json.RawMessage `json:"payloadSchema,omitempty"`
+	// SecretsChangedWebhookURL receives a POST request with a JSON body (address, slot_id, version and action)
+	// after each successful secrets mutation. Failed deliveries are logged and not retried.
+	SecretsChangedWebhookURL string `json:"secretsChangedWebhookURL"`
+}
+
 func ValidatePluginConfig(config PluginConfig) error {
 	if config.DecryptionQueueConfig == nil {
 		return errors.New("missing decryptionQueueConfig")
@@ -56,6 +256,29 @@ func ValidatePluginConfig(config PluginConfig) error {
 	if config.DecryptionQueueConfig.CompletedCacheTimeoutSec <= 0 {
 		return errors.New("missing or invalid decryptionQueueConfig completedCacheTimeoutSec")
 	}
+	if config.ConnectorHandlerConfig != nil {
+		if config.ConnectorHandlerConfig.DailyQuotaResetOffsetSec >= 24*60*60 {
+			return errors.New("invalid connectorHandlerConfig dailyQuotaResetOffsetSec")
+		}
+		for sender := range config.ConnectorHandlerConfig.SenderQuotas {
+			if !common.IsHexAddress(sender) {
+				return fmt.Errorf("invalid connectorHandlerConfig senderQuotas address %s", sender)
+			}
+		}
+		for alias, owner := range config.ConnectorHandlerConfig.SenderAliases {
+			if !common.IsHexAddress(alias) || !common.IsHexAddress(owner) {
+				return fmt.Errorf("invalid connectorHandlerConfig senderAliases entry %s: %s", alias, owner)
+			}
+		}
+		for donId, nodeAddress := range config.ConnectorHandlerConfig.DonNodeAddresses {
+			if !common.IsHexAddress(nodeAddress) {
+				return fmt.Errorf("invalid connectorHandlerConfig donNodeAddresses address for DON %s", donId)
+			}
+		}
+		if config.ConnectorHandlerConfig.RoundPeriodSec > 0 && 2*config.ConnectorHandlerConfig.RoundBoundaryGuardSec >= config.ConnectorHandlerConfig.RoundPeriodSec {
+			return errors.New("invalid connectorHandlerConfig roundBoundaryGuardSec, must be less than half of roundPeriodSec")
+		}
+	}
 	return nil
 }
 
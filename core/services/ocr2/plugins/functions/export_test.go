@@ -0,0 +1,4 @@
+package functions
+
+// NewConnectorHandler exposes the handler behind NewConnector to tests.
+var NewConnectorHandler = newConnectorHandler
@@ -1,8 +1,11 @@
 package functions
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"math/big"
+	"net/http"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -50,6 +53,8 @@ const (
 	FunctionsBridgeName     string = "ea_bridge"
 	FunctionsS4Namespace    string = "functions"
 	MaxAdapterResponseBytes int64  = 1_000_000
+
+	secretsChangedWebhookTimeout = 10 * time.Second
 )
 
 // Create all OCR2 plugin Oracles and all extra services needed to run a Functions job.
@@ -131,7 +136,24 @@ func NewFunctionsServices(functionsOracleArgs, thresholdOracleArgs, s4OracleArgs
 		}
 		s4Storage := s4.NewStorage(conf.Logger, *pluginConfig.S4Constraints, s4ORM, utils.NewRealClock())
 		connectorLogger := conf.Logger.Named("GatewayConnector").With("jobName", conf.Job.PipelineSpec.JobName)
-		connector, err3 := NewConnector(pluginConfig.GatewayConnectorConfig, conf.EthKeystore, conf.Chain.ID(), s4Storage, allowlist, connectorLogger)
+		var handlerConfig config.ConnectorHandlerConfig
+		if pluginConfig.ConnectorHandlerConfig != nil {
+			handlerConfig = *pluginConfig.ConnectorHandlerConfig
+		}
+		var handlerOpts []functions.ConnectorHandlerOpt
+		if handlerConfig.PersistLimiterState {
+			quotaStore := functions.NewDailyQuotaORM(conf.DB, conf.Logger, conf.QConfig, conf.Job.ExternalJobID.String())
+			handlerOpts = append(handlerOpts, functions.WithDailyQuotaStore(quotaStore))
+		}
+		if handlerConfig.MirrorS4Namespace != "" {
+			mirrorORM := s4.NewPostgresORM(conf.DB, conf.Logger, conf.QConfig, s4.SharedTableName, handlerConfig.MirrorS4Namespace)
+			mirror := s4.NewStorage(conf.Logger, *pluginConfig.S4Constraints, mirrorORM, utils.NewRealClock())
+			handlerOpts = append(handlerOpts, functions.WithMirrorStorage(mirror, handlerConfig.MirrorFallbackReads))
+			if handlerConfig.ReadFromMirror {
+				handlerOpts = append(handlerOpts, functions.WithReadReplica(mirror, true))
+			}
+		}
+		connector, err3 := NewConnector(pluginConfig.GatewayConnectorConfig, conf.EthKeystore, conf.Chain.ID(), s4Storage, allowlist, handlerConfig, connectorLogger, handlerOpts...)
 		if err3 != nil {
 			return nil, errors.Wrap(err, "failed to create a GatewayConnector")
 		}
@@ -158,7 +180,28 @@ func NewFunctionsServices(functionsOracleArgs, thresholdOracleArgs, s4OracleArgs
 	return allServices, nil
 }
 
-func NewConnector(gwcCfg *connector.ConnectorConfig, ethKeystore keystore.Eth, chainID *big.Int, s4Storage s4.Storage, allowlist gwFunctions.OnchainAllowlist, lggr logger.Logger) (connector.GatewayConnector, error) {
+func NewConnector(gwcCfg *connector.ConnectorConfig, ethKeystore keystore.Eth, chainID *big.Int, s4Storage s4.Storage, allowlist gwFunctions.OnchainAllowlist, handlerConfig config.ConnectorHandlerConfig, lggr logger.Logger, opts ...functions.ConnectorHandlerOpt) (connector.GatewayConnector, error) {
+	handler, err := newConnectorHandler(gwcCfg, ethKeystore, chainID, s4Storage, allowlist, handlerConfig, utils.NewRealClock(), lggr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := connector.NewGatewayConnector(gwcCfg, handler, handler, utils.NewRealClock(), lggr)
+	if err != nil {
+		return nil, err
+	}
+	handler.SetConnector(connector)
+	return connector, nil
+}
+
+// connectorHandler is the handler behind the GatewayConnector created by NewConnector.
+type connectorHandler interface {
+	connector.GatewayConnectorHandler
+	connector.Signer
+	SetConnector(connector connector.GatewayConnector)
+}
+
+// newConnectorHandler applies the options derived from handlerConfig, followed by opts.
+func newConnectorHandler(gwcCfg *connector.ConnectorConfig, ethKeystore keystore.Eth, chainID *big.Int, s4Storage s4.Storage, allowlist gwFunctions.OnchainAllowlist, handlerConfig config.ConnectorHandlerConfig, clock utils.Clock, lggr logger.Logger, opts ...functions.ConnectorHandlerOpt) (connectorHandler, error) {
 	enabledKeys, err := ethKeystore.EnabledKeysForChain(chainID)
 	if err != nil {
 		return nil, err
@@ -171,11 +214,73 @@ func NewConnector(gwcCfg *connector.ConnectorConfig, ethKeystore keystore.Eth, c
 	signerKey := enabledKeys[idx].ToEcdsaPrivKey()
 	nodeAddress := enabledKeys[idx].ID()
 
-	handler := functions.NewFunctionsConnectorHandler(nodeAddress, signerKey, s4Storage, allowlist, lggr)
-	connector, err := connector.NewGatewayConnector(gwcCfg, handler, handler, utils.NewRealClock(), lggr)
-	if err != nil {
-		return nil, err
+	if handlerConfig.StrictDonIdMatching {
+		handlerConfig.AcceptedDonIds = append([]string{gwcCfg.DonId}, handlerConfig.AcceptedDonIds...)
 	}
-	handler.SetConnector(connector)
-	return connector, nil
+	var configOpts []functions.ConnectorHandlerOpt
+	if len(handlerConfig.SenderQuotas) > 0 {
+		quotas := make(senderQuotas, len(handlerConfig.SenderQuotas))
+		for sender, quota := range handlerConfig.SenderQuotas {
+			quotas[common.HexToAddress(sender)] = quota
+		}
+		configOpts = append(configOpts, functions.WithQuotaResolver(quotas))
+	}
+	if len(handlerConfig.SenderAliases) > 0 {
+		aliases := make(senderAliases, len(handlerConfig.SenderAliases))
+		for alias, owner := range handlerConfig.SenderAliases {
+			aliases[common.HexToAddress(alias)] = common.HexToAddress(owner)
+		}
+		configOpts = append(configOpts, functions.WithSenderResolver(aliases))
+	}
+	for donId, donNodeAddress := range handlerConfig.DonNodeAddresses {
+		address := common.HexToAddress(donNodeAddress)
+		idx := slices.IndexFunc(enabledKeys, func(key ethkey.KeyV2) bool { return key.Address == address })
+		if idx == -1 {
+			return nil, fmt.Errorf("key for node address of DON %s not found", donId)
+		}
+		configOpts = append(configOpts, functions.WithDonIdentity(donId, enabledKeys[idx].ToEcdsaPrivKey()))
+	}
+	if handlerConfig.PartialSignatureIndex != nil {
+		configOpts = append(configOpts, functions.WithPartialSigner(functions.NewMultiSigSigner(signerKey, *handlerConfig.PartialSignatureIndex)))
+	}
+	if handlerConfig.RoundPeriodSec > 0 {
+		period := time.Duration(handlerConfig.RoundPeriodSec) * time.Second
+		guard := time.Duration(handlerConfig.RoundBoundaryGuardSec) * time.Second
+		configOpts = append(configOpts, functions.WithRoundGate(functions.NewPeriodicRoundGate(period, guard)))
+	}
+	if len(handlerConfig.PayloadSchema) > 0 {
+		enforcer, err := functions.NewSchemaPayloadFormatEnforcer(handlerConfig.PayloadSchema)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid payloadSchema")
+		}
+		configOpts = append(configOpts, functions.WithPayloadFormatEnforcer(enforcer))
+	}
+	if handlerConfig.SecretsChangedWebhookURL != "" {
+		client := &http.Client{Timeout: secretsChangedWebhookTimeout}
+		configOpts = append(configOpts, functions.WithOnSecretsChanged(functions.NewSecretsChangedWebhook(handlerConfig.SecretsChangedWebhookURL, client)))
+	}
+	return functions.NewFunctionsConnectorHandler(nodeAddress, signerKey, s4Storage, allowlist, handlerConfig, clock, lggr, append(configOpts, opts...)...)
+}
+
+// senderAliases is a functions.SenderResolver for ConnectorHandlerConfig.SenderAliases.
+type senderAliases map[common.Address]common.Address
+
+func (a senderAliases) ResolveSender(_ context.Context, sender common.Address) (common.Address, error) {
+	if owner, ok := a[sender]; ok {
+		return owner, nil
+	}
+	return sender, nil
+}
+
+// senderQuotas is a functions.QuotaResolver for ConnectorHandlerConfig.SenderQuotas.
+type senderQuotas map[common.Address]config.SenderQuota
+
+func (q senderQuotas) DailyQuota(sender common.Address) (uint32, bool) {
+	quota := q[sender]
+	return quota.DailyRequests, quota.DailyRequests > 0
+}
+
+func (q senderQuotas) SlotQuota(sender common.Address) (uint, bool) {
+	quota := q[sender]
+	return quota.Slots, quota.Slots > 0
 }
@@ -1,39 +1,87 @@
 package functions_test
 
 import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/smartcontractkit/chainlink/v2/core/internal/testutils"
 	"github.com/smartcontractkit/chainlink/v2/core/logger"
+	"github.com/smartcontractkit/chainlink/v2/core/services/functions/testhelpers"
+	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/api"
+	gwcommon "github.com/smartcontractkit/chainlink/v2/core/services/gateway/common"
 	"github.com/smartcontractkit/chainlink/v2/core/services/gateway/connector"
 	gfmocks "github.com/smartcontractkit/chainlink/v2/core/services/gateway/handlers/functions/mocks"
 	"github.com/smartcontractkit/chainlink/v2/core/services/keystore/keys/ethkey"
 	ksmocks "github.com/smartcontractkit/chainlink/v2/core/services/keystore/mocks"
 	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions"
+	"github.com/smartcontractkit/chainlink/v2/core/services/ocr2/plugins/functions/config"
+	"github.com/smartcontractkit/chainlink/v2/core/services/s4"
 	s4mocks "github.com/smartcontractkit/chainlink/v2/core/services/s4/mocks"
 )
 
 func TestNewConnector_Success(t *testing.T) {
 	t.Parallel()
-	address := "0x00000000DE801ceE9471ADf23370c48b011f82a6"
+	key, err := ethkey.NewV2()
+	require.NoError(t, err)
 
 	gwcCfg := &connector.ConnectorConfig{
-		NodeAddress: address,
+		NodeAddress: key.Address.Hex(),
 		DonId:       "my_don",
 	}
 	chainID := big.NewInt(80001)
 	ethKeystore := ksmocks.NewEth(t)
 	s4Storage := s4mocks.NewStorage(t)
 	allowlist := gfmocks.NewOnchainAllowlist(t)
-	ethKeystore.On("EnabledKeysForChain", mock.Anything).Return([]ethkey.KeyV2{{Address: common.HexToAddress(address)}}, nil)
-	_, err := functions.NewConnector(gwcCfg, ethKeystore, chainID, s4Storage, allowlist, logger.TestLogger(t))
+	ethKeystore.On("EnabledKeysForChain", mock.Anything).Return([]ethkey.KeyV2{key}, nil)
+	_, err = functions.NewConnector(gwcCfg, ethKeystore, chainID, s4Storage, allowlist, config.ConnectorHandlerConfig{}, logger.TestLogger(t))
 	require.NoError(t, err)
 }
 
+func TestNewConnector_StrictDonIdMatching(t *testing.T) {
+	t.Parallel()
+	key, err := ethkey.NewV2()
+	require.NoError(t, err)
+
+	gwcCfg := &connector.ConnectorConfig{
+		NodeAddress: key.Address.Hex(),
+		DonId:       "my_don",
+	}
+	chainID := big.NewInt(80001)
+	ethKeystore := ksmocks.NewEth(t)
+	s4Storage := s4mocks.NewStorage(t)
+	allowlist := gfmocks.NewOnchainAllowlist(t)
+	ethKeystore.On("EnabledKeysForChain", mock.Anything).Return([]ethkey.KeyV2{key}, nil)
+	acceptedDonIds := []string{"old_don"}
+	handlerConfig := config.ConnectorHandlerConfig{StrictDonIdMatching: true, AcceptedDonIds: acceptedDonIds}
+	_, err = functions.NewConnector(gwcCfg, ethKeystore, chainID, s4Storage, allowlist, handlerConfig, logger.TestLogger(t))
+	require.NoError(t, err)
+	require.Equal(t, []string{"old_don"}, acceptedDonIds)
+
+	ctx := testutils.Context(t)
+	senderKey, senderAddr := testutils.NewPrivateKeyAndAddress(t)
+	handler, fakeConnector := newTestHandler(t, &connector.ConnectorConfig{DonId: "my_don"}, handlerConfig, senderAddr)
+	handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "my_don", 1))
+	require.Len(t, fakeConnector.Responses(), 1)
+	handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "old_don", 2))
+	require.Len(t, fakeConnector.Responses(), 2)
+	handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "other_don", 3))
+	require.Len(t, fakeConnector.Responses(), 2)
+}
+
 func TestNewConnector_NoKeyForConfiguredAddress(t *testing.T) {
 	t.Parallel()
 	addresses := []string{
@@ -50,6 +98,180 @@ func TestNewConnector_NoKeyForConfiguredAddress(t *testing.T) {
 	s4Storage := s4mocks.NewStorage(t)
 	allowlist := gfmocks.NewOnchainAllowlist(t)
 	ethKeystore.On("EnabledKeysForChain", mock.Anything).Return([]ethkey.KeyV2{{Address: common.HexToAddress(addresses[1])}}, nil)
-	_, err := functions.NewConnector(gwcCfg, ethKeystore, chainID, s4Storage, allowlist, logger.TestLogger(t))
+	_, err := functions.NewConnector(gwcCfg, ethKeystore, chainID, s4Storage, allowlist, config.ConnectorHandlerConfig{}, logger.TestLogger(t))
 	require.Error(t, err)
 }
+
+// newTestHandler starts the handler NewConnector would create, with in-memory storage and the given senders allowlisted.
+func newTestHandler(t *testing.T, gwcCfg *connector.ConnectorConfig, handlerConfig config.ConnectorHandlerConfig, senders ...common.Address) (connector.GatewayConnectorHandler, *testhelpers.FakeConnector) {
+	handler, fakeConnector, _ := newTestHandlerWithKeys(t, gwcCfg, handlerConfig, nil, senders...)
+	return handler, fakeConnector
+}
+
+// newTestHandlerWithKeys is like newTestHandler, but the keystore also holds extraKeys.
+func newTestHandlerWithKeys(t *testing.T, gwcCfg *connector.ConnectorConfig, handlerConfig config.ConnectorHandlerConfig, extraKeys []ethkey.KeyV2, senders ...common.Address) (connector.GatewayConnectorHandler, *testhelpers.FakeConnector, *testhelpers.FakeClock) {
+	key, err := ethkey.NewV2()
+	require.NoError(t, err)
+	gwcCfg.NodeAddress = key.Address.Hex()
+	ethKeystore := ksmocks.NewEth(t)
+	ethKeystore.On("EnabledKeysForChain", mock.Anything).Return(append([]ethkey.KeyV2{key}, extraKeys...), nil)
+	clock := testhelpers.NewFakeClock(time.Now())
+	lggr := logger.TestLogger(t)
+	s4Storage := s4.NewStorage(lggr, testhelpers.TestConstraints, s4.NewInMemoryORM(), clock)
+
+	handler, err := functions.NewConnectorHandler(gwcCfg, ethKeystore, big.NewInt(80001), s4Storage, testhelpers.NewFakeAllowlist(senders...), handlerConfig, clock, lggr)
+	require.NoError(t, err)
+	fakeConnector := &testhelpers.FakeConnector{}
+	handler.SetConnector(fakeConnector)
+	require.NoError(t, handler.Start(testutils.Context(t)))
+	t.Cleanup(func() { require.NoError(t, handler.Close()) })
+	return handler, fakeConnector, clock
+}
+
+func newTestRequest(t *testing.T, privateKey *ecdsa.PrivateKey, donId string, messageId int) *api.Message {
+	return newTestRequestWithPayload(t, privateKey, donId, messageId, "secrets_list", "")
+}
+
+func newTestRequestWithPayload(t *testing.T, privateKey *ecdsa.PrivateKey, donId string, messageId int, method string, payload string) *api.Message {
+	msg := &api.Message{
+		Body: api.MessageBody{
+			MessageId: fmt.Sprint(messageId),
+			DonId:     donId,
+			Method:    method,
+			Sender:    crypto.PubkeyToAddress(privateKey.PublicKey).Hex(),
+		},
+	}
+	if payload != "" {
+		msg.Body.Payload = json.RawMessage(payload)
+	}
+	require.NoError(t, msg.Sign(privateKey))
+	return msg
+}
+
+// setRequest returns a secrets_set payload writing payload to slot 0, signed by privateKey.
+func setRequest(t *testing.T, privateKey *ecdsa.PrivateKey, version uint64, payload []byte) string {
+	key := s4.Key{Address: crypto.PubkeyToAddress(privateKey.PublicKey), Version: version}
+	record := s4.Record{Payload: payload, Expiration: time.Now().Add(time.Hour).UnixMilli()}
+	signature, err := s4.NewEnvelopeFromRecord(&key, &record).Sign(privateKey)
+	require.NoError(t, err)
+	return fmt.Sprintf(`{"slot_id":0,"version":%d,"expiration":%d,"payload":"%s","signature":"%s"}`,
+		version, record.Expiration, base64.StdEncoding.EncodeToString(payload), base64.StdEncoding.EncodeToString(signature))
+}
+
+func TestNewConnector_DailyQuota(t *testing.T) {
+	t.Parallel()
+	ctx := testutils.Context(t)
+	senderKey, senderAddr := testutils.NewPrivateKeyAndAddress(t)
+	partnerKey, partnerAddr := testutils.NewPrivateKeyAndAddress(t)
+	handlerConfig := config.ConnectorHandlerConfig{
+		MaxDailyRequestsPerSender: 1,
+		SenderQuotas:              map[string]config.SenderQuota{partnerAddr.Hex(): {DailyRequests: 2}},
+	}
+	handler, fakeConnector := newTestHandler(t, &connector.ConnectorConfig{DonId: "my_don"}, handlerConfig, senderAddr, partnerAddr)
+
+	handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "my_don", 1))
+	require.Equal(t, `{"success":true}`, fakeConnector.LastResponsePayload())
+	handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "my_don", 2))
+	require.Contains(t, fakeConnector.LastResponsePayload(), `"error_code":"DAILY_QUOTA_EXCEEDED"`)
+
+	for i := 1; i <= 2; i++ {
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, partnerKey, "my_don", i))
+		require.Equal(t, `{"success":true}`, fakeConnector.LastResponsePayload())
+	}
+	handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, partnerKey, "my_don", 3))
+	require.Contains(t, fakeConnector.LastResponsePayload(), `"error_code":"DAILY_QUOTA_EXCEEDED"`)
+}
+
+func TestNewConnector_ConfiguredOptions(t *testing.T) {
+	t.Parallel()
+	ctx := testutils.Context(t)
+	senderKey, senderAddr := testutils.NewPrivateKeyAndAddress(t)
+
+	t.Run("sender aliases", func(t *testing.T) {
+		aliasKey, aliasAddr := testutils.NewPrivateKeyAndAddress(t)
+		handlerConfig := config.ConnectorHandlerConfig{SenderAliases: map[string]string{aliasAddr.Hex(): senderAddr.Hex()}}
+		handler, fakeConnector := newTestHandler(t, &connector.ConnectorConfig{DonId: "my_don"}, handlerConfig, senderAddr)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, aliasKey, "my_don", 1))
+		require.Equal(t, `{"success":true}`, fakeConnector.LastResponsePayload())
+	})
+
+	t.Run("DON node addresses", func(t *testing.T) {
+		donKey, err := ethkey.NewV2()
+		require.NoError(t, err)
+		handlerConfig := config.ConnectorHandlerConfig{DonNodeAddresses: map[string]string{"other_don": donKey.Address.Hex()}}
+		handler, fakeConnector, _ := newTestHandlerWithKeys(t, &connector.ConnectorConfig{DonId: "my_don"}, handlerConfig, []ethkey.KeyV2{donKey}, senderAddr)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "other_don", 1))
+		responses := fakeConnector.Responses()
+		require.Equal(t, donKey.Address.Hex(), responses[len(responses)-1].Body.Sender)
+
+		_, err = functions.NewConnectorHandler(&connector.ConnectorConfig{NodeAddress: donKey.Address.Hex()}, ethKeystoreWith(t, donKey), big.NewInt(80001), s4mocks.NewStorage(t), gfmocks.NewOnchainAllowlist(t),
+			config.ConnectorHandlerConfig{DonNodeAddresses: map[string]string{"other_don": senderAddr.Hex()}}, testhelpers.NewFakeClock(time.Now()), logger.TestLogger(t))
+		require.ErrorContains(t, err, "key for node address of DON other_don not found")
+	})
+
+	t.Run("partial signatures", func(t *testing.T) {
+		index := uint32(3)
+		handler, fakeConnector := newTestHandler(t, &connector.ConnectorConfig{DonId: "my_don"}, config.ConnectorHandlerConfig{PartialSignatureIndex: &index}, senderAddr)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequest(t, senderKey, "my_don", 1))
+		responses := fakeConnector.Responses()
+		response := responses[len(responses)-1]
+		var signed struct {
+			Payload          json.RawMessage `json:"payload"`
+			PartialSignature []byte          `json:"partial_signature"`
+			SignerIndex      uint32          `json:"signer_index"`
+		}
+		require.NoError(t, json.Unmarshal(response.Body.Payload, &signed))
+		require.Equal(t, `{"success":true}`, string(signed.Payload))
+		require.Equal(t, index, signed.SignerIndex)
+		signer, err := gwcommon.ExtractSigner(signed.PartialSignature, signed.Payload)
+		require.NoError(t, err)
+		require.Equal(t, response.Body.Sender, common.BytesToAddress(signer).Hex())
+	})
+
+	t.Run("round gate", func(t *testing.T) {
+		handlerConfig := config.ConnectorHandlerConfig{RoundPeriodSec: 60, RoundBoundaryGuardSec: 5}
+		handler, fakeConnector, clock := newTestHandlerWithKeys(t, &connector.ConnectorConfig{DonId: "my_don"}, handlerConfig, nil, senderAddr)
+		clock.Advance(-time.Duration(clock.Now().UnixNano() % int64(time.Minute)))
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequestWithPayload(t, senderKey, "my_don", 1, "secrets_set", setRequest(t, senderKey, 1, []byte("test"))))
+		require.Contains(t, fakeConnector.LastResponsePayload(), `"error_code":"OUTSIDE_ACCEPTANCE_WINDOW"`)
+		clock.Advance(30 * time.Second)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequestWithPayload(t, senderKey, "my_don", 2, "secrets_set", setRequest(t, senderKey, 1, []byte("test"))))
+		require.Equal(t, `{"success":true}`, fakeConnector.LastResponsePayload())
+	})
+
+	t.Run("payload schema", func(t *testing.T) {
+		handlerConfig := config.ConnectorHandlerConfig{PayloadSchema: json.RawMessage(`{"type":"object","required":["ciphertext"]}`)}
+		handler, fakeConnector := newTestHandler(t, &connector.ConnectorConfig{DonId: "my_don"}, handlerConfig, senderAddr)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequestWithPayload(t, senderKey, "my_don", 1, "secrets_set", setRequest(t, senderKey, 1, []byte("plaintext"))))
+		require.Contains(t, fakeConnector.LastResponsePayload(), `"error_code":"PAYLOAD_FORMAT_INVALID"`)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequestWithPayload(t, senderKey, "my_don", 2, "secrets_set", setRequest(t, senderKey, 1, []byte(`{"ciphertext":"AQID"}`))))
+		require.Equal(t, `{"success":true}`, fakeConnector.LastResponsePayload())
+
+		key, err := ethkey.NewV2()
+		require.NoError(t, err)
+		_, err = functions.NewConnectorHandler(&connector.ConnectorConfig{NodeAddress: key.Address.Hex()}, ethKeystoreWith(t, key), big.NewInt(80001), s4mocks.NewStorage(t), gfmocks.NewOnchainAllowlist(t),
+			config.ConnectorHandlerConfig{PayloadSchema: json.RawMessage(`{"type":"object","pattern":"x"}`)}, testhelpers.NewFakeClock(time.Now()), logger.TestLogger(t))
+		require.ErrorContains(t, err, "invalid payloadSchema")
+	})
+
+	t.Run("secrets changed webhook", func(t *testing.T) {
+		notifications := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			notifications <- string(body)
+		}))
+		t.Cleanup(server.Close)
+		handler, fakeConnector := newTestHandler(t, &connector.ConnectorConfig{DonId: "my_don"}, config.ConnectorHandlerConfig{SecretsChangedWebhookURL: server.URL}, senderAddr)
+		handler.HandleGatewayMessage(ctx, "gw1", newTestRequestWithPayload(t, senderKey, "my_don", 1, "secrets_set", setRequest(t, senderKey, 1, []byte("test"))))
+		require.Equal(t, `{"success":true}`, fakeConnector.LastResponsePayload())
+		require.Equal(t, fmt.Sprintf(`{"address":"%s","slot_id":0,"version":1,"action":"set"}`, senderAddr.Hex()), <-notifications)
+	})
+}
+
+// ethKeystoreWith returns a keystore holding keys.
+func ethKeystoreWith(t *testing.T, keys ...ethkey.KeyV2) *ksmocks.Eth {
+	ethKeystore := ksmocks.NewEth(t)
+	ethKeystore.On("EnabledKeysForChain", mock.Anything).Return(keys, nil)
+	return ethKeystore
+}
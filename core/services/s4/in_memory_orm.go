@@ -1,6 +1,7 @@
 package s4
 
 import (
+	"bytes"
 	"sort"
 	"sync"
 	"time"
@@ -15,8 +16,7 @@ type key struct {
 }
 
 type mrow struct {
-	Row       *Row
-	UpdatedAt time.Time
+	Row *Row
 }
 
 type inMemoryOrm struct {
@@ -67,13 +67,28 @@ func (o *inMemoryOrm) Update(row *Row, qopts ...pg.QOpt) error {
 		return ErrVersionTooLow
 	}
 
+	clone := row.Clone()
+	if clone.UpdatedAt.IsZero() {
+		clone.UpdatedAt = time.Now().UTC()
+	}
+	clone.CreatedAt = clone.UpdatedAt
+	if ok {
+		clone.CreatedAt = existing.Row.CreatedAt
+		if !recordChanged(existing.Row, clone) {
+			clone.UpdatedAt = existing.Row.UpdatedAt
+		}
+	}
 	o.rows[mkey] = &mrow{
-		Row:       row.Clone(),
-		UpdatedAt: time.Now().UTC(),
+		Row: clone,
 	}
 	return nil
 }
 
+// recordChanged tells whether an update changes the stored record, rather than e.g. only confirming it.
+func recordChanged(existing *Row, row *Row) bool {
+	return existing.Version != row.Version || existing.Expiration != row.Expiration || !bytes.Equal(existing.Payload, row.Payload)
+}
+
 func (o *inMemoryOrm) DeleteExpired(limit uint, now time.Time, qopts ...pg.QOpt) (int64, error) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -103,11 +118,14 @@ func (o *inMemoryOrm) GetSnapshot(addressRange *AddressRange, qopts ...pg.QOpt)
 	for _, mrow := range o.rows {
 		if mrow.Row.Expiration > now {
 			rows = append(rows, &SnapshotRow{
-				Address:    utils.NewBig(mrow.Row.Address.ToInt()),
-				SlotId:     mrow.Row.SlotId,
-				Version:    mrow.Row.Version,
-				Expiration: mrow.Row.Expiration,
-				Confirmed:  mrow.Row.Confirmed,
+				Address:     utils.NewBig(mrow.Row.Address.ToInt()),
+				SlotId:      mrow.Row.SlotId,
+				Version:     mrow.Row.Version,
+				Expiration:  mrow.Row.Expiration,
+				Confirmed:   mrow.Row.Confirmed,
+				PayloadSize: uint64(len(mrow.Row.Payload)),
+				CreatedAt:   mrow.Row.CreatedAt,
+				UpdatedAt:   mrow.Row.UpdatedAt,
 			})
 		}
 	}
@@ -128,7 +146,7 @@ func (o *inMemoryOrm) GetUnconfirmedRows(limit uint, qopts ...pg.QOpt) ([]*Row,
 	}
 
 	sort.Slice(mrows, func(i, j int) bool {
-		return mrows[i].UpdatedAt.Before(mrows[j].UpdatedAt)
+		return mrows[i].Row.UpdatedAt.Before(mrows[j].Row.UpdatedAt)
 	})
 
 	if uint(len(mrows)) > limit {
@@ -20,6 +20,7 @@ func TestInMemoryORM(t *testing.T) {
 	payload := testutils.Random32Byte()
 	signature := testutils.Random32Byte()
 	expiration := time.Now().Add(time.Minute).UnixMilli()
+	createdAt := time.Now().UTC()
 	row := &s4.Row{
 		Address:    utils.NewBig(address.Big()),
 		SlotId:     slotId,
@@ -28,6 +29,8 @@ func TestInMemoryORM(t *testing.T) {
 		Expiration: expiration,
 		Confirmed:  false,
 		Signature:  signature[:],
+		CreatedAt:  createdAt,
+		UpdatedAt:  createdAt,
 	}
 
 	orm := s4.NewInMemoryORM()
@@ -48,6 +51,8 @@ func TestInMemoryORM(t *testing.T) {
 
 	t.Run("update and get", func(t *testing.T) {
 		row.Version = 5
+		// CreatedAt is preserved on update.
+		row.UpdatedAt = createdAt.Add(time.Minute)
 		err := orm.Update(row)
 		assert.NoError(t, err)
 
@@ -63,6 +68,17 @@ func TestInMemoryORM(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, row, e)
 	})
+
+	t.Run("confirmation keeps updated_at", func(t *testing.T) {
+		updatedAt := row.UpdatedAt
+		row.UpdatedAt = updatedAt.Add(time.Minute)
+		err := orm.Update(row)
+		assert.NoError(t, err)
+
+		e, err := orm.Get(utils.NewBig(address.Big()), slotId)
+		assert.NoError(t, err)
+		assert.True(t, updatedAt.Equal(e.UpdatedAt))
+	})
 }
 
 func TestInMemoryORM_DeleteExpired(t *testing.T) {
@@ -141,7 +157,7 @@ func TestInMemoryORM_GetSnapshot(t *testing.T) {
 		row := &s4.Row{
 			Address:    utils.NewBig(thisAddress.Big()),
 			SlotId:     1,
-			Payload:    []byte{},
+			Payload:    make([]byte, i%3),
 			Version:    uint64(i),
 			Expiration: expiration,
 			Confirmed:  i >= 100,
@@ -158,6 +174,7 @@ func TestInMemoryORM_GetSnapshot(t *testing.T) {
 	testMap := make(map[uint64]int)
 	for i := 0; i < n; i++ {
 		testMap[rows[i].Version]++
+		assert.Equal(t, rows[i].Version%3, rows[i].PayloadSize)
 	}
 	assert.Len(t, testMap, n)
 	for _, c := range testMap {
@@ -66,6 +66,41 @@ func (_m *Storage) Get(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metada
 	return r0, r1, r2
 }
 
+// GetIncludingExpired provides a mock function with given fields: ctx, key
+func (_m *Storage) GetIncludingExpired(ctx context.Context, key *s4.Key) (*s4.Record, *s4.Metadata, error) {
+	ret := _m.Called(ctx, key)
+
+	var r0 *s4.Record
+	var r1 *s4.Metadata
+	var r2 error
+	if rf, ok := ret.Get(0).(func(context.Context, *s4.Key) (*s4.Record, *s4.Metadata, error)); ok {
+		return rf(ctx, key)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, *s4.Key) *s4.Record); ok {
+		r0 = rf(ctx, key)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*s4.Record)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, *s4.Key) *s4.Metadata); ok {
+		r1 = rf(ctx, key)
+	} else {
+		if ret.Get(1) != nil {
+			r1 = ret.Get(1).(*s4.Metadata)
+		}
+	}
+
+	if rf, ok := ret.Get(2).(func(context.Context, *s4.Key) error); ok {
+		r2 = rf(ctx, key)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // List provides a mock function with given fields: ctx, address
 func (_m *Storage) List(ctx context.Context, address common.Address) ([]*s4.SnapshotRow, error) {
 	ret := _m.Called(ctx, address)
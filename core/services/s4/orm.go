@@ -16,15 +16,20 @@ type Row struct {
 	Expiration int64
 	Confirmed  bool
 	Signature  []byte
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
 }
 
 // SnapshotRow(s) are returned by GetSnapshot function.
 type SnapshotRow struct {
-	Address    *utils.Big
-	SlotId     uint
-	Version    uint64
-	Expiration int64
-	Confirmed  bool
+	Address     *utils.Big
+	SlotId      uint
+	Version     uint64
+	Expiration  int64
+	Confirmed   bool
+	PayloadSize uint64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
 }
 
 //go:generate mockery --quiet --name ORM --output ./mocks/ --case=underscore
@@ -40,7 +45,9 @@ type ORM interface {
 	// Update inserts or updates the row identified by (Address, SlotId) pair.
 	// When updating, the new row must have greater or equal version,
 	// otherwise ErrVersionTooLow is returned.
-	// UpdatedAt field value is ignored.
+	// UpdatedAt is set to the row's UpdatedAt, or to the current time if it is zero. It is kept
+	// when the version, expiration and payload don't change, e.g. when a row is only confirmed.
+	// CreatedAt is set on insert only, its field value is ignored.
 	Update(row *Row, qopts ...pg.QOpt) error
 
 	// DeleteExpired deletes any entries having Expiration < utcNow,
@@ -66,6 +73,8 @@ func (r Row) Clone() *Row {
 		Expiration: r.Expiration,
 		Confirmed:  r.Confirmed,
 		Signature:  make([]byte, len(r.Signature)),
+		CreatedAt:  r.CreatedAt,
+		UpdatedAt:  r.UpdatedAt,
 	}
 	copy(clone.Payload, r.Payload)
 	copy(clone.Signature, r.Signature)
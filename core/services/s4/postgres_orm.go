@@ -38,7 +38,7 @@ func (o orm) Get(address *utils.Big, slotId uint, qopts ...pg.QOpt) (*Row, error
 	row := &Row{}
 	q := o.q.WithOpts(qopts...)
 
-	stmt := fmt.Sprintf(`SELECT address, slot_id, version, expiration, confirmed, payload, signature FROM %s 
+	stmt := fmt.Sprintf(`SELECT address, slot_id, version, expiration, confirmed, payload, signature, created_at, updated_at FROM %s 
 WHERE namespace=$1 AND address=$2 AND slot_id=$3;`, o.tableName)
 	if err := q.Get(row, stmt, o.namespace, address, slotId); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -55,19 +55,21 @@ func (o orm) Update(row *Row, qopts ...pg.QOpt) error {
 	// This query inserts or updates a row, depending on whether the version is higher than the existing one.
 	// We only allow the same version when the row is confirmed.
 	// We never transition back from unconfirmed to confirmed state.
-	stmt := fmt.Sprintf(`INSERT INTO %s as t (namespace, address, slot_id, version, expiration, confirmed, payload, signature, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+	stmt := fmt.Sprintf(`INSERT INTO %s as t (namespace, address, slot_id, version, expiration, confirmed, payload, signature, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, COALESCE($9, NOW()), COALESCE($9, NOW()))
 ON CONFLICT (namespace, address, slot_id)
 DO UPDATE SET version = EXCLUDED.version,
 expiration = EXCLUDED.expiration,
 confirmed = EXCLUDED.confirmed,
 payload = EXCLUDED.payload,
 signature = EXCLUDED.signature,
-updated_at = NOW()
+updated_at = CASE WHEN t.version <> EXCLUDED.version OR t.expiration <> EXCLUDED.expiration OR t.payload <> EXCLUDED.payload
+	THEN EXCLUDED.updated_at ELSE t.updated_at END
 WHERE (t.version < EXCLUDED.version AND t.confirmed IS FALSE) OR (t.version <= EXCLUDED.version AND EXCLUDED.confirmed IS TRUE)
 RETURNING id;`, o.tableName)
+	updatedAt := sql.NullTime{Time: row.UpdatedAt, Valid: !row.UpdatedAt.IsZero()}
 	var id uint64
-	err := q.Get(&id, stmt, o.namespace, row.Address, row.SlotId, row.Version, row.Expiration, row.Confirmed, row.Payload, row.Signature)
+	err := q.Get(&id, stmt, o.namespace, row.Address, row.SlotId, row.Version, row.Expiration, row.Confirmed, row.Payload, row.Signature, updatedAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return ErrVersionTooLow
 	}
@@ -90,7 +92,7 @@ func (o orm) GetSnapshot(addressRange *AddressRange, qopts ...pg.QOpt) ([]*Snaps
 	q := o.q.WithOpts(qopts...)
 	rows := make([]*SnapshotRow, 0)
 
-	stmt := fmt.Sprintf(`SELECT address, slot_id, version, expiration, confirmed FROM %s WHERE namespace = $1 AND address >= $2 AND address <= $3;`, o.tableName)
+	stmt := fmt.Sprintf(`SELECT address, slot_id, version, expiration, confirmed, octet_length(payload) AS payload_size, created_at, updated_at FROM %s WHERE namespace = $1 AND address >= $2 AND address <= $3;`, o.tableName)
 	if err := q.Select(&rows, stmt, o.namespace, addressRange.MinAddress, addressRange.MaxAddress); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return nil, err
@@ -103,7 +105,7 @@ func (o orm) GetUnconfirmedRows(limit uint, qopts ...pg.QOpt) ([]*Row, error) {
 	q := o.q.WithOpts(qopts...)
 	rows := make([]*Row, 0)
 
-	stmt := fmt.Sprintf(`SELECT address, slot_id, version, expiration, confirmed, payload, signature FROM %s
+	stmt := fmt.Sprintf(`SELECT address, slot_id, version, expiration, confirmed, payload, signature, created_at, updated_at FROM %s
 WHERE namespace = $1 AND confirmed IS FALSE ORDER BY updated_at LIMIT $2;`, o.tableName)
 	if err := q.Select(&rows, stmt, o.namespace, limit); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
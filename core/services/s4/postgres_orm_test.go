@@ -79,6 +79,9 @@ func TestPostgresORM_UpdateAndGet(t *testing.T) {
 	for _, row := range rows {
 		gotRow, err := orm.Get(row.Address, row.SlotId)
 		assert.NoError(t, err)
+		assert.False(t, gotRow.CreatedAt.IsZero())
+		assert.False(t, gotRow.UpdatedAt.Before(gotRow.CreatedAt))
+		gotRow.CreatedAt, gotRow.UpdatedAt = time.Time{}, time.Time{}
 		assert.Equal(t, row, gotRow)
 	}
 
@@ -87,6 +90,36 @@ func TestPostgresORM_UpdateAndGet(t *testing.T) {
 	assert.ErrorIs(t, err, s4.ErrNotFound)
 }
 
+func TestPostgresORM_Timestamps(t *testing.T) {
+	t.Parallel()
+
+	orm := setupORM(t, "test")
+	row := generateTestRows(t, 1)[0]
+	createdAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Microsecond)
+	row.UpdatedAt = createdAt
+	assert.NoError(t, orm.Update(row))
+
+	row.Version++
+	row.UpdatedAt = createdAt.Add(time.Minute)
+	assert.NoError(t, orm.Update(row))
+
+	gotRow, err := orm.Get(row.Address, row.SlotId)
+	assert.NoError(t, err)
+	assert.True(t, createdAt.Equal(gotRow.CreatedAt))
+	assert.True(t, row.UpdatedAt.Equal(gotRow.UpdatedAt))
+
+	// Confirming the record doesn't modify it.
+	updatedAt := row.UpdatedAt
+	row.Confirmed = true
+	row.UpdatedAt = updatedAt.Add(time.Minute)
+	assert.NoError(t, orm.Update(row))
+
+	gotRow, err = orm.Get(row.Address, row.SlotId)
+	assert.NoError(t, err)
+	assert.True(t, gotRow.Confirmed)
+	assert.True(t, updatedAt.Equal(gotRow.UpdatedAt))
+}
+
 func TestPostgresORM_DeleteExpired(t *testing.T) {
 	t.Parallel()
 
@@ -153,6 +186,7 @@ func TestPostgresORM_GetSnapshot(t *testing.T) {
 				assert.Equal(t, snapshotRow.Version, sr.Version)
 				assert.Equal(t, snapshotRow.Expiration, sr.Expiration)
 				assert.Equal(t, snapshotRow.Confirmed, sr.Confirmed)
+				assert.Equal(t, uint64(len(sr.Payload)), snapshotRow.PayloadSize)
 			}
 		})
 
@@ -2,6 +2,7 @@ package s4
 
 import (
 	"context"
+	"time"
 
 	"github.com/smartcontractkit/chainlink/v2/core/logger"
 	"github.com/smartcontractkit/chainlink/v2/core/services/pg"
@@ -36,10 +37,15 @@ type Record struct {
 
 // Metadata is the internal S4 data associated with a Record
 type Metadata struct {
+	// Version is the data version of the stored record.
+	Version uint64
 	// Confirmed turns true once consensus is reached.
 	Confirmed bool
 	// Signature contains the original user signature.
 	Signature []byte
+	// CreatedAt is when the slot was first written, UpdatedAt is when the record was last written.
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 //go:generate mockery --quiet --name Storage --output ./mocks/ --case=underscore
@@ -55,6 +61,10 @@ type Storage interface {
 	// The returned Record & Metadata are always a copy.
 	Get(ctx context.Context, key *Key) (*Record, *Metadata, error)
 
+	// GetIncludingExpired works like Get, but also returns expired records.
+	// Callers must compare Record.Expiration with the current time themselves.
+	GetIncludingExpired(ctx context.Context, key *Key) (*Record, *Metadata, error)
+
 	// Put creates (or updates) a record identified by the specified key.
 	// For signature calculation see envelope.go
 	Put(ctx context.Context, key *Key, record *Record, signature []byte) error
@@ -64,6 +74,30 @@ type Storage interface {
 	List(ctx context.Context, address common.Address) ([]*SnapshotRow, error)
 }
 
+// BackendVersion is bumped whenever the way storage persists or validates records changes,
+// so that nodes running different storage implementations can be told apart.
+const BackendVersion = "1"
+
+// BackendInfo identifies the implementation behind a Storage.
+type BackendInfo struct {
+	// Type is e.g. "postgres" or "in_memory".
+	Type    string
+	Version string
+}
+
+// BackendInfoProvider is implemented by storages that can describe their backend.
+type BackendInfoProvider interface {
+	BackendInfo() BackendInfo
+}
+
+// GetBackendInfo returns the BackendInfo of storage, or "unknown" type and version if it doesn't provide one.
+func GetBackendInfo(storage Storage) BackendInfo {
+	if provider, ok := storage.(BackendInfoProvider); ok {
+		return provider.BackendInfo()
+	}
+	return BackendInfo{Type: "unknown", Version: "unknown"}
+}
+
 type storage struct {
 	lggr       logger.Logger
 	contraints Constraints
@@ -72,6 +106,7 @@ type storage struct {
 }
 
 var _ Storage = (*storage)(nil)
+var _ BackendInfoProvider = (*storage)(nil)
 
 func NewStorage(lggr logger.Logger, contraints Constraints, orm ORM, clock utils.Clock) Storage {
 	return &storage{
@@ -82,11 +117,33 @@ func NewStorage(lggr logger.Logger, contraints Constraints, orm ORM, clock utils
 	}
 }
 
+func (s *storage) BackendInfo() BackendInfo {
+	info := BackendInfo{Type: "custom", Version: BackendVersion}
+	switch s.orm.(type) {
+	case *orm:
+		info.Type = "postgres"
+	case *inMemoryOrm:
+		info.Type = "in_memory"
+	}
+	return info
+}
+
 func (s *storage) Constraints() Constraints {
 	return s.contraints
 }
 
 func (s *storage) Get(ctx context.Context, key *Key) (*Record, *Metadata, error) {
+	record, metadata, err := s.GetIncludingExpired(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.Expiration <= s.clock.Now().UnixMilli() {
+		return nil, nil, ErrNotFound
+	}
+	return record, metadata, nil
+}
+
+func (s *storage) GetIncludingExpired(ctx context.Context, key *Key) (*Record, *Metadata, error) {
 	if key.SlotId >= s.contraints.MaxSlotsPerUser {
 		return nil, nil, ErrSlotIdTooBig
 	}
@@ -97,10 +154,6 @@ func (s *storage) Get(ctx context.Context, key *Key) (*Record, *Metadata, error)
 		return nil, nil, err
 	}
 
-	if row.Expiration <= s.clock.Now().UnixMilli() {
-		return nil, nil, ErrNotFound
-	}
-
 	record := &Record{
 		Payload:    make([]byte, len(row.Payload)),
 		Expiration: row.Expiration,
@@ -108,8 +161,11 @@ func (s *storage) Get(ctx context.Context, key *Key) (*Record, *Metadata, error)
 	copy(record.Payload, row.Payload)
 
 	metadata := &Metadata{
+		Version:   row.Version,
 		Confirmed: row.Confirmed,
 		Signature: make([]byte, len(row.Signature)),
+		CreatedAt: row.CreatedAt,
+		UpdatedAt: row.UpdatedAt,
 	}
 	copy(metadata.Signature, row.Signature)
 
@@ -146,6 +202,7 @@ func (s *storage) Put(ctx context.Context, key *Key, record *Record, signature [
 		Expiration: record.Expiration,
 		Confirmed:  false,
 		Signature:  make([]byte, len(signature)),
+		UpdatedAt:  s.clock.Now().UTC(),
 	}
 	copy(row.Payload, record.Payload)
 	copy(row.Signature, signature)
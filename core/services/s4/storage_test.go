@@ -38,6 +38,19 @@ func TestStorage_Constraints(t *testing.T) {
 	assert.Equal(t, constraints, c)
 }
 
+func TestStorage_BackendInfo(t *testing.T) {
+	t.Parallel()
+
+	clock := utils.NewFixedClock(time.Now())
+	storage := s4.NewStorage(logger.TestLogger(t), constraints, s4.NewInMemoryORM(), clock)
+	assert.Equal(t, s4.BackendInfo{Type: "in_memory", Version: s4.BackendVersion}, s4.GetBackendInfo(storage))
+
+	_, storage = setupTestStorage(t, time.Now())
+	assert.Equal(t, s4.BackendInfo{Type: "custom", Version: s4.BackendVersion}, s4.GetBackendInfo(storage))
+
+	assert.Equal(t, s4.BackendInfo{Type: "unknown", Version: "unknown"}, s4.GetBackendInfo(mocks.NewStorage(t)))
+}
+
 func TestStorage_Errors(t *testing.T) {
 	t.Parallel()
 
@@ -163,7 +176,9 @@ func TestStorage_PutAndGet(t *testing.T) {
 	signature, err := env.Sign(privateKey)
 	assert.NoError(t, err)
 
-	ormMock.On("Update", mock.Anything, mock.Anything).Return(nil)
+	ormMock.On("Update", mock.MatchedBy(func(row *s4.Row) bool {
+		return row.UpdatedAt.Equal(now)
+	}), mock.Anything).Return(nil)
 	ormMock.On("Get", utils.NewBig(key.Address.Big()), uint(2), mock.Anything).Return(&s4.Row{
 		Address:    utils.NewBig(key.Address.Big()),
 		SlotId:     key.SlotId,
@@ -171,6 +186,8 @@ func TestStorage_PutAndGet(t *testing.T) {
 		Payload:    record.Payload,
 		Expiration: record.Expiration,
 		Signature:  signature,
+		CreatedAt:  now.Add(-time.Hour),
+		UpdatedAt:  now,
 	}, nil)
 
 	err = storage.Put(testutils.Context(t), key, record, signature)
@@ -178,12 +195,45 @@ func TestStorage_PutAndGet(t *testing.T) {
 
 	rec, metadata, err := storage.Get(testutils.Context(t), key)
 	assert.NoError(t, err)
+	assert.Equal(t, key.Version, metadata.Version)
 	assert.Equal(t, false, metadata.Confirmed)
 	assert.Equal(t, signature, metadata.Signature)
+	assert.Equal(t, now.Add(-time.Hour), metadata.CreatedAt)
+	assert.Equal(t, now, metadata.UpdatedAt)
 	assert.Equal(t, record.Expiration, rec.Expiration)
 	assert.Equal(t, record.Payload, rec.Payload)
 }
 
+func TestStorage_GetIncludingExpired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	ormMock, storage := setupTestStorage(t, now)
+
+	address := testutils.NewAddress()
+	key := &s4.Key{
+		Address: address,
+		SlotId:  1,
+	}
+	expiration := now.Add(-time.Minute).UnixMilli()
+	ormMock.On("Get", utils.NewBig(key.Address.Big()), uint(1), mock.Anything).Return(&s4.Row{
+		Address:    utils.NewBig(key.Address.Big()),
+		SlotId:     key.SlotId,
+		Version:    3,
+		Payload:    []byte("foobar"),
+		Expiration: expiration,
+	}, nil)
+
+	_, _, err := storage.Get(testutils.Context(t), key)
+	assert.ErrorIs(t, err, s4.ErrNotFound)
+
+	rec, metadata, err := storage.GetIncludingExpired(testutils.Context(t), key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), metadata.Version)
+	assert.Equal(t, expiration, rec.Expiration)
+	assert.Equal(t, []byte("foobar"), rec.Payload)
+}
+
 func TestStorage_List(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,9 @@
+-- +goose Up
+
+ALTER TABLE "s4".shared ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+UPDATE "s4".shared SET created_at = updated_at;
+ALTER TABLE "s4".shared ALTER COLUMN created_at SET NOT NULL;
+
+-- +goose Down
+
+ALTER TABLE "s4".shared DROP COLUMN IF EXISTS created_at;
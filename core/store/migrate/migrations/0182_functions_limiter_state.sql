@@ -0,0 +1,11 @@
+-- +goose Up
+
+CREATE TABLE functions_limiter_state(
+    state_key TEXT PRIMARY KEY,
+    state JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- +goose Down
+
+DROP TABLE functions_limiter_state;